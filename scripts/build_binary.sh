@@ -10,11 +10,17 @@ if [[ -z ${GO_VERSION} ]]; then GO_VERSION=1.8; fi
 NAME=ecs-task-tracker
 BUILD=$(get_build)
 BRANCH_NAME=$(get_branch)
+VERSION=$(get_version)
+COMMIT=$(get_commit)
+BUILD_TIME=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-s -X main.version=${VERSION} -X main.commit=${COMMIT} -X main.buildTime=${BUILD_TIME}"
 
 echo "Building binary:"
 echo "  KMS name:    ${NAME}"
 echo "  Build:       ${BUILD}"
 echo "  Branch:      ${BRANCH_NAME}"
+echo "  Version:     ${VERSION}"
+echo "  Commit:      ${COMMIT}"
 echo "  GO version:  ${GO_VERSION}"
 docker run --rm -i \
        -v ${HOME}/.ssh:/root/.ssh \
@@ -23,8 +29,8 @@ docker run --rm -i \
        -w /go/src/github.com/tskinn/${NAME} \
        golang:${GO_VERSION} \
        sh -c "cd src && go get -d && \
-      GOOS=${GOOS} CGO_ENABLED=0 go build -a -ldflags=\"-s\" \
-      -o ../bin/${GOOS}/${NAME} -ldflags \"-X main.BUILD=${BUILD}\" ."
+      GOOS=${GOOS} CGO_ENABLED=0 go build -a \
+      -o ../bin/${GOOS}/${NAME} -ldflags \"${LDFLAGS}\" ."
 
 if [ $? -eq 0 ]; then
     echo "${GOOS} binary successfully built at bin/${GOOS}/${NAME}"
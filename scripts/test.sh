@@ -22,8 +22,8 @@ docker run --rm -i \
        -v ${PWD}:/go/src/github.com/tskinn/${NAME} \
        -w /go/src/github.com/tskinn/${NAME} \
        golang:${GO_VERSION} \
-       sh -c "cd src/utils && go get -d -t && \
-      GOOS=${GOOS} CGO_ENABLED=0 go test -covermode=count"
+       sh -c "cd src && go get -d -t ./... && \
+      GOOS=${GOOS} CGO_ENABLED=0 go test -covermode=count ./..."
 
 if [ $? -eq 0 ]; then
     echo "successfully tested!"
@@ -18,6 +18,15 @@ get_branch() {
     fi
 }
 
+get_version() {
+    # the closest tag, or the commit when there are no tags
+    git describe --tags --always --dirty 2>/dev/null || echo dev
+}
+
+get_commit() {
+    git rev-parse --short HEAD 2>/dev/null || echo unknown
+}
+
 get_build() {
     local BUILD_TIME=$(sh -c "date -u +%m%d%H%M")
     if [[ ${BUILD_NUMBER} == "" ]]; then
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
+)
+
+// routeAPI adds the routes of version 1 of the json api to group. Changes to
+// them that aren't backwards compatible belong in a new version
+func routeAPI(api *echo.Group) {
+	api.GET("/openapi.json", openAPI)
+	api.POST("/syncs", apiSyncAll)
+	api.POST("/services/:name/sync", apiSync)
+	api.GET("/services/:name/diff", apiDiff)
+	api.GET("/backends", apiBackends)
+	api.GET("/backends/:name", apiBackend)
+	api.POST("/prunes", apiPrune)
+}
+
+// apiError is the body of an api response that failed
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// apiFail responds with an error and the http status of its kind
+func apiFail(c echo.Context, err error) error {
+	return c.JSON(statusOf(err), apiError{Error: err.Error()})
+}
+
+// synced is the result of syncing one or every service
+type synced struct {
+	Service string `json:"service,omitempty"`
+	DryRun  bool   `json:"dryRun"`
+	// Mutations are the changes a dry run planned. They are empty otherwise
+	Mutations []utils.Mutation `json:"mutations"`
+}
+
+func newSynced(service string, mutations []utils.Mutation) synced {
+	// only dry runs return mutations
+	s := synced{Service: service, DryRun: mutations != nil, Mutations: mutations}
+	if s.Mutations == nil {
+		s.Mutations = []utils.Mutation{}
+	}
+	return s
+}
+
+// apiSyncAll syncs every service of ?cluster, or of every cluster
+func apiSyncAll(c echo.Context) error {
+	mutations, err := utils.HandleSyncAll(c.QueryParam("cluster"), dryRun(c))
+	if err != nil {
+		return apiFail(c, err)
+	}
+	return c.JSON(http.StatusOK, newSynced("", mutations))
+}
+
+// apiSync syncs a service in ?cluster, or in every cluster it runs in
+func apiSync(c echo.Context) error {
+	service := c.Param("name")
+	mutations, err := utils.HandleSync(c.QueryParam("cluster"), service, dryRun(c))
+	if err != nil {
+		return apiFail(c, err)
+	}
+	return c.JSON(http.StatusOK, newSynced(service, mutations))
+}
+
+// apiDiff compares the servers of a service in ecs with its backend
+func apiDiff(c echo.Context) error {
+	service := c.Param("name")
+	status, err := utils.HandleDiff(c.QueryParam("cluster"), service)
+	if err != nil {
+		return apiFail(c, err)
+	}
+	return c.JSON(http.StatusOK, diffed{Service: service, Status: status})
+}
+
+// apiBackends lists every backend in the traefik table
+func apiBackends(c echo.Context) error {
+	backends, err := utils.HandleBackends()
+	if err != nil {
+		return apiFail(c, err)
+	}
+	return c.JSON(http.StatusOK, backends)
+}
+
+// apiBackend gets the item of a backend
+func apiBackend(c echo.Context) error {
+	backend, err := utils.HandleBackend(c.Param("name"))
+	if err != nil {
+		return apiFail(c, err)
+	}
+	return c.JSON(http.StatusOK, backend)
+}
+
+// pruned is the result of pruning orphaned backends
+type pruned struct {
+	DryRun   bool           `json:"dryRun"`
+	Backends []utils.Pruned `json:"backends"`
+}
+
+// apiPrune prunes orphaned backends once
+func apiPrune(c echo.Context) error {
+	cfg := activeConfig()
+	dry := dryRun(c) || cfg.DryRun || cfg.Prune.DryRun
+	backends, err := utils.HandlePrune(dry)
+	if err != nil {
+		return apiFail(c, err)
+	}
+	if backends == nil {
+		backends = []utils.Pruned{}
+	}
+	return c.JSON(http.StatusOK, pruned{DryRun: dry, Backends: backends})
+}
+
+// openAPI serves the description of the api
+func openAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, []byte(openAPIDoc))
+}
+
+// openAPIDoc describes /api/v1 in openapi 3
+const openAPIDoc = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "ecs-task-tracker",
+    "description": "Keeps the traefik backends in dynamodb in sync with the tasks of ecs services",
+    "version": "1"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearer": []}],
+  "paths": {
+    "/syncs": {
+      "post": {
+        "summary": "Sync every service",
+        "description": "Puts the servers of every tracked service in ecs in their backends",
+        "parameters": [
+          {"$ref": "#/components/parameters/cluster"},
+          {"$ref": "#/components/parameters/dryRun"}
+        ],
+        "responses": {
+          "200": {"description": "The services were synced", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Synced"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/services/{name}/sync": {
+      "post": {
+        "summary": "Sync a service",
+        "description": "Puts the servers of a service in ecs in its backend",
+        "parameters": [
+          {"$ref": "#/components/parameters/service"},
+          {"$ref": "#/components/parameters/cluster"},
+          {"$ref": "#/components/parameters/dryRun"}
+        ],
+        "responses": {
+          "200": {"description": "The service was synced", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Synced"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/services/{name}/diff": {
+      "get": {
+        "summary": "Diff a service",
+        "description": "Compares the servers of a service in ecs with the servers of its backend",
+        "parameters": [
+          {"$ref": "#/components/parameters/service"},
+          {"$ref": "#/components/parameters/cluster"}
+        ],
+        "responses": {
+          "200": {"description": "Whether the service is in sync", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Diff"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/backends": {
+      "get": {
+        "summary": "List backends",
+        "description": "Lists every backend in the traefik table sorted by name",
+        "responses": {
+          "200": {"description": "The backends", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Backend"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/backends/{name}": {
+      "get": {
+        "summary": "Get a backend",
+        "description": "Gets the dynamodb item of a backend by its name",
+        "parameters": [
+          {"name": "name", "in": "path", "required": true, "description": "Name of the backend", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The backend", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Backend"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/prunes": {
+      "post": {
+        "summary": "Prune orphaned backends",
+        "description": "Deletes or empties the backends this tracker owns that no tracked service or task group has had for prune.gracePeriod",
+        "parameters": [
+          {"$ref": "#/components/parameters/dryRun"}
+        ],
+        "responses": {
+          "200": {"description": "What happened to each orphaned backend", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Pruned"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "responses": {
+          "200": {"description": "The openapi document of the api", "content": {"application/json": {}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer", "description": "auth.token. Not required when it isn't set"}
+    },
+    "parameters": {
+      "service": {"name": "name", "in": "path", "required": true, "description": "Name of the ecs service", "schema": {"type": "string"}},
+      "cluster": {"name": "cluster", "in": "query", "description": "Only act on this tracked cluster. Every tracked cluster by default", "schema": {"type": "string"}},
+      "dryRun": {"name": "dryRun", "in": "query", "description": "Only plan the changes", "schema": {"type": "boolean", "default": false}}
+    },
+    "responses": {
+      "Error": {"description": "The request failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Synced": {
+        "type": "object",
+        "required": ["dryRun", "mutations"],
+        "properties": {
+          "service": {"type": "string", "description": "The service synced. Missing when every service was"},
+          "dryRun": {"type": "boolean"},
+          "mutations": {"type": "array", "description": "The changes a dry run planned", "items": {"$ref": "#/components/schemas/Mutation"}}
+        }
+      },
+      "Mutation": {
+        "type": "object",
+        "required": ["id", "action"],
+        "properties": {
+          "id": {"type": "string", "description": "Id of the dynamodb item"},
+          "action": {"type": "string", "enum": ["create", "update", "delete"]},
+          "add": {"type": "array", "items": {"type": "string"}, "description": "Servers added to the backend"},
+          "remove": {"type": "array", "items": {"type": "string"}, "description": "Servers removed from the backend"},
+          "version": {"type": "integer", "description": "Version of the item after the change"}
+        }
+      },
+      "Diff": {
+        "type": "object",
+        "required": ["service", "status"],
+        "properties": {
+          "service": {"type": "string"},
+          "status": {"type": "string", "enum": ["in sync", "out of sync", "ignored"]}
+        }
+      },
+      "Backend": {
+        "type": "object",
+        "required": ["id", "name", "version", "backend"],
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "version": {"type": "integer", "description": "Incremented by every change to the item"},
+          "owner": {"type": "string", "description": "The tracker that created the backend"},
+          "orphanedAt": {"type": "integer", "description": "Unix time pruning first found the backend orphaned"},
+          "backend": {
+            "type": "object",
+            "properties": {
+              "servers": {
+                "type": "object",
+                "additionalProperties": {
+                  "type": "object",
+                  "properties": {"url": {"type": "string"}, "weight": {"type": "integer"}}
+                }
+              },
+              "loadBalancer": {"type": "object", "properties": {"method": {"type": "string"}}}
+            }
+          }
+        }
+      },
+      "Pruned": {
+        "type": "object",
+        "required": ["dryRun", "backends"],
+        "properties": {
+          "dryRun": {"type": "boolean"},
+          "backends": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["id", "action"],
+              "properties": {
+                "id": {"type": "string", "description": "Id of the dynamodb item of the backend"},
+                "action": {"type": "string", "enum": ["delete", "empty", "mark", "wait", "revive"]}
+              }
+            }
+          }
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {"error": {"type": "string"}}
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
+)
+
+// commands are the subcommands of ecs-task-tracker by name. They take the
+// flags of serve too and print their results to stdout while logging to stderr
+var commands = map[string]func(args []string) error{
+	"serve":         serve,
+	"replay":        replay,
+	"diff":          diffCommand,
+	"sync":          syncCommand,
+	"list":          listCommand,
+	"show":          showCommand,
+	"servers":       serversCommand,
+	"migrate-names": migrateNamesCommand,
+}
+
+// outputs are the formats commands print their results in
+var outputs = []string{"table", "json"}
+
+// startCommand loads the configuration of a command whose own flags are added
+// by addFlags, connects to aws and returns the arguments of the command
+func startCommand(name string, args []string, addFlags func(flags *flag.FlagSet)) (*config.Config, []string, error) {
+	flags := flag.NewFlagSet("ecs-task-tracker "+name, flag.ContinueOnError)
+	if addFlags != nil {
+		addFlags(flags)
+	}
+	cfg, opts, err := parseConfig(flags, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if output := flags.Lookup("output"); output != nil && !contains(outputs, output.Value.String()) {
+		return nil, nil, errors.New("-output must be one of " + strings.Join(outputs, " or "))
+	}
+	utils.LogTo(os.Stderr)
+	if _, err := connect(cfg); err != nil {
+		return nil, nil, err
+	}
+	return cfg, opts.args, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func outputFlag(flags *flag.FlagSet) *string {
+	return flags.String("output", "table", "format of the results: table or json")
+}
+
+// printJSON prints v as indented json
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json.MarshalIndent()")
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// printTable prints rows under a header with aligned columns
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// diffed is the status of a service in the output of diff
+type diffed struct {
+	Service string `json:"service"`
+	Status  string `json:"status"`
+}
+
+// diffCommand compares the servers of one or every service in ecs with their backends
+//
+//	ecs-task-tracker diff [-output table|json] [service]
+func diffCommand(args []string) error {
+	var output *string
+	_, args, err := startCommand("diff", args, func(flags *flag.FlagSet) {
+		output = outputFlag(flags)
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errors.New("diff takes at most one service")
+	}
+
+	diffs := make([]diffed, 0)
+	if len(args) == 1 {
+		status, err := utils.HandleDiff("", args[0])
+		if err != nil {
+			return err
+		}
+		diffs = append(diffs, diffed{Service: args[0], Status: status})
+	} else {
+		outOfSync, ignored, diffErr := utils.HandleDiffAll("")
+		for _, service := range outOfSync {
+			diffs = append(diffs, diffed{Service: service, Status: utils.StatusOutOfSync})
+		}
+		for _, service := range ignored {
+			diffs = append(diffs, diffed{Service: service, Status: utils.StatusIgnored})
+		}
+		// services that failed to be diffed are neither
+		err = diffErr
+	}
+
+	if *output == "json" {
+		if perr := printJSON(diffs); perr != nil {
+			return perr
+		}
+		return err
+	}
+	if len(args) == 0 && len(diffs) == 0 && err == nil {
+		fmt.Println("all services in sync")
+		return nil
+	}
+	rows := make([][]string, len(diffs))
+	for i, d := range diffs {
+		rows[i] = []string{d.Service, d.Status}
+	}
+	if perr := printTable([]string{"SERVICE", "STATUS"}, rows); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// syncCommand puts the servers of one or every service in ecs in their backends
+//
+//	ecs-task-tracker sync [-dry-run] [service]
+func syncCommand(args []string) error {
+	var dryRun *bool
+	cfg, args, err := startCommand("sync", args, func(flags *flag.FlagSet) {
+		dryRun = flags.Bool("dry-run", false, "only print the changes that would be made")
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errors.New("sync takes at most one service")
+	}
+
+	var mutations []utils.Mutation
+	done := "all services synced"
+	if len(args) == 1 {
+		mutations, err = utils.HandleSync("", args[0], *dryRun || cfg.DryRun)
+		done = args[0] + " synced"
+	} else {
+		mutations, err = utils.HandleSyncAll("", *dryRun || cfg.DryRun)
+	}
+	if mutations != nil {
+		fmt.Println(planned(mutations))
+	} else if err == nil {
+		fmt.Println(done)
+	}
+	return err
+}
+
+// listCommand lists the backends in the traefik table
+//
+//	ecs-task-tracker list [-output table|json] backends
+func listCommand(args []string) error {
+	var output *string
+	_, args, err := startCommand("list", args, func(flags *flag.FlagSet) {
+		output = outputFlag(flags)
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 || args[0] != "backends" {
+		return errors.New("list takes what to list: backends")
+	}
+
+	backends, err := utils.HandleBackends()
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(backends)
+	}
+	rows := make([][]string, len(backends))
+	for i, b := range backends {
+		rows[i] = []string{b.Name, strconv.FormatUint(b.Version, 10), strconv.Itoa(len(b.Backend.Servers)), b.Owner}
+	}
+	return printTable([]string{"NAME", "VERSION", "SERVERS", "OWNER"}, rows)
+}
+
+// showCommand prints the dynamodb item of a backend as json
+//
+//	ecs-task-tracker show backend <name>
+func showCommand(args []string) error {
+	_, args, err := startCommand("show", args, nil)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 || args[0] != "backend" {
+		return errors.New("show takes what to show and its name: backend <name>")
+	}
+
+	backend, err := utils.HandleBackend(args[1])
+	if err != nil {
+		return err
+	}
+	return printJSON(backend)
+}
+
+// serversCommand lists the addresses ecs reports for the tasks of a service
+//
+//	ecs-task-tracker servers [-output table|json] <service>
+func serversCommand(args []string) error {
+	var output *string
+	_, args, err := startCommand("servers", args, func(flags *flag.FlagSet) {
+		output = outputFlag(flags)
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("servers takes one service")
+	}
+
+	servers, err := utils.HandleServers("", args[0])
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return printJSON(servers)
+	}
+	rows := make([][]string, len(servers))
+	for i, s := range servers {
+		rows[i] = []string{s.Address, s.TaskArn, s.Cluster, s.Backend}
+	}
+	return printTable([]string{"ADDRESS", "TASK", "CLUSTER", "BACKEND"}, rows)
+}
+
+// migrateNamesCommand renames the backends named by the naming of an older
+// config file to the current naming
+//
+//	ecs-task-tracker migrate-names <from-config>
+func migrateNamesCommand(args []string) error {
+	_, args, err := startCommand("migrate-names", args, nil)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("migrate-names takes the config file to migrate from")
+	}
+	from, err := loadMigrateFrom(args[0])
+	if err != nil {
+		return err
+	}
+	return utils.MigrateNames(from)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
+)
+
+// active holds the *config.Config in use
+var active atomic.Value
+
+func activeConfig() *config.Config {
+	return active.Load().(*config.Config)
+}
+
+// options are the command line flags that aren't configuration
+type options struct {
+	configFile   string
+	printConfig  bool
+	printVersion bool
+	// args are the arguments left after the flags
+	args []string
+}
+
+// loadConfig builds the configuration from the defaults, the config file,
+// the environment and lastly the command line flags
+func loadConfig(args []string) (*config.Config, options, error) {
+	return parseConfig(flag.NewFlagSet("ecs-task-tracker", flag.ContinueOnError), args)
+}
+
+// parseConfig is loadConfig with the flags of a command added to flags. Flags
+// may come before and after the arguments of the command. A command with a
+// dry-run flag of its own replaces the -dry-run flag
+func parseConfig(flags *flag.FlagSet, args []string) (*config.Config, options, error) {
+	cfg := config.Default()
+	opts := options{}
+	flags.StringVar(&opts.configFile, "config", os.Getenv("CONFIG_FILE"), "path to a yaml config file")
+	flags.BoolVar(&opts.printConfig, "print-config", false, "print the effective configuration and exit")
+	flags.BoolVar(&opts.printVersion, "version", false, "print the version and exit")
+	port := flags.String("port", "", "address to listen on of the form :port")
+	region := flags.String("region", "", "default aws region")
+	table := flags.String("table", "", "traefik dynamodb table")
+	clusters := flags.String("cluster", "", "comma separated clusters of the form name[@region[@roleArn]]")
+	namePolicy := flags.String("name-policy", "", "how backends are named: service, cluster or first")
+	maxTries := flags.Int("max-tries", 0, "times to try updating a backend that is locked")
+	debug := flags.String("debug", "", "print debug logs: on or off")
+	legacy := flags.String("legacy-routes", "", "serve the unversioned /diff, /sync, /syncslow and /prune routes: on or off")
+	dryRun := new(string)
+	if flags.Lookup("dry-run") == nil {
+		dryRun = flags.String("dry-run", "", "only log the changes that would be made: on or off")
+	}
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, opts, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		opts.args = append(opts.args, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if opts.configFile != "" {
+		if err := config.LoadFile(cfg, opts.configFile); err != nil {
+			return nil, opts, err
+		}
+	}
+	if err := config.LoadEnv(cfg); err != nil {
+		return nil, opts, err
+	}
+
+	if *port != "" {
+		cfg.Port = *port
+	}
+	if *region != "" {
+		cfg.Region = *region
+	}
+	if *table != "" {
+		cfg.Tables.Traefik = *table
+	}
+	if *clusters != "" {
+		cfg.Clusters = config.ParseClusters(*clusters)
+	}
+	if *namePolicy != "" {
+		cfg.NamePolicy = *namePolicy
+	}
+	if *maxTries != 0 {
+		cfg.Retry.MaxTries = *maxTries
+	}
+	if *debug != "" {
+		on, err := config.ParseBool(*debug)
+		if err != nil {
+			return nil, opts, errors.Wrap(err, "-debug")
+		}
+		cfg.Debug = on
+	}
+	if *legacy != "" {
+		on, err := config.ParseBool(*legacy)
+		if err != nil {
+			return nil, opts, errors.Wrap(err, "-legacy-routes")
+		}
+		cfg.API.Legacy = on
+	}
+	if *dryRun != "" {
+		on, err := config.ParseBool(*dryRun)
+		if err != nil {
+			return nil, opts, errors.Wrap(err, "-dry-run")
+		}
+		cfg.DryRun = on
+	}
+	return cfg, opts, cfg.Validate()
+}
+
+// loadMigrateFrom loads the config file backends are migrated from
+func loadMigrateFrom(filename string) (*config.Config, error) {
+	from := config.Default()
+	if err := config.LoadFile(from, filename); err != nil {
+		return nil, err
+	}
+	// only the naming is used so the rest doesn't need to be valid
+	if err := from.Naming.Validate(); err != nil {
+		return nil, errors.Wrap(err, filename)
+	}
+	return from, nil
+}
+
+// clusters creates the clusters to track
+func clusters(sess *session.Session, cfg *config.Config) []*utils.Cluster {
+	clusters := make([]*utils.Cluster, len(cfg.Clusters))
+	for i, cluster := range cfg.Clusters {
+		clusters[i] = utils.NewCluster(sess, cluster.Name, cluster.Region, cluster.RoleArn)
+	}
+	return clusters
+}
+
+// sinks creates the sinks that are enabled
+func sinks(sess *session.Session, cfg *config.Config) []utils.Sink {
+	sinks := make([]utils.Sink, 0)
+	if cfg.Sinks.CloudMap.Namespace != "" {
+		sinks = append(sinks, utils.NewCloudMap(servicediscovery.New(sess), cfg.Sinks.CloudMap.Namespace))
+	}
+	return sinks
+}
+
+// reload loads the configuration again from the args serve started with and
+// swaps it in if it is valid
+func reload(sess *session.Session, args []string) {
+	cfg, _, err := loadConfig(args)
+	if err != nil {
+		utils.ReloadFailed(err)
+		return
+	}
+	prev := activeConfig()
+	if cfg.Port != prev.Port || cfg.Region != prev.Region || cfg.Timeouts != prev.Timeouts || cfg.API != prev.API {
+		utils.Log(utils.LevelWarn, "config", "changes to port, region, timeouts and api take effect after a restart")
+	}
+	utils.Reload(cfg, clusters(sess, cfg), sinks(sess, cfg))
+	active.Store(cfg)
+	if cfg.Hash() != prev.Hash() {
+		utils.Log(utils.LevelInfo, "config", "configuration hash is now "+cfg.Hash())
+		recordBuild()
+	}
+}
+
+// watchReloads reloads the configuration on SIGHUP and whenever the config file changes
+func watchReloads(sess *session.Session, configFile string, args []string) {
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	if configFile != "" {
+		go config.Watch(configFile, 5*time.Second, func() {
+			reloads <- syscall.SIGHUP
+		})
+	}
+	for range reloads {
+		reload(sess, args)
+	}
+}
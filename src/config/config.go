@@ -0,0 +1,800 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// NamePolicyService names backends after the ecs service alone. Services with
+	// the same name in different clusters share, and clobber, one backend
+	NamePolicyService = "service"
+	// NamePolicyCluster names every backend <cluster>-<service>
+	NamePolicyCluster = "cluster"
+	// NamePolicyFirst names the backends of the first configured cluster after the
+	// service and prefixes the backends of every other cluster like NamePolicyCluster
+	NamePolicyFirst = "first"
+
+	// PruneDelete deletes orphaned backends
+	PruneDelete = "delete"
+	// PruneEmpty removes every server from orphaned backends but keeps the items
+	PruneEmpty = "empty"
+
+	// WriteStrategyLock adds and removes servers by writing the whole backend
+	// conditioned on its version
+	WriteStrategyLock = "lock"
+	// WriteStrategyPath adds and removes single servers with map path update
+	// expressions so events for the same backend don't conflict
+	WriteStrategyPath = "path"
+
+	// TaskPolicyIgnore skips tasks outside of services that no task group matches
+	TaskPolicyIgnore = "ignore"
+	// TaskPolicyGroup tracks tasks outside of services that no task group matches
+	// under a backend named after their group without any family: prefix
+	TaskPolicyGroup = "group"
+
+	// LogLevelDebug logs what every operation is doing
+	LogLevelDebug = "debug"
+	// LogLevelInfo logs the outcome of operations
+	LogLevelInfo = "info"
+	// LogLevelWarn logs what was skipped or retried
+	LogLevelWarn = "warn"
+	// LogLevelError only logs failures
+	LogLevelError = "error"
+
+	// TracingNone doesn't export spans
+	TracingNone = "none"
+	// TracingOTLP exports spans to an opentelemetry collector over otlp/http
+	TracingOTLP = "otlp"
+)
+
+// LogComponents are the parts of ecs-task-tracker whose log level can be set on its own
+var LogComponents = []string{"backends", "config", "diff", "events", "main", "migrate", "prune", "ready", "sync", "table"}
+
+// Config is the configuration of ecs-task-tracker
+type Config struct {
+	Port          string      `yaml:"port"`
+	Region        string      `yaml:"region"`
+	Debug         bool        `yaml:"debug"`
+	Logging       Logging     `yaml:"logging"`
+	Tracing       Tracing     `yaml:"tracing"`
+	DryRun        bool        `yaml:"dryRun"`
+	NamePolicy    string      `yaml:"namePolicy"`
+	Naming        Naming      `yaml:"naming"`
+	WriteStrategy string      `yaml:"writeStrategy"`
+	Clusters      []Cluster   `yaml:"clusters"`
+	Tables        Tables      `yaml:"tables"`
+	Owner         string      `yaml:"owner"`
+	Prune         Prune       `yaml:"prune"`
+	Retry         Retry       `yaml:"retry"`
+	Timeouts      Timeouts    `yaml:"timeouts"`
+	Sinks         Sinks       `yaml:"sinks"`
+	Services      Services    `yaml:"services"`
+	Tasks         Tasks       `yaml:"tasks"`
+	Labels        Labels      `yaml:"labels"`
+	Auth          Auth        `yaml:"auth"`
+	API           API         `yaml:"api"`
+	Ready         Ready       `yaml:"ready"`
+	Dedupe        Dedupe      `yaml:"dedupe"`
+	Queue         Queue       `yaml:"queue"`
+	DeadLetters   DeadLetters `yaml:"deadLetters"`
+	Capture       Capture     `yaml:"capture"`
+}
+
+// Cluster is an ecs cluster to track
+type Cluster struct {
+	// Name is the name or arn of the cluster
+	Name string `yaml:"name"`
+	// Region defaults to the top level region
+	Region string `yaml:"region,omitempty"`
+	// RoleArn is an iam role to assume to reach the cluster
+	RoleArn string `yaml:"roleArn,omitempty"`
+}
+
+// Naming are go templates that name backends and their dynamodb items
+type Naming struct {
+	// Backend is the name of a backend. It is executed with .Service, the service
+	// or task group backend, .Cluster, .Account, .Region and .Labels, the docker
+	// labels of the task definition. Empty uses the name policy
+	Backend string `yaml:"backend"`
+	// ID is the id of the dynamodb item of a backend. It is executed with .Name,
+	// the name of the backend
+	ID string `yaml:"id"`
+}
+
+// Tables are the dynamodb tables written to
+type Tables struct {
+	Traefik string `yaml:"traefik"`
+	// Verify checks at startup that the traefik table exists with an id hash key
+	Verify bool `yaml:"verify"`
+	// Create creates the traefik table with on-demand billing if it is missing. It implies Verify
+	Create bool `yaml:"create"`
+	// Tags are put on a table that is created
+	Tags map[string]string `yaml:"tags"`
+}
+
+// Prune configures garbage collection of backends owned by this tracker that
+// no tracked service or task group has anymore
+type Prune struct {
+	// Interval between prunes. Zero only prunes when /api/v1/prunes is called
+	Interval Duration `yaml:"interval"`
+	// GracePeriod is how long a backend has to be orphaned before it is pruned
+	GracePeriod Duration `yaml:"gracePeriod"`
+	// Action is what happens to orphaned backends. Either delete or empty
+	Action string `yaml:"action"`
+	// DryRun only reports what pruning would do
+	DryRun bool `yaml:"dryRun"`
+}
+
+// Retry configures the exponential backoff of aws calls that are throttled or
+// fail transiently and of optimistic locking conflicts in dynamodb. Each retry
+// waits a random time up to delay doubled for every earlier retry
+type Retry struct {
+	MaxTries   int      `yaml:"maxTries"`
+	Delay      Duration `yaml:"delay"`
+	MaxDelay   Duration `yaml:"maxDelay"`
+	MaxElapsed Duration `yaml:"maxElapsed"`
+}
+
+// Timeouts of the http server and of aws api calls. Zero means no timeout
+type Timeouts struct {
+	Read  Duration `yaml:"read"`
+	Write Duration `yaml:"write"`
+	AWS   Duration `yaml:"aws"`
+}
+
+// Sinks are service discovery registries kept up to date besides dynamodb
+type Sinks struct {
+	CloudMap CloudMap `yaml:"cloudMap"`
+}
+
+// CloudMap registers tasks in an aws cloud map namespace when Namespace is set
+type CloudMap struct {
+	Namespace string `yaml:"namespace"`
+}
+
+// Services filters which ecs services are tracked. A service is tracked if its
+// name matches an include glob or regex, or there are none, doesn't match an
+// exclude glob or regex and has every tag in Tags
+type Services struct {
+	Include      []string          `yaml:"include"`
+	Exclude      []string          `yaml:"exclude"`
+	IncludeRegex []string          `yaml:"includeRegex"`
+	ExcludeRegex []string          `yaml:"excludeRegex"`
+	Tags         map[string]string `yaml:"tags"`
+	// TagCacheTTL is how long the tags of a service are remembered
+	TagCacheTTL Duration `yaml:"tagCacheTTL"`
+}
+
+// Tasks configures tasks that aren't part of a service, like ones started with
+// RunTask or by scheduled rules
+type Tasks struct {
+	// Policy is what happens to tasks no group matches. Either ignore or group
+	Policy string `yaml:"policy"`
+	// Groups map tasks to backends. The first group a task matches wins
+	Groups []TaskGroup `yaml:"groups"`
+}
+
+// TaskGroup maps the standalone tasks matching every field that is set to a backend
+type TaskGroup struct {
+	// Backend is the name of the backend before the name policy is applied
+	Backend string `yaml:"backend"`
+	// Group is a glob pattern matched against the group of the task like family:batch
+	Group string `yaml:"group,omitempty"`
+	// Family is the family of the task definition of the task
+	Family string `yaml:"family,omitempty"`
+	// StartedBy is what started the task like events-rule/nightly for a scheduled task
+	StartedBy string `yaml:"startedBy,omitempty"`
+}
+
+// Labels are the docker labels on container definitions that ecs-task-tracker reads
+type Labels struct {
+	// Port is the label whose value is the container port traffic is sent to.
+	// Tasks without it use the first network binding of the first container
+	Port string `yaml:"port"`
+}
+
+// Auth protects the http endpoints
+type Auth struct {
+	// Token is required as a bearer token on every endpoint except /event, /health and /ready
+	Token string `yaml:"token"`
+	// TopicArns are the only sns topics notifications and subscriptions are accepted from.
+	// Empty accepts every topic
+	TopicArns []string `yaml:"topicArns"`
+}
+
+// API configures the http api
+type API struct {
+	// Legacy serves the unversioned /diff, /sync, /syncslow and /prune routes next to /api/v1
+	Legacy bool `yaml:"legacy"`
+}
+
+// Ready configures the dependency checks of /ready
+type Ready struct {
+	// Timeout of each check
+	Timeout Duration `yaml:"timeout"`
+	// Endpoint is the url sns posts events to. When set the subscriptions of
+	// auth.topicArns must be confirmed for this endpoint. Otherwise any confirmed
+	// http subscription will do
+	Endpoint string `yaml:"endpoint"`
+}
+
+// Dedupe configures how events delivered more than once are recognized by
+// their sns message id and ecs event id
+type Dedupe struct {
+	// TTL is how long an event is remembered
+	TTL Duration `yaml:"ttl"`
+	// Table is a dynamodb table with an id hash key that remembers events for
+	// every replica. Empty remembers them in memory
+	Table string `yaml:"table"`
+}
+
+// DeadLetters configures where events that failed to be handled are kept so
+// they can be replayed. Failed events aren't kept when neither is set
+type DeadLetters struct {
+	// File is a json file on the local disk
+	File string `yaml:"file"`
+	// Table is a dynamodb table with an id hash key shared by every replica
+	Table string `yaml:"table"`
+}
+
+// Capture configures writing the sns messages /event receives to files so
+// they can be replayed offline with the replay command
+type Capture struct {
+	// Dir is the directory of the capture files. Empty captures nothing
+	Dir string `yaml:"dir"`
+	// MaxBytes is how large a capture file grows before a new one is started
+	MaxBytes int64 `yaml:"maxBytes"`
+	// MaxFiles is how many capture files are kept. The oldest are removed
+	MaxFiles int `yaml:"maxFiles"`
+}
+
+// Queue configures handling sns events in the background. Events of the same
+// service are handled in order by the same worker
+type Queue struct {
+	// Workers handle queued events. Zero handles each event while sns waits.
+	// Queued events that fail aren't retried by sns so they need dead letters
+	Workers int `yaml:"workers"`
+	// Size is how many events each worker can have waiting. Events beyond it
+	// are rejected so sns delivers them again later
+	Size int `yaml:"size"`
+	// DrainTimeout is how long queued events are handled for on shutdown
+	DrainTimeout Duration `yaml:"drainTimeout"`
+	// CoalesceWindow is how long a worker waits for more events after the last
+	// one it took. The events of a backend it collected are written with one
+	// update. Zero writes every event on its own
+	CoalesceWindow Duration `yaml:"coalesceWindow"`
+	// CoalesceMaxDelay is the longest a worker collects events for after the first
+	CoalesceMaxDelay Duration `yaml:"coalesceMaxDelay"`
+}
+
+// Logging configures the json log lines
+type Logging struct {
+	// Level is the lowest level logged: debug, info, warn or error. Debug lowers it to debug
+	Level string `yaml:"level"`
+	// Components override the level of single components like sync: debug
+	Components map[string]string `yaml:"components"`
+}
+
+// Tracing exports opentelemetry spans of events, syncs, diffs and aws calls
+type Tracing struct {
+	// Exporter is where spans go: none or otlp
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the otlp/http receiver. Empty uses
+	// OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans over http instead of https
+	Insecure bool `yaml:"insecure"`
+	// SampleRatio is the share of traces kept from 0 to 1
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Duration is a time.Duration written as a string like 100ms in yaml
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalYAML writes a duration string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// Default is the configuration used for anything that isn't set
+func Default() *Config {
+	return &Config{
+		Port:          ":8080",
+		NamePolicy:    NamePolicyService,
+		WriteStrategy: WriteStrategyLock,
+		Owner:         "ecs-task-tracker",
+		Prune: Prune{
+			GracePeriod: Duration(time.Hour),
+			Action:      PruneDelete,
+		},
+		Naming: Naming{
+			ID: "{{.Name}}__backend",
+		},
+		Logging: Logging{
+			Level: LogLevelInfo,
+		},
+		Tracing: Tracing{
+			Exporter:    TracingNone,
+			SampleRatio: 1,
+		},
+		Tasks: Tasks{
+			Policy: TaskPolicyIgnore,
+		},
+		Services: Services{
+			TagCacheTTL: Duration(time.Minute),
+		},
+		Retry: Retry{
+			MaxTries:   10,
+			Delay:      Duration(100 * time.Millisecond),
+			MaxDelay:   Duration(5 * time.Second),
+			MaxElapsed: Duration(30 * time.Second),
+		},
+		Timeouts: Timeouts{
+			Read:  Duration(30 * time.Second),
+			Write: Duration(30 * time.Second),
+			AWS:   Duration(30 * time.Second),
+		},
+		API: API{
+			Legacy: true,
+		},
+		Ready: Ready{
+			Timeout: Duration(2 * time.Second),
+		},
+		Dedupe: Dedupe{
+			TTL: Duration(time.Hour),
+		},
+		Queue: Queue{
+			Size:             100,
+			DrainTimeout:     Duration(20 * time.Second),
+			CoalesceMaxDelay: Duration(time.Second),
+		},
+		Capture: Capture{
+			MaxBytes: 10 << 20,
+			MaxFiles: 5,
+		},
+	}
+}
+
+// LoadFile merges the yaml file at filename into cfg
+func LoadFile(cfg *Config, filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrap(err, "ioutil.ReadFile("+filename+")")
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return errors.Wrap(err, "yaml.UnmarshalStrict("+filename+")")
+	}
+	return nil
+}
+
+// LoadEnv merges the environment variables that are set into cfg
+func LoadEnv(cfg *Config) error {
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Port = port
+	}
+	if region := os.Getenv("REGION"); region != "" {
+		cfg.Region = region
+	}
+	if table := os.Getenv("TRAEFIK_TABLE"); table != "" {
+		cfg.Tables.Traefik = table
+	}
+	if clusters := os.Getenv("CLUSTER"); clusters != "" {
+		cfg.Clusters = ParseClusters(clusters)
+	}
+	if policy := os.Getenv("BACKEND_NAME_POLICY"); policy != "" {
+		cfg.NamePolicy = policy
+	}
+	if strategy := os.Getenv("WRITE_STRATEGY"); strategy != "" {
+		cfg.WriteStrategy = strategy
+	}
+	if namespace := os.Getenv("CLOUDMAP_NAMESPACE"); namespace != "" {
+		cfg.Sinks.CloudMap.Namespace = namespace
+	}
+	if dryRun := os.Getenv("DRY_RUN"); dryRun != "" {
+		on, err := ParseBool(dryRun)
+		if err != nil {
+			return errors.Wrap(err, "DRY_RUN")
+		}
+		cfg.DryRun = on
+	}
+	if debug := os.Getenv("DEBUG"); debug != "" {
+		on, err := ParseBool(debug)
+		if err != nil {
+			return errors.Wrap(err, "DEBUG")
+		}
+		cfg.Debug = on
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		cfg.Logging.Level = level
+	}
+	if table := os.Getenv("DEDUPE_TABLE"); table != "" {
+		cfg.Dedupe.Table = table
+	}
+	if file := os.Getenv("DEAD_LETTER_FILE"); file != "" {
+		cfg.DeadLetters.File = file
+	}
+	if table := os.Getenv("DEAD_LETTER_TABLE"); table != "" {
+		cfg.DeadLetters.Table = table
+	}
+	if dir := os.Getenv("CAPTURE_DIR"); dir != "" {
+		cfg.Capture.Dir = dir
+	}
+	if workers := os.Getenv("QUEUE_WORKERS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil {
+			return errors.Wrap(err, "QUEUE_WORKERS")
+		}
+		cfg.Queue.Workers = n
+	}
+	if legacy := os.Getenv("LEGACY_ROUTES"); legacy != "" {
+		on, err := ParseBool(legacy)
+		if err != nil {
+			return errors.Wrap(err, "LEGACY_ROUTES")
+		}
+		cfg.API.Legacy = on
+	}
+	if exporter := os.Getenv("TRACING_EXPORTER"); exporter != "" {
+		cfg.Tracing.Exporter = exporter
+	}
+	return nil
+}
+
+// ParseBool is strconv.ParseBool that also accepts on and off
+func ParseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// ParseClusters parses a comma separated list of clusters of the form name[@region[@roleArn]]
+func ParseClusters(s string) []Cluster {
+	clusters := make([]Cluster, 0)
+	for _, cluster := range strings.Split(s, ",") {
+		if cluster = strings.TrimSpace(cluster); cluster == "" {
+			continue
+		}
+		// role arns can contain @ so it has to be the last field
+		fields := strings.SplitN(cluster, "@", 3)
+		for len(fields) < 3 {
+			fields = append(fields, "")
+		}
+		clusters = append(clusters, Cluster{Name: fields[0], Region: fields[1], RoleArn: fields[2]})
+	}
+	return clusters
+}
+
+// Validate checks the configuration and returns an error listing every problem found
+func (cfg *Config) Validate() error {
+	problems := make([]string, 0)
+	invalid := func(field, problem string) {
+		problems = append(problems, field+": "+problem)
+	}
+
+	if !strings.Contains(cfg.Port, ":") {
+		invalid("port", "must be of the form :port or host:port, got "+strconv.Quote(cfg.Port))
+	} else if _, err := strconv.Atoi(cfg.Port[strings.LastIndex(cfg.Port, ":")+1:]); err != nil {
+		invalid("port", "port must be a number, got "+strconv.Quote(cfg.Port))
+	}
+	if cfg.Tables.Traefik == "" {
+		invalid("tables.traefik", "is required")
+	}
+	for key := range cfg.Tables.Tags {
+		if key == "" {
+			invalid("tables.tags", "keys must not be empty")
+		}
+	}
+	switch cfg.NamePolicy {
+	case NamePolicyService, NamePolicyCluster, NamePolicyFirst:
+	default:
+		invalid("namePolicy", "must be one of service, cluster or first, got "+strconv.Quote(cfg.NamePolicy))
+	}
+
+	switch cfg.WriteStrategy {
+	case WriteStrategyLock, WriteStrategyPath:
+	default:
+		invalid("writeStrategy", "must be lock or path, got "+strconv.Quote(cfg.WriteStrategy))
+	}
+
+	if !isLogLevel(cfg.Logging.Level) {
+		invalid("logging.level", "must be one of debug, info, warn or error, got "+strconv.Quote(cfg.Logging.Level))
+	}
+	for component, level := range cfg.Logging.Components {
+		if !isLogComponent(component) {
+			invalid("logging.components", "unknown component "+strconv.Quote(component))
+		}
+		if !isLogLevel(level) {
+			invalid("logging.components."+component, "must be one of debug, info, warn or error, got "+strconv.Quote(level))
+		}
+	}
+
+	switch cfg.Tracing.Exporter {
+	case TracingNone, TracingOTLP:
+	default:
+		invalid("tracing.exporter", "must be none or otlp, got "+strconv.Quote(cfg.Tracing.Exporter))
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		invalid("tracing.sampleRatio", "must be between 0 and 1")
+	}
+
+	problems = append(problems, cfg.Naming.problems()...)
+
+	if len(cfg.Clusters) == 0 {
+		invalid("clusters", "at least one cluster is required")
+	}
+	seen := make(map[string]int)
+	for i, cluster := range cfg.Clusters {
+		field := "clusters[" + strconv.Itoa(i) + "]"
+		if cluster.Name == "" {
+			invalid(field+".name", "is required")
+		}
+		if cluster.Region == "" && cfg.Region == "" {
+			invalid(field+".region", "is required when there is no top level region")
+		}
+		if cluster.RoleArn != "" && !isArn(cluster.RoleArn, "iam") {
+			invalid(field+".roleArn", "must be an iam role arn, got "+strconv.Quote(cluster.RoleArn))
+		}
+		key := cluster.Name + "@" + cluster.Region + "@" + cluster.RoleArn
+		if j, exists := seen[key]; exists {
+			invalid(field, "is a duplicate of clusters["+strconv.Itoa(j)+"]")
+		}
+		seen[key] = i
+	}
+
+	if cfg.Owner == "" {
+		invalid("owner", "is required")
+	}
+	if cfg.Prune.Interval < 0 {
+		invalid("prune.interval", "must not be negative")
+	}
+	if cfg.Prune.GracePeriod < 0 {
+		invalid("prune.gracePeriod", "must not be negative")
+	}
+	switch cfg.Prune.Action {
+	case PruneDelete, PruneEmpty:
+	default:
+		invalid("prune.action", "must be one of delete or empty, got "+strconv.Quote(cfg.Prune.Action))
+	}
+
+	if cfg.Retry.MaxTries < 1 {
+		invalid("retry.maxTries", "must be at least 1")
+	}
+	if cfg.Retry.Delay < 0 {
+		invalid("retry.delay", "must not be negative")
+	}
+	if cfg.Retry.MaxDelay < cfg.Retry.Delay {
+		invalid("retry.maxDelay", "must not be less than retry.delay")
+	}
+	if cfg.Retry.MaxElapsed < 0 {
+		invalid("retry.maxElapsed", "must not be negative")
+	}
+	if cfg.Timeouts.Read < 0 {
+		invalid("timeouts.read", "must not be negative")
+	}
+	if cfg.Timeouts.Write < 0 {
+		invalid("timeouts.write", "must not be negative")
+	}
+	if cfg.Timeouts.AWS < 0 {
+		invalid("timeouts.aws", "must not be negative")
+	}
+	if cfg.Ready.Timeout <= 0 {
+		invalid("ready.timeout", "must be positive")
+	}
+	if cfg.Dedupe.TTL <= 0 {
+		invalid("dedupe.ttl", "must be positive")
+	}
+	if cfg.Dedupe.Table != "" && cfg.Dedupe.Table == cfg.Tables.Traefik {
+		invalid("dedupe.table", "must not be the traefik table")
+	}
+	if cfg.DeadLetters.File != "" && cfg.DeadLetters.Table != "" {
+		invalid("deadLetters", "only one of file and table can be set")
+	}
+	if cfg.DeadLetters.Table != "" && (cfg.DeadLetters.Table == cfg.Tables.Traefik || cfg.DeadLetters.Table == cfg.Dedupe.Table) {
+		invalid("deadLetters.table", "must not be the traefik or dedupe table")
+	}
+	if cfg.Queue.Workers < 0 {
+		invalid("queue.workers", "must not be negative")
+	}
+	// sns doesn't retry an event it was told was queued, so one that fails
+	// would be lost without a dead letter
+	if cfg.Queue.Workers > 0 && cfg.DeadLetters.File == "" && cfg.DeadLetters.Table == "" {
+		invalid("queue.workers", "requires deadLetters.file or deadLetters.table to keep the events that fail")
+	}
+	if cfg.Queue.Size < 1 {
+		invalid("queue.size", "must be at least 1")
+	}
+	if cfg.Queue.DrainTimeout < 0 {
+		invalid("queue.drainTimeout", "must not be negative")
+	}
+	if cfg.Queue.CoalesceWindow < 0 {
+		invalid("queue.coalesceWindow", "must not be negative")
+	}
+	if cfg.Queue.CoalesceMaxDelay < cfg.Queue.CoalesceWindow {
+		invalid("queue.coalesceMaxDelay", "must not be less than queue.coalesceWindow")
+	}
+	if cfg.Capture.MaxBytes < 1 {
+		invalid("capture.maxBytes", "must be at least 1")
+	}
+	if cfg.Capture.MaxFiles < 1 {
+		invalid("capture.maxFiles", "must be at least 1")
+	}
+
+	for i, pattern := range cfg.Services.Include {
+		if _, err := path.Match(pattern, ""); err != nil {
+			invalid("services.include["+strconv.Itoa(i)+"]", "invalid pattern "+strconv.Quote(pattern))
+		}
+	}
+	for i, pattern := range cfg.Services.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			invalid("services.exclude["+strconv.Itoa(i)+"]", "invalid pattern "+strconv.Quote(pattern))
+		}
+	}
+
+	for i, pattern := range cfg.Services.IncludeRegex {
+		if _, err := regexp.Compile(pattern); err != nil {
+			invalid("services.includeRegex["+strconv.Itoa(i)+"]", err.Error())
+		}
+	}
+	for i, pattern := range cfg.Services.ExcludeRegex {
+		if _, err := regexp.Compile(pattern); err != nil {
+			invalid("services.excludeRegex["+strconv.Itoa(i)+"]", err.Error())
+		}
+	}
+	if cfg.Services.TagCacheTTL < 0 {
+		invalid("services.tagCacheTTL", "must not be negative")
+	}
+
+	switch cfg.Tasks.Policy {
+	case TaskPolicyIgnore, TaskPolicyGroup:
+	default:
+		invalid("tasks.policy", "must be one of ignore or group, got "+strconv.Quote(cfg.Tasks.Policy))
+	}
+	for i, group := range cfg.Tasks.Groups {
+		field := "tasks.groups[" + strconv.Itoa(i) + "]"
+		if group.Backend == "" {
+			invalid(field+".backend", "is required")
+		}
+		if group.Group == "" && group.Family == "" && group.StartedBy == "" {
+			invalid(field, "one of group, family or startedBy is required")
+		}
+		if group.Group == "" {
+			continue
+		}
+		if _, err := path.Match(group.Group, ""); err != nil {
+			invalid(field+".group", "invalid pattern "+strconv.Quote(group.Group))
+		}
+		if strings.HasPrefix(group.Group, "service:") {
+			invalid(field+".group", "service tasks are always tracked by service, got "+strconv.Quote(group.Group))
+		}
+	}
+
+	for i, topic := range cfg.Auth.TopicArns {
+		if !isArn(topic, "sns") {
+			invalid("auth.topicArns["+strconv.Itoa(i)+"]", "must be an sns topic arn, got "+strconv.Quote(topic))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func isLogLevel(level string) bool {
+	switch level {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+		return true
+	}
+	return false
+}
+
+func isLogComponent(component string) bool {
+	for _, c := range LogComponents {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the naming templates and returns an error listing every problem found
+func (n Naming) Validate() error {
+	if problems := n.problems(); len(problems) > 0 {
+		return errors.New("invalid naming:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func (n Naming) problems() []string {
+	problems := make([]string, 0)
+	if n.Backend != "" {
+		if _, err := template.New("backend").Option("missingkey=error").Parse(n.Backend); err != nil {
+			problems = append(problems, "naming.backend: "+err.Error())
+		}
+	}
+	if tmpl, err := template.New("id").Option("missingkey=error").Parse(n.ID); err != nil {
+		problems = append(problems, "naming.id: "+err.Error())
+	} else if !strings.Contains(n.ID, ".Name") {
+		problems = append(problems, "naming.id: must contain {{.Name}} so every backend gets its own item")
+	} else if err := tmpl.Execute(ioutil.Discard, map[string]string{"Name": "backend"}); err != nil {
+		problems = append(problems, "naming.id: "+err.Error())
+	}
+	return problems
+}
+
+// isArn checks that s looks like an arn of an aws service
+func isArn(s, service string) bool {
+	parts := strings.SplitN(s, ":", 6)
+	return len(parts) == 6 && parts[0] == "arn" && parts[2] == service && parts[5] != ""
+}
+
+// String is the yaml of the configuration with secrets redacted
+func (cfg *Config) String() string {
+	redacted := *cfg
+	if redacted.Auth.Token != "" {
+		redacted.Auth.Token = "REDACTED"
+	}
+	out, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// Hash identifies the effective configuration so replicas running with
+// different configurations can be told apart. The auth token is left out
+func (cfg *Config) Hash() string {
+	hashed := *cfg
+	hashed.Auth.Token = ""
+	sum := sha256.Sum256([]byte(hashed.String()))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Watch polls filename every interval and calls changed whenever its
+// modification time or size changes. It never returns
+func Watch(filename string, interval time.Duration, changed func()) {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(filename); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(modTime) || info.Size() != size {
+			modTime, size = info.ModTime(), info.Size()
+			changed()
+		}
+	}
+}
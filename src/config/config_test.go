@@ -0,0 +1,181 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "ecs-task-tracker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadFile(t *testing.T) {
+	filename := writeConfig(t, `
+region: us-east-1
+clusters:
+  - name: staging
+  - name: prod
+    region: us-west-2
+    roleArn: arn:aws:iam::222222222222:role/tracker
+tables:
+  traefik: traefik-staging
+retry:
+  maxTries: 3
+  delay: 250ms
+services:
+  exclude: ["*-worker"]
+`)
+	defer os.Remove(filename)
+
+	cfg := Default()
+	if err := LoadFile(cfg, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Clusters) != 2 || cfg.Clusters[1].RoleArn != "arn:aws:iam::222222222222:role/tracker" {
+		t.Errorf("clusters not loaded: %+v", cfg.Clusters)
+	}
+	if cfg.Retry.MaxTries != 3 || time.Duration(cfg.Retry.Delay) != 250*time.Millisecond {
+		t.Errorf("retry not loaded: %+v", cfg.Retry)
+	}
+	// defaults are kept for anything the file doesn't set
+	if cfg.Port != ":8080" || cfg.NamePolicy != NamePolicyService {
+		t.Errorf("defaults were lost: %s %s", cfg.Port, cfg.NamePolicy)
+	}
+}
+
+func TestLoadFileUnknownField(t *testing.T) {
+	filename := writeConfig(t, "tables:\n  traefk: typo\n")
+	defer os.Remove(filename)
+
+	if err := LoadFile(Default(), filename); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Port = "8080"
+	cfg.NamePolicy = "bogus"
+	cfg.WriteStrategy = "merge"
+	cfg.Logging.Level = "trace"
+	cfg.Tracing.Exporter = "jaeger"
+	cfg.Tracing.SampleRatio = 2
+	cfg.Dedupe.TTL = 0
+	cfg.Queue.Workers = -1
+	cfg.DeadLetters = DeadLetters{File: "/var/lib/ecs-task-tracker/dead-letters.json", Table: "dead-letters"}
+	cfg.Queue.CoalesceWindow = Duration(2 * time.Second)
+	cfg.Capture.MaxFiles = 0
+	cfg.Logging.Components = map[string]string{"sink": "debug", "sync": "verbose"}
+	cfg.Retry.MaxTries = 0
+	cfg.Retry.MaxDelay = Duration(time.Millisecond)
+	cfg.Clusters = []Cluster{{Name: "staging", RoleArn: "not-an-arn"}}
+	cfg.Services.Include = []string{"["}
+	cfg.Naming.Backend = "{{.Cluster"
+	cfg.Naming.ID = "{{.Service}}"
+	cfg.Prune.Action = "archive"
+	cfg.Tasks.Policy = "track"
+	cfg.Tasks.Groups = []TaskGroup{{Group: "family:batch"}, {Backend: "reports"}}
+	cfg.Auth.TopicArns = []string{"arn:aws:sqs:us-east-1:111111111111:queue"}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+	for _, field := range []string{
+		"port:",
+		"tables.traefik:",
+		"namePolicy:",
+		"writeStrategy:",
+		"logging.level:",
+		"logging.components:",
+		"logging.components.sync:",
+		"tracing.exporter:",
+		"tracing.sampleRatio:",
+		"dedupe.ttl:",
+		"queue.workers:",
+		"deadLetters:",
+		"queue.coalesceMaxDelay:",
+		"capture.maxFiles:",
+		"clusters[0].region:",
+		"clusters[0].roleArn:",
+		"retry.maxTries:",
+		"retry.maxDelay:",
+		"services.include[0]:",
+		"naming.backend:",
+		"naming.id:",
+		"prune.action:",
+		"tasks.policy:",
+		"tasks.groups[0].backend:",
+		"tasks.groups[1]:",
+		"auth.topicArns[0]:",
+	} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected a problem with %s in:\n%s", field, err)
+		}
+	}
+}
+
+func TestValidateQueueNeedsDeadLetters(t *testing.T) {
+	cfg := Default()
+	cfg.Tables.Traefik = "traefik"
+	cfg.Region = "us-east-1"
+	cfg.Clusters = []Cluster{{Name: "staging"}}
+	cfg.Queue.Workers = 4
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "queue.workers:") {
+		t.Errorf("expected queueing without dead letters to be invalid, got %v", err)
+	}
+	cfg.DeadLetters.File = "/var/lib/ecs-task-tracker/dead-letters.json"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected queueing with dead letters to be valid, got %v", err)
+	}
+}
+
+func TestParseClusters(t *testing.T) {
+	clusters := ParseClusters("staging, prod@us-west-2@arn:aws:iam::222222222222:role/path/tracker@example")
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %d", len(clusters))
+	}
+	if clusters[0].Name != "staging" || clusters[0].Region != "" || clusters[0].RoleArn != "" {
+		t.Errorf("unexpected cluster: %+v", clusters[0])
+	}
+	if clusters[1].Region != "us-west-2" || clusters[1].RoleArn != "arn:aws:iam::222222222222:role/path/tracker@example" {
+		t.Errorf("unexpected cluster: %+v", clusters[1])
+	}
+}
+
+func TestStringRedactsToken(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.Token = "secret"
+	if strings.Contains(cfg.String(), "secret") {
+		t.Error("token was printed")
+	}
+	if cfg.Auth.Token != "secret" {
+		t.Error("printing changed the configuration")
+	}
+}
+
+func TestHash(t *testing.T) {
+	cfg, other := Default(), Default()
+	other.Auth.Token = "secret"
+	if cfg.Hash() != other.Hash() {
+		t.Error("the auth token changed the hash")
+	}
+	other.Tables.Traefik = "traefik-prod"
+	if cfg.Hash() == other.Hash() {
+		t.Error("expected a different hash for a different table")
+	}
+}
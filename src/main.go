@@ -1,18 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
-	"github.com/tskinn/ecs-task-tracker/src/utils"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
 )
 
 // SNSMiddleware checks for an sns subscription header and subscribes and short circuits the request
@@ -22,7 +35,7 @@ func SNSMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		if messageType == "SubscriptionConfirmation" {
 			notification, err := utils.DecodeNotification(c.Request().Body)
 			if err != nil {
-				return c.String(500, "error failed to decode notification: " + err.Error())
+				return c.String(statusOf(err), "error failed to decode notification: " + err.Error())
 			}
 			if _, err := http.Get(notification.SubscribeURL); err != nil {
 				return c.String(500, "error failed to visit subscribeURL: " + notification.SubscribeURL)
@@ -33,51 +46,281 @@ func SNSMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// TopicMiddleware rejects sns messages from topics that aren't in the auth.topicArns
+// of the active configuration. An empty auth.topicArns accepts every topic
+func TopicMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		topicArns := activeConfig().Auth.TopicArns
+		if len(topicArns) == 0 || c.Request().Header.Get("x-amz-sns-message-type") == "" {
+			return next(c)
+		}
+		topicArn := c.Request().Header.Get("x-amz-sns-topic-arn")
+		for _, allowed := range topicArns {
+			if topicArn == allowed {
+				return next(c)
+			}
+		}
+		return c.String(http.StatusForbidden, "topic not allowed: "+topicArn)
+	}
+}
+
+// TokenMiddleware requires the auth.token of the active configuration as a
+// bearer token when one is set
+func TokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := activeConfig().Auth.Token
+		if token == "" {
+			return next(c)
+		}
+		auth := c.Request().Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			return c.String(http.StatusUnauthorized, "unauthorized")
+		}
+		return next(c)
+	}
+}
+
 func main() {
+	args := os.Args[1:]
+	command := serve
+	if len(args) > 0 {
+		if c, ok := commands[args[0]]; ok {
+			command, args = c, args[1:]
+		}
+	}
+	err := command(args)
+	// spans are batched so the last ones would be lost on exit
+	flushTracing()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String(os.Getenv("REGION"))}))
-	// TODO get max tries from env var
-	// or change it to a exponential backoff limit
-	// Must call utils.Init in order for anything in utils to work properly!
-	utils.Init(os.Getenv("TRAEFIK_TABLE"),
-		os.Getenv("CLUSTER"),
-		10,
-		dynamodb.New(sess),
-		ec2.New(sess),
-		ecs.New(sess),
-		os.Getenv("DEBUG"),
-	)
+// serve tracks the tasks of the clusters and serves the http endpoints until
+// it is stopped. It is the command when none is given
+func serve(args []string) error {
+	cfg, opts, err := loadConfig(args)
+	if opts.printVersion {
+		fmt.Println(currentBuild())
+		return nil
+	}
+	if len(opts.args) > 0 {
+		return errors.New("unknown command " + opts.args[0])
+	}
+	if cfg != nil && opts.printConfig {
+		fmt.Print(cfg)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.printConfig {
+		return nil
+	}
+	sess, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+	utils.Log(utils.LevelInfo, "main", "starting "+currentBuild().String())
+	recordBuild()
+	if err := utils.BootstrapTable(cfg.Tables); err != nil {
+		return err
+	}
+
+	go watchReloads(sess, opts.configFile, args)
+	go prunePeriodically()
+	if cfg.Queue.Workers > 0 {
+		utils.StartQueue(cfg.Queue)
+	}
 
 	e := echo.New()
+	e.Server.ReadTimeout = time.Duration(cfg.Timeouts.Read)
+	e.Server.WriteTimeout = time.Duration(cfg.Timeouts.Write)
+	routes(e, cfg)
+	go func() {
+		if err := e.Start(cfg.Port); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	shutdown(e, activeConfig().Queue)
+	return nil
+}
+
+// routes adds the middleware and routes of a configuration to e. Routes that
+// are turned off by api.legacy stay off until a restart
+func routes(e *echo.Echo, cfg *config.Config) {
+	e.Use(TopicMiddleware)
 	e.Use(SNSMiddleware)
-	e.GET("/diff", diffAll)
-	e.GET("/diff/:service", diff)
 	e.POST("/event", ecsEvent)
-	e.GET("/sync", syncAll)
-	e.GET("/sync/:service", sync)
-	e.GET("/syncslow/:milliseconds", syncSlow)
-	e.GET("/syncslow", syncSlow)
 	e.GET("/health", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Healthy")
 	})
-	// TODO add a build endpoint
-	e.Logger.Fatal(e.Start(os.Getenv("PORT")))
+	e.GET("/ready", ready)
+
+	admin := e.Group("", TokenMiddleware)
+	admin.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	if cfg.API.Legacy {
+		admin.GET("/diff", diffAll)
+		admin.GET("/diff/:service", diff)
+		admin.GET("/sync", syncAll)
+		admin.GET("/sync/:service", sync)
+		admin.GET("/syncslow/:milliseconds", syncSlow)
+		admin.GET("/syncslow", syncSlow)
+		admin.GET("/prune", prune)
+	}
+	admin.GET("/deadletters", listDeadLetters)
+	admin.POST("/deadletters/replay", replayDeadLetters)
+	admin.POST("/deadletters/:id/replay", replayDeadLetter)
+	admin.GET("/version", versionHandler)
+	routeAPI(e.Group("/api/v1", TokenMiddleware))
+}
+
+// connect creates the aws clients of a configuration and initializes utils with them
+func connect(cfg *config.Config) (*session.Session, error) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:     aws.String(cfg.Region),
+		HTTPClient: &http.Client{Timeout: time.Duration(cfg.Timeouts.AWS)},
+		Retryer:    utils.NewRetryer(cfg.Retry),
+	}))
+	stop, err := setupTracing(cfg.Tracing)
+	if err != nil {
+		return nil, err
+	}
+	stopTracing = stop
+	// clients copy the handlers of the session so this has to come first
+	utils.TraceAWS(&sess.Handlers)
+	// Must call utils.Init in order for anything in utils to work properly!
+	utils.Init(cfg,
+		clusters(sess, cfg),
+		sinks(sess, cfg),
+		dynamodb.New(sess),
+		ec2.New(sess),
+		ecs.New(sess),
+		sns.New(sess),
+	)
+	active.Store(cfg)
+	return sess, nil
+}
+
+// shutdown stops accepting requests and handles the queued events, giving up
+// after queue.drainTimeout, then exports the spans that are still batched
+func shutdown(e *echo.Echo, cfg config.Queue) {
+	utils.Log(utils.LevelInfo, "main", "shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		utils.Log(utils.LevelWarn, "main", "error shutting down the server: "+err.Error())
+	}
+	if err := utils.DrainQueue(ctx); err != nil {
+		utils.Log(utils.LevelError, "main", "error draining the queue: "+err.Error())
+	} else {
+		utils.Log(utils.LevelInfo, "main", "shut down")
+	}
+	// the spans of the drained events
+	flushTracing()
+}
+
+// ready checks every dependency and reports each of them as json. Unlike
+// /health it fails when a dependency can't be used
+func ready(c echo.Context) error {
+	readiness := utils.HandleReady()
+	if !readiness.Ready {
+		return c.JSON(http.StatusServiceUnavailable, readiness)
+	}
+	return c.JSON(http.StatusOK, readiness)
 }
 
 // ecs Event handles SNS messages in the form of http POST requests
+// ?dryRun=true only returns the changes the event would make
 func ecsEvent(c echo.Context) error {
 
 	snsType := c.Request().Header.Get("x-amz-sns-message-type")
 	messageID := c.Request().Header.Get("x-amz-sns-message-id")
+	if utils.Capturing() && !dryRun(c) {
+		if err := capture(c, snsType, messageID); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+	}
+	if snsType == "Notification" && utils.Queueing() && !dryRun(c) {
+		if err := utils.EnqueueSNS(messageID, c.Request().Body); err != nil {
+			return c.String(statusOf(err), err.Error())
+		}
+		return c.String(http.StatusAccepted, "ecs event queued")
+	}
 	if snsType == "Notification" {
-		err := utils.HandleSNS(messageID, c.Request().Body)
+		mutations, err := utils.HandleSNS(messageID, c.Request().Body, dryRun(c))
+		if errors.Is(err, utils.ErrDuplicateEvent) {
+			// sns would deliver it again if it wasn't acknowledged
+			return c.String(http.StatusOK, "duplicate event ignored")
+		}
 		if err != nil {
-			return c.String(500, err.Error())
+			return c.String(statusOf(err), err.Error())
+		}
+		if mutations != nil {
+			return c.String(200, planned(mutations))
 		}
 	}
 	return c.String(200, "ecs event processes successfully")
 }
 
+// capture writes the message of a request to the capture files and leaves
+// its body to be read again
+func capture(c echo.Context, snsType, messageID string) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return errors.Wrap(err, "error reading body")
+	}
+	c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+	utils.Capture(utils.Captured{
+		Time:        time.Now(),
+		MessageID:   messageID,
+		MessageType: snsType,
+		TopicArn:    c.Request().Header.Get("x-amz-sns-topic-arn"),
+		Body:        string(body),
+	})
+	return nil
+}
+
+// statusOf maps the errors of the utils package to the http status of a response
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrInvalidEvent):
+		return http.StatusBadRequest
+	case errors.Is(err, utils.ErrItemNotFound), errors.Is(err, utils.ErrUnknownCluster), errors.Is(err, utils.ErrDeadLettersDisabled):
+		return http.StatusNotFound
+	case errors.Is(err, utils.ErrVersionConflict):
+		return http.StatusConflict
+	case errors.Is(err, utils.ErrNoNetworkBindings):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, utils.ErrThrottled):
+		return http.StatusTooManyRequests
+	case errors.Is(err, utils.ErrQueueFull), errors.Is(err, utils.ErrQueueStopped):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// dryRun checks whether a request asks for a dry run with ?dryRun=true
+func dryRun(c echo.Context) bool {
+	on, _ := strconv.ParseBool(c.QueryParam("dryRun"))
+	return on
+}
+
+// planned describes the changes a dry run would have made
+func planned(mutations []utils.Mutation) string {
+	if len(mutations) == 0 {
+		return "dry run: no changes"
+	}
+	out := make([]string, len(mutations))
+	for i, m := range mutations {
+		out[i] = m.String()
+	}
+	return "dry run:\n" + strings.Join(out, "\n")
+}
+
 // used for testing the slow sync functionality
 func syncSlow(c echo.Context) error {
 	milliseconds, err := strconv.Atoi(c.Param("milliseconds"))
@@ -86,49 +329,120 @@ func syncSlow(c echo.Context) error {
 	} else if err != nil {
 		return c.String(500, ":<()")
 	}
-	go utils.HandleSyncSlow(milliseconds)
+	go utils.HandleSyncSlow(c.QueryParam("cluster"), milliseconds, dryRun(c))
 	return c.String(200, "syncing a service every "+strconv.Itoa(milliseconds)+" milliseconds")
 }
 
 // used for testing the sync functionality
 func sync(c echo.Context) error {
 	serviceName := c.Param("service")
-	err := utils.HandleSync(serviceName)
+	mutations, err := utils.HandleSync(c.QueryParam("cluster"), serviceName, dryRun(c))
 	if err != nil {
-		return c.String(500, err.Error())
+		return c.String(statusOf(err), err.Error())
+	}
+	if mutations != nil {
+		return c.String(200, planned(mutations))
 	}
 	return c.String(200, serviceName+" synced")
 }
 
 // used for testing the sync all functionality
 func syncAll(c echo.Context) error {
-	err := utils.HandleSyncAll()
+	mutations, err := utils.HandleSyncAll(c.QueryParam("cluster"), dryRun(c))
 	if err != nil {
-		return c.String(500, "error syncing services")
+		return c.String(statusOf(err), "error syncing services")
+	}
+	if mutations != nil {
+		return c.String(200, planned(mutations))
 	}
 	return c.String(200, "all services synced")
 }
 
 func diff(c echo.Context) error {
 	serviceName := c.Param("service")
-	insync, err := utils.HandleDiff(serviceName)
+	status, err := utils.HandleDiff(c.QueryParam("cluster"), serviceName)
 	if err != nil {
-		return c.String(500, err.Error())
+		return c.String(statusOf(err), err.Error())
 	}
-	if insync {
-		return c.String(200, " is in sync")
-	}
-	return c.String(200, serviceName+" is out of sync")
+	return c.String(200, serviceName+" is "+status)
 }
 
 func diffAll(c echo.Context) error {
-	outOfSyncServices, err := utils.HandleDiffAll()
+	outOfSyncServices, ignoredServices, err := utils.HandleDiffAll(c.QueryParam("cluster"))
+	if err != nil {
+		return c.String(statusOf(err), "error comparing services: "+err.Error())
+	}
+	out := "all services in sync"
+	if len(outOfSyncServices) > 0 {
+		out = "services out of sync:\n" + strings.Join(outOfSyncServices, "\n")
+	}
+	if len(ignoredServices) > 0 {
+		out += "\nservices ignored:\n" + strings.Join(ignoredServices, "\n")
+	}
+	return c.String(200, out)
+}
+
+// prune garbage collects orphaned backends. ?dryRun=true only reports what would happen
+func prune(c echo.Context) error {
+	pruned, err := utils.HandlePrune(dryRun(c))
+	if err != nil {
+		return c.String(statusOf(err), "error pruning backends: "+err.Error())
+	}
+	if len(pruned) == 0 {
+		return c.String(200, "no orphaned backends")
+	}
+	out := make([]string, len(pruned))
+	for i, p := range pruned {
+		out[i] = p.String()
+	}
+	return c.String(200, strings.Join(out, "\n"))
+}
+
+// listDeadLetters lists the events that failed to be handled as json
+func listDeadLetters(c echo.Context) error {
+	letters, err := utils.ListDeadLetters()
 	if err != nil {
-		return c.String(500, "error comparing services: "+err.Error())
+		return c.String(statusOf(err), "error listing dead letters: "+err.Error())
 	}
-	if len(outOfSyncServices) == 0 {
-		return c.String(200, "all services in sync")
+	return c.JSON(http.StatusOK, letters)
+}
+
+// replayDeadLetter handles a dead letter again
+func replayDeadLetter(c echo.Context) error {
+	replayed, err := utils.ReplayDeadLetter(c.Param("id"))
+	if err != nil {
+		return c.String(statusOf(err), "error replaying dead letter: "+err.Error())
+	}
+	return c.String(200, replayed.String())
+}
+
+// replayDeadLetters handles every dead letter again and lists what happened to each
+func replayDeadLetters(c echo.Context) error {
+	replayed, err := utils.ReplayDeadLetters()
+	out := make([]string, len(replayed))
+	for i, r := range replayed {
+		out[i] = r.String()
+	}
+	if err != nil {
+		return c.String(statusOf(err), "error replaying dead letters: "+err.Error()+"\n"+strings.Join(out, "\n"))
+	}
+	if len(replayed) == 0 {
+		return c.String(200, "no dead letters")
+	}
+	return c.String(200, strings.Join(out, "\n"))
+}
+
+// prunePeriodically prunes orphaned backends every prune.interval of the active configuration
+func prunePeriodically() {
+	for {
+		interval := time.Duration(activeConfig().Prune.Interval)
+		if interval <= 0 {
+			// pruning may be turned on by a reload
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+		// HandlePrune logs its errors
+		utils.HandlePrune(false)
 	}
-	outString := strings.Join(outOfSyncServices, "\n")
-	return c.String(200, "services out of sync:\n"+outString)
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/containous/traefik/types"
+	"github.com/labstack/echo"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+// newTestServer routes a server of one cluster whose aws clients are in memory fakes
+func newTestServer(legacy bool) (*echo.Echo, *utils_test.EcsMock) {
+	cfg := config.Default()
+	cfg.Clusters = []config.Cluster{{Name: "test", Region: "us-east-1"}}
+	cfg.API.Legacy = legacy
+	_, ecsFake := initFakes(cfg, "10.0.0.1")
+	e := echo.New()
+	routes(e, cfg)
+	return e, ecsFake
+}
+
+func call(e *echo.Echo, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func TestAPISyncDryRun(t *testing.T) {
+	e, ecsFake := newTestServer(false)
+	ecsFake.AddTask(&ecs.Task{
+		ContainerInstanceArn: aws.String("fake"),
+		TaskArn:              aws.String("web-arn"),
+		Group:                aws.String("service:web"),
+		LastStatus:           aws.String("RUNNING"),
+		DesiredStatus:        aws.String("RUNNING"),
+		Containers: []*ecs.Container{
+			{NetworkBindings: []*ecs.NetworkBinding{{HostPort: aws.Int64(8080)}}},
+		},
+	})
+
+	rec := call(e, http.MethodPost, "/api/v1/services/web/sync?dryRun=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	s := synced{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Service != "web" || !s.DryRun || len(s.Mutations) != 1 {
+		t.Fatalf("unexpected sync %s", rec.Body)
+	}
+	if m := s.Mutations[0]; m.Action != "create" || len(m.Add) != 1 || m.Add[0] != "10.0.0.1:8080" {
+		t.Errorf("expected the backend to be created with the server of the task, got %+v", m)
+	}
+}
+
+func TestAPIBackendNotFound(t *testing.T) {
+	e, _ := newTestServer(false)
+	rec := call(e, http.MethodGet, "/api/v1/backends/missing")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d: %s", rec.Code, rec.Body)
+	}
+	body := apiError{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+		t.Errorf("expected a json error, got %s", rec.Body)
+	}
+}
+
+func TestAPIMethodNotAllowed(t *testing.T) {
+	e, _ := newTestServer(false)
+	if rec := call(e, http.MethodGet, "/api/v1/syncs"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	legacy := []string{"/diff", "/diff/web", "/sync", "/sync/web", "/syncslow", "/syncslow/10", "/prune"}
+	e, _ := newTestServer(false)
+	for _, route := range legacy {
+		if rec := call(e, http.MethodGet, route); rec.Code != http.StatusNotFound {
+			t.Errorf("expected %s to be off, got %d", route, rec.Code)
+		}
+	}
+
+	e, ecsFake := newTestServer(true)
+	ecsFake.AddService("web")
+	if rec := call(e, http.MethodGet, "/prune?dryRun=true"); rec.Code != http.StatusOK {
+		t.Errorf("expected /prune to be served, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAPIPruneDryRun(t *testing.T) {
+	e, ecsFake := newTestServer(false)
+	ecsFake.AddService("web")
+	rec := call(e, http.MethodPost, "/api/v1/prunes?dryRun=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	p := pruned{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if !p.DryRun || p.Backends == nil || len(p.Backends) != 0 {
+		t.Errorf("expected a dry run without orphans, got %s", rec.Body)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	e, _ := newTestServer(false)
+	rec := call(e, http.MethodGet, "/api/v1/openapi.json")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	doc := struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/syncs", "/services/{name}/sync", "/services/{name}/diff", "/backends", "/backends/{name}", "/prunes"} {
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("expected %s to be described", path)
+		}
+	}
+}
+
+func TestFakeBackendsCustomNaming(t *testing.T) {
+	dynamo := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	items := map[string]interface{}{
+		"be-web": utils.BackendItem{
+			EndItem: utils.EndItem{ID: "be-web", Name: "web"},
+			Backend: types.Backend{Servers: map[string]types.Server{"10.0.0.1:8080": {URL: "http://10.0.0.1:8080"}}},
+		},
+		"fe-web": utils.FrontendItem{
+			EndItem:  utils.EndItem{ID: "fe-web", Name: "web"},
+			Frontend: types.Frontend{Backend: "web"},
+		},
+	}
+	for id, item := range items {
+		av, err := dynamodbattribute.MarshalMap(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dynamo.Items[id] = av
+	}
+
+	lines, err := fakeBackends(dynamo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0] != "web: 10.0.0.1:8080" {
+		t.Errorf("expected the backend named by naming.id, got %v", lines)
+	}
+}
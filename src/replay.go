@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+// replay feeds the notifications of a capture file through the event handling
+// again, either against aws or against in memory fakes
+//
+//	ecs-task-tracker replay [-speed 1] [-fake] [-dry-run on] [flags] capture.jsonl
+func replay(args []string) error {
+	flags := flag.NewFlagSet("ecs-task-tracker replay", flag.ContinueOnError)
+	speed := flags.Float64("speed", 1, "how many times faster than they were received notifications are replayed. 0 doesn't wait between them")
+	fake := flags.Bool("fake", false, "replay against in memory fakes of dynamodb, ecs and ec2 and print the backends they end up with")
+	fakeIP := flags.String("fake-ip", "10.0.0.1", "private ip of the one instance every task runs on with -fake")
+	cfg, opts, err := parseConfig(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(opts.args) != 1 {
+		return errors.New("replay takes one capture file")
+	}
+	file, err := os.Open(opts.args[0])
+	if err != nil {
+		return errors.Wrap(err, "os.Open("+opts.args[0]+")")
+	}
+	defer file.Close()
+	captured, err := utils.ReadCapture(file)
+	if err != nil {
+		return errors.Wrap(err, opts.args[0])
+	}
+	// the replay itself isn't captured
+	cfg.Capture.Dir = ""
+	utils.LogTo(os.Stderr)
+
+	var dynamo *utils_test.DynamodbMock
+	if *fake {
+		dynamo, _ = initFakes(cfg, *fakeIP)
+	} else if _, err := connect(cfg); err != nil {
+		return err
+	}
+	for _, r := range utils.ReplayCapture(captured, *speed, cfg.DryRun) {
+		fmt.Println(r)
+	}
+	if dynamo != nil {
+		return printFakeBackends(dynamo)
+	}
+	return nil
+}
+
+// initFakes initializes utils with in memory fakes and returns the fakes of
+// dynamodb and ecs. Every container instance is the same ec2 instance with the
+// private ip fakeIP
+func initFakes(cfg *config.Config, fakeIP string) (*utils_test.DynamodbMock, *utils_test.EcsMock) {
+	dynamo := &utils_test.DynamodbMock{
+		Items: make(map[string]map[string]*dynamodb.AttributeValue),
+	}
+	ecsFake := &utils_test.EcsMock{
+		ContainerInstances: make(map[string]*ecs.ContainerInstance),
+		Services:           make(map[string]bool),
+		Tasks:              make(map[string]*ecs.Task),
+	}
+	ecsFake.AddContainerInstance(&ecs.ContainerInstance{
+		ContainerInstanceArn: aws.String("fake"),
+		Ec2InstanceId:        aws.String("i-fake"),
+	})
+	ec2Fake := &utils_test.Ec2Mock{
+		Instance: &ec2.Instance{
+			InstanceId:       aws.String("i-fake"),
+			PrivateIpAddress: aws.String(fakeIP),
+		},
+	}
+	clusters := make([]*utils.Cluster, len(cfg.Clusters))
+	for i, cluster := range cfg.Clusters {
+		clusters[i] = &utils.Cluster{Name: cluster.Name, Region: cluster.Region}
+	}
+	// events don't reach sinks or dynamodb tables other than the traefik table
+	cfg.Sinks = config.Sinks{}
+	cfg.Dedupe.Table = ""
+	cfg.DeadLetters = config.DeadLetters{}
+	utils.Init(cfg, clusters, nil, dynamo, ec2Fake, ecsFake, nil)
+	active.Store(cfg)
+	return dynamo, ecsFake
+}
+
+// printFakeBackends prints the servers of every backend in the fake traefik table
+func printFakeBackends(dynamo *utils_test.DynamodbMock) error {
+	lines, err := fakeBackends(dynamo)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// fakeBackends describes every backend in the fake traefik table by its name
+// and servers, sorted by name
+func fakeBackends(dynamo *utils_test.DynamodbMock) ([]string, error) {
+	lines := make([]string, 0)
+	for id, item := range dynamo.Items {
+		// the ids of backends depend on naming.id so they are told apart from
+		// frontends by their attributes
+		if _, ok := item["backend"]; !ok {
+			continue
+		}
+		backend := utils.BackendItem{}
+		if err := dynamodbattribute.UnmarshalMap(item, &backend); err != nil {
+			return nil, errors.Wrap(err, "dynamodbattribute.UnmarshalMap("+id+")")
+		}
+		servers := make([]string, 0, len(backend.Backend.Servers))
+		for addr := range backend.Backend.Servers {
+			servers = append(servers, addr)
+		}
+		sort.Strings(servers)
+		lines = append(lines, backend.Name+": "+strings.Join(servers, " "))
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
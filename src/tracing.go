@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// stopTracing exports the spans that are still batched and stops the tracer
+// provider. It does nothing until setupTracing installs one
+var stopTracing = func(ctx context.Context) error { return nil }
+
+// flushTimeout bounds how long exporting the last spans may take on exit
+const flushTimeout = 5 * time.Second
+
+// setupTracing installs a tracer provider exporting spans as configured. Spans
+// aren't recorded when the exporter is none. Changes take effect after a restart.
+// The returned func exports the batched spans and stops the provider
+func setupTracing(cfg config.Tracing) (func(ctx context.Context) error, error) {
+	if cfg.Exporter != config.TracingOTLP {
+		return func(ctx context.Context) error { return nil }, nil
+	}
+	opts := make([]otlptracehttp.Option, 0)
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "otlptracehttp.New()")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "ecs-task-tracker"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// flushTracing exports the spans that are still batched, giving up after
+// flushTimeout. Only the first call does anything
+func flushTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	stop := stopTracing
+	stopTracing = func(ctx context.Context) error { return nil }
+	if err := stop(ctx); err != nil {
+		utils.Log(utils.LevelWarn, "main", "error exporting the last spans: "+err.Error())
+	}
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// Captured is an sns message /event received. Captures are json lines of them
+type Captured struct {
+	Time        time.Time `json:"time"`
+	MessageID   string    `json:"messageId"`
+	MessageType string    `json:"messageType"`
+	TopicArn    string    `json:"topicArn,omitempty"`
+	// Body is the request body as it was received
+	Body string `json:"body"`
+}
+
+// replayClock is the time replays wait with so tests don't have to sleep
+var replayClock clock = realClock{}
+
+// captureFiles writes captured messages to files in a directory. A new file
+// is started when the current one would grow beyond maxBytes and the oldest
+// files beyond maxFiles are removed
+type captureFiles struct {
+	dir   string
+	mutex *sync.Mutex
+	// maxBytes and maxFiles follow reloads so they are guarded by mutex
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// newCapture creates the capture files of a configuration. It is nil when
+// nothing is captured. The files of prev keep being written when the
+// directory is the same
+func newCapture(cfg config.Capture, prev *captureFiles) *captureFiles {
+	if cfg.Dir == "" {
+		return nil
+	}
+	if prev != nil && prev.dir == cfg.Dir {
+		prev.mutex.Lock()
+		prev.maxBytes, prev.maxFiles = cfg.MaxBytes, cfg.MaxFiles
+		prev.mutex.Unlock()
+		return prev
+	}
+	return &captureFiles{dir: cfg.Dir, mutex: &sync.Mutex{}, maxBytes: cfg.MaxBytes, maxFiles: cfg.MaxFiles}
+}
+
+// Capturing reports whether the messages /event receives are captured
+func Capturing() bool {
+	return current.Load().(*Util).capture != nil
+}
+
+// Capture appends a message to the capture files. Failing to capture it is
+// logged and doesn't keep the message from being handled
+func Capture(captured Captured) {
+	req := newRequest("Capture::" + captured.MessageID)
+	if req.util.capture == nil {
+		return
+	}
+	if err := req.util.capture.write(captured); err != nil {
+		req.warn("error capturing message: " + err.Error())
+	}
+}
+
+func (c *captureFiles) write(captured Captured) error {
+	line, err := json.Marshal(captured)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal()")
+	}
+	line = append(line, '\n')
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil || (c.size > 0 && c.size+int64(len(line)) > c.maxBytes) {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	return errors.Wrap(err, "Write("+c.file.Name()+")")
+}
+
+// rotate starts a new capture file and removes the oldest ones beyond maxFiles
+func (c *captureFiles) rotate() error {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return errors.Wrap(err, "os.MkdirAll("+c.dir+")")
+	}
+	name := filepath.Join(c.dir, "events-"+time.Now().UTC().Format("20060102T150405.000000000")+".jsonl")
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "os.OpenFile("+name+")")
+	}
+	c.file, c.size = file, 0
+
+	// the names sort in the order the files were started
+	files, err := filepath.Glob(filepath.Join(c.dir, "events-*.jsonl"))
+	if err != nil {
+		return errors.Wrap(err, "filepath.Glob("+c.dir+")")
+	}
+	sort.Strings(files)
+	for len(files) > c.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return errors.Wrap(err, "os.Remove("+files[0]+")")
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// ReadCapture reads the messages of a capture file
+func ReadCapture(r io.Reader) ([]Captured, error) {
+	captured := make([]Captured, 0)
+	scanner := bufio.NewScanner(r)
+	// sns messages are up to 256KB
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		c := Captured{}
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, errors.Wrap(err, "line "+strconv.Itoa(line))
+		}
+		captured = append(captured, c)
+	}
+	return captured, errors.Wrap(scanner.Err(), "Scan()")
+}
+
+// ReplayCapture handles captured notifications again in the order they were
+// received. The time between them is divided by speed. A speed of zero
+// doesn't wait at all. Messages other than notifications are skipped
+func ReplayCapture(captured []Captured, speed float64, dryRun bool) []Replayed {
+	replayed := make([]Replayed, 0, len(captured))
+	for i, c := range captured {
+		if i > 0 && speed > 0 {
+			if gap := c.Time.Sub(captured[i-1].Time); gap > 0 {
+				replayClock.Sleep(time.Duration(float64(gap) / speed))
+			}
+		}
+		if c.MessageType != "Notification" {
+			replayed = append(replayed, Replayed{ID: c.MessageID, Result: "skipped " + c.MessageType})
+			continue
+		}
+		mutations, err := HandleSNS(c.MessageID, ioutil.NopCloser(strings.NewReader(c.Body)), dryRun)
+		replayed = append(replayed, Replayed{ID: c.MessageID, Result: replayResult(mutations, err, dryRun)})
+	}
+	return replayed
+}
+
+// replayResult describes what handling a captured notification did
+func replayResult(mutations []Mutation, err error, dryRun bool) string {
+	switch {
+	case errors.Is(err, ErrDuplicateEvent):
+		return "already handled"
+	case err != nil:
+		return "failed: " + err.Error()
+	case !dryRun:
+		return "handled"
+	case len(mutations) == 0:
+		return "no changes"
+	}
+	planned := make([]string, len(mutations))
+	for i, m := range mutations {
+		planned[i] = m.String()
+	}
+	return "would " + strings.Join(planned, ", ")
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+func TestCaptureRotates(t *testing.T) {
+	dir := t.TempDir()
+	defer withUtil(func(u *Util) {
+		u.capture = newCapture(config.Capture{Dir: dir, MaxBytes: 300, MaxFiles: 2}, nil)
+	})()
+	if !Capturing() {
+		t.Fatal("expected messages to be captured")
+	}
+
+	// each message fills most of a file
+	body := strings.Repeat("x", 150)
+	for i := 0; i < 4; i++ {
+		Capture(Captured{Time: time.Unix(int64(i), 0), MessageID: "TestCapture::" + strconv.Itoa(i), MessageType: "Notification", Body: body})
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "events-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the 2 newest capture files to be kept, got %v", files)
+	}
+	sort.Strings(files)
+	file, err := os.Open(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	captured, err := ReadCapture(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captured) != 1 || captured[0].MessageID != "TestCapture::3" || captured[0].Body != body {
+		t.Errorf("expected the last message in the newest file, got %+v", captured)
+	}
+}
+
+func TestReadCaptureInvalid(t *testing.T) {
+	if _, err := ReadCapture(strings.NewReader("{\"messageId\": \"1\"}\n\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected an error on line 3, got %v", err)
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	defer withUtil(func(u *Util) { u.dedupe = newMemoryDedupe() })()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	replayClock = clock
+	defer func() { replayClock = realClock{} }()
+	forgetInstances()
+	defer forgetInstances()
+	createEnv("captureinstancearn", "capturetask", "captureinstanceid", "10.0.0.14", 8400)
+	defer ecsM.RemoveTask("capturetask-arn")
+
+	body := func(port int) string {
+		event := Event{
+			ID: "capture" + strconv.Itoa(port),
+			Detail: Detail{
+				Group:                "service:capturetask",
+				ContainerInstanceArn: "captureinstancearn",
+				DesiredStatus:        Running,
+				LastStatus:           Running,
+				TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/capture" + strconv.Itoa(port),
+				Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: port}}}},
+			},
+		}
+		data, _ := ioutil.ReadAll(snsEventBody(event))
+		return string(data)
+	}
+	received := time.Unix(1500000000, 0)
+	captured := []Captured{
+		{Time: received, MessageID: "TestCapture::1", MessageType: "Notification", Body: body(8401)},
+		{Time: received.Add(4 * time.Second), MessageID: "TestCapture::2", MessageType: "SubscriptionConfirmation"},
+		{Time: received.Add(10 * time.Second), MessageID: "TestCapture::1", MessageType: "Notification", Body: body(8401)},
+		{Time: received.Add(12 * time.Second), MessageID: "TestCapture::3", MessageType: "Notification", Body: "{"},
+	}
+	replayed := ReplayCapture(captured, 2, false)
+
+	results := make([]string, len(replayed))
+	for i, r := range replayed {
+		results[i] = r.String()
+	}
+	expected := []string{
+		"TestCapture::1 handled",
+		"TestCapture::2 skipped SubscriptionConfirmation",
+		"TestCapture::1 already handled",
+	}
+	if len(results) != 4 || strings.Join(results[:3], ",") != strings.Join(expected, ",") || !strings.HasPrefix(results[3], "TestCapture::3 failed: ") {
+		t.Errorf("unexpected replays %v", results)
+	}
+	if len(clock.sleeps) != 3 || clock.sleeps[0] != 2*time.Second || clock.sleeps[1] != 3*time.Second || clock.sleeps[2] != time.Second {
+		t.Errorf("expected the gaps at twice the speed, got %v", clock.sleeps)
+	}
+	if _, ok := backendServers(t, "capturetask")["10.0.0.14:8401"]; !ok {
+		t.Error("the replayed event didn't add its server")
+	}
+}
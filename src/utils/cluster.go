@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+const (
+	// NamePolicyService names backends after the ecs service alone. See config.NamePolicyService
+	NamePolicyService = config.NamePolicyService
+	// NamePolicyCluster names every backend <cluster>-<service>. See config.NamePolicyCluster
+	NamePolicyCluster = config.NamePolicyCluster
+	// NamePolicyFirst only prefixes backends outside the first cluster. See config.NamePolicyFirst
+	NamePolicyFirst = config.NamePolicyFirst
+)
+
+// Cluster is an ecs cluster that is tracked along with the clients used to reach it
+type Cluster struct {
+	// Name is the name or arn of the cluster
+	Name string
+	// Account is the id of the aws account the cluster is in. Empty matches events from any account
+	Account string
+	// Region is the aws region the cluster is in. Empty matches events from any region
+	Region string
+	// RoleArn is the iam role assumed to reach the cluster. Empty uses the default credentials
+	RoleArn string
+	ECS     ecsiface.ECSAPI
+	EC2     ec2iface.EC2API
+}
+
+// NewCluster creates a Cluster whose clients are in region and use credentials
+// from assuming roleArn, which are refreshed automatically before they expire.
+// An empty region or roleArn falls back to the region or credentials of sess
+func NewCluster(sess *session.Session, name, region, roleArn string) *Cluster {
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	} else {
+		region = aws.StringValue(sess.Config.Region)
+	}
+	account := ""
+	if roleArn != "" {
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(sess, roleArn))
+		account = arnAccount(roleArn)
+	} else {
+		account = arnAccount(name)
+	}
+	return &Cluster{
+		Name:    name,
+		Account: account,
+		Region:  region,
+		RoleArn: roleArn,
+		ECS:     ecs.New(sess, cfg),
+		EC2:     ec2.New(sess, cfg),
+	}
+}
+
+// arnAccount gets the account id from an arn or an empty string if it isn't one
+// arn:aws:iam::123456789012:role/tracker -> 123456789012
+func arnAccount(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[4]
+}
+
+// clusterName gets the name of a cluster from its name or arn
+// arn:aws:ecs:us-east-1:123456789012:cluster/staging -> staging
+func clusterName(cluster string) string {
+	parts := strings.Split(cluster, "/")
+	return parts[len(parts)-1]
+}
+
+// findCluster returns the configured cluster matching the name or arn of a cluster
+func (req *request) findCluster(cluster string) (*Cluster, bool) {
+	name := clusterName(cluster)
+	for _, c := range req.util.Clusters {
+		if clusterName(c.Name) == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// clustersFor returns the clusters a request should act on. An empty cluster
+// means every configured cluster
+func (req *request) clustersFor(cluster string) ([]*Cluster, error) {
+	if cluster == "" {
+		return req.util.Clusters, nil
+	}
+	c, ok := req.findCluster(cluster)
+	if !ok {
+		return nil, errors.Wrap(ErrUnknownCluster, cluster)
+	}
+	return []*Cluster{c}, nil
+}
+
+// qualifiedName is how a service is reported to users. The cluster is only
+// included when more than one cluster is tracked
+func (req *request) qualifiedName(service string) string {
+	if len(req.util.Clusters) > 1 {
+		return clusterName(req.cluster.Name) + "/" + service
+	}
+	return service
+}
+
+// hasService checks whether a service exists in the requests cluster
+func (req *request) hasService(service string) (bool, error) {
+	services, err := req.listServices()
+	if err != nil {
+		return false, errors.Wrap(err, "listServices()")
+	}
+	for _, s := range services {
+		if s == service {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// eventCluster returns the configured cluster an event belongs to by matching
+// the cluster name, account and region of the event. Events without a cluster
+// arn belong to the only cluster when just one is tracked
+func (req *request) eventCluster(event Event) (*Cluster, bool) {
+	if event.Detail.ClusterArn == "" {
+		if len(req.util.Clusters) == 1 {
+			return req.util.Clusters[0], true
+		}
+		return nil, false
+	}
+	name := clusterName(event.Detail.ClusterArn)
+	for _, c := range req.util.Clusters {
+		if clusterName(c.Name) != name {
+			continue
+		}
+		if c.Account != "" && event.Account != "" && c.Account != event.Account {
+			continue
+		}
+		if c.Region != "" && event.Region != "" && c.Region != event.Region {
+			continue
+		}
+		return c, true
+	}
+	return nil, false
+}
+
+// serviceClusters returns the clusters a service should be acted on in. When
+// no cluster is given and more than one is tracked only the clusters the
+// service exists in are returned
+func (req *request) serviceClusters(cluster, service string) ([]*Cluster, error) {
+	clusters, err := req.clustersFor(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if len(clusters) == 1 {
+		return clusters, nil
+	}
+	found := make([]*Cluster, 0)
+	for _, c := range clusters {
+		creq := req.forCluster(c)
+		exists, err := creq.hasService(service)
+		if err != nil {
+			return nil, errors.Wrap(err, "hasService("+c.Name+", "+service+")")
+		}
+		if exists {
+			found = append(found, c)
+		}
+	}
+	if len(found) == 0 {
+		return nil, errors.Wrap(ErrItemNotFound, "service "+service+" is not in any cluster")
+	}
+	return found, nil
+}
+
+// forCluster returns a copy of the request that acts on cluster
+func (req *request) forCluster(cluster *Cluster) *request {
+	creq := *req
+	creq.cluster = cluster
+	return &creq
+}
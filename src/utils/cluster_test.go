@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func withClusters(clusters []*Cluster, policy string) func() {
+	return withUtil(func(u *Util) {
+		u.Clusters, u.NamePolicy = clusters, policy
+	})
+}
+
+// accountCluster creates a cluster in an account with its own fake clients
+func accountCluster(account, instanceArn, instanceID, instanceIP string) *Cluster {
+	ecsMock := &utils_test.EcsMock{
+		ContainerInstances: make(map[string]*ecs.ContainerInstance),
+		Services:           make(map[string]bool),
+		Tasks:              make(map[string]*ecs.Task),
+	}
+	ecsMock.AddContainerInstance(&ecs.ContainerInstance{
+		ContainerInstanceArn: aws.String(instanceArn),
+		Ec2InstanceId:        aws.String(instanceID),
+	})
+	return &Cluster{
+		Name:    "web",
+		Account: account,
+		Region:  "us-east-1",
+		ECS:     ecsMock,
+		EC2: &utils_test.Ec2Mock{
+			Instance: &ec2.Instance{
+				PrivateIpAddress: aws.String(instanceIP),
+				InstanceId:       aws.String(instanceID),
+			},
+		},
+	}
+}
+
+func TestBackendNamePolicies(t *testing.T) {
+	staging := &Cluster{Name: "staging"}
+	prod := &Cluster{Name: "arn:aws:ecs:us-east-1:123456789012:cluster/prod"}
+	clusters := []*Cluster{staging, prod}
+	cases := []struct {
+		policy  string
+		cluster *Cluster
+		want    string
+	}{
+		{NamePolicyService, staging, "api"},
+		{NamePolicyService, prod, "api"},
+		{NamePolicyCluster, staging, "staging-api"},
+		{NamePolicyCluster, prod, "prod-api"},
+		{NamePolicyFirst, staging, "api"},
+		{NamePolicyFirst, prod, "prod-api"},
+	}
+	for _, c := range cases {
+		restore := withClusters(clusters, c.policy)
+		req := newRequest("TestBackendNamePolicies").forCluster(c.cluster)
+		if got, _ := req.backendName("api", ""); got != c.want {
+			t.Errorf("%s policy in %s: got %s want %s", c.policy, c.cluster.Name, got, c.want)
+		}
+		restore()
+	}
+}
+
+func TestEventCluster(t *testing.T) {
+	staging := &Cluster{Name: "staging"}
+	prod := &Cluster{Name: "arn:aws:ecs:us-east-1:123456789012:cluster/prod"}
+	defer withClusters([]*Cluster{staging, prod}, NamePolicyService)()
+
+	req := newRequest("TestEventCluster")
+	cluster, ok := req.eventCluster(Event{Detail: Detail{ClusterArn: "arn:aws:ecs:us-east-1:123456789012:cluster/prod"}})
+	if !ok || cluster != prod {
+		t.Error("event for prod was not routed to prod")
+	}
+	cluster, ok = req.eventCluster(Event{Detail: Detail{ClusterArn: "arn:aws:ecs:us-east-1:123456789012:cluster/staging"}})
+	if !ok || cluster != staging {
+		t.Error("event for staging was not routed to staging")
+	}
+	if _, ok := req.eventCluster(Event{Detail: Detail{ClusterArn: "arn:aws:ecs:us-east-1:123456789012:cluster/other"}}); ok {
+		t.Error("event for untracked cluster was routed")
+	}
+	if _, ok := req.eventCluster(Event{}); ok {
+		t.Error("event without a cluster was routed while tracking several clusters")
+	}
+}
+
+func TestEventClusterByAccountAndRegion(t *testing.T) {
+	staging := &Cluster{Name: "web", Account: "111111111111", Region: "us-east-1"}
+	prod := &Cluster{Name: "web", Account: "222222222222", Region: "us-west-2"}
+	defer withClusters([]*Cluster{staging, prod}, NamePolicyCluster)()
+
+	req := newRequest("TestEventClusterByAccountAndRegion")
+	cluster, ok := req.eventCluster(Event{
+		Account: "222222222222",
+		Region:  "us-west-2",
+		Detail:  Detail{ClusterArn: "arn:aws:ecs:us-west-2:222222222222:cluster/web"},
+	})
+	if !ok || cluster != prod {
+		t.Error("event for prod account was not routed to prod")
+	}
+	if _, ok := req.eventCluster(Event{
+		Account: "333333333333",
+		Region:  "us-east-1",
+		Detail:  Detail{ClusterArn: "arn:aws:ecs:us-east-1:333333333333:cluster/web"},
+	}); ok {
+		t.Error("event for untracked account was routed")
+	}
+}
+
+func TestHandleSNSUsesClientsOfAccount(t *testing.T) {
+	staging := accountCluster("111111111111", "staging-instance-arn", "i-staging", "10.1.0.1")
+	prod := accountCluster("222222222222", "prod-instance-arn", "i-prod", "10.2.0.1")
+	defer withClusters([]*Cluster{staging, prod}, NamePolicyService)()
+
+	event := Event{
+		Account: "222222222222",
+		Region:  "us-east-1",
+		Detail: Detail{
+			ClusterArn:           "arn:aws:ecs:us-east-1:222222222222:cluster/web",
+			Group:                "service:accounttask",
+			ContainerInstanceArn: "prod-instance-arn",
+			DesiredStatus:        Running,
+			LastStatus:           Running,
+			TaskArn:              "arn:aws:ecs:us-east-1:222222222222:task/prod1",
+			Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 9000}}}},
+		},
+	}
+	_, err := HandleSNS("TestAccount::Add", ioutil.NopCloser(snsEventBody(event)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["accounttask__backend"], &backend); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Backend.Servers["10.2.0.1:9000"]; !ok {
+		t.Errorf("expected the address from the prod account, got %v", backend.Backend.Servers)
+	}
+}
+
+func TestClustersForUnknownCluster(t *testing.T) {
+	req := newRequest("TestClustersForUnknownCluster")
+	if _, err := req.clustersFor("nope"); err == nil {
+		t.Error("expected an error for an untracked cluster")
+	}
+	clusters, err := req.clustersFor("")
+	if err != nil || len(clusters) != len(req.util.Clusters) {
+		t.Error("an empty cluster should mean every tracked cluster")
+	}
+}
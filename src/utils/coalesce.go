@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// coalescedEvent is an event whose change waits to be written with the
+// changes of the other events of its backend
+type coalescedEvent struct {
+	req     *request
+	span    trace.Span
+	release func()
+	event   Event
+}
+
+// handleCoalesced handles the events of one task group that a worker collected
+// during the coalescing window. Each backend they change is written once with
+// the last state of each of its servers. An event that fails before its change
+// is known fails on its own
+func handleCoalesced(events []queuedEvent) {
+	if len(events) == 1 {
+		// handleEvent logs its errors
+		events[0].req.handleEvent(events[0].event)
+		return
+	}
+	backends := make([]string, 0)
+	changes := make(map[string][]serverChange)
+	pending := make(map[string][]coalescedEvent)
+	for _, e := range events {
+		req, span, tracked := e.req.startEvent(e.event)
+		if !tracked {
+			span.End()
+			continue
+		}
+		release, err := req.claim(e.event)
+		if err != nil {
+			if !errors.Is(err, ErrDuplicateEvent) {
+				req.deadLetter(e.event, err)
+			}
+			endEventSpan(span, err)
+			continue
+		}
+		change, err := req.eventChange(e.event.Detail)
+		if err != nil {
+			release()
+			req.error("error processing ecs event message: " + err.Error())
+			req.deadLetter(e.event, err)
+			endSpan(span, err)
+			continue
+		}
+		if change == nil {
+			req.log("handled sns notification for service: " + e.event.Detail.Group)
+			req.clearDeadLetter(e.event)
+			span.End()
+			continue
+		}
+		if _, exists := changes[change.backend]; !exists {
+			backends = append(backends, change.backend)
+		}
+		changes[change.backend] = append(changes[change.backend], *change)
+		pending[change.backend] = append(pending[change.backend], coalescedEvent{
+			req:     req.withService(change.backend),
+			span:    span,
+			release: release,
+			event:   e.event,
+		})
+	}
+
+	for _, backend := range backends {
+		last := pending[backend][len(pending[backend])-1].req
+		req, span := last.startSpan("coalesce", attribute.Int("events", len(changes[backend])))
+		coalescedEvents.Observe(float64(len(changes[backend])))
+		err := req.applyChanges(backend, changes[backend])
+		endSpan(span, err)
+		for _, e := range pending[backend] {
+			if err != nil {
+				e.release()
+				e.req.error("error processing coalesced ecs event message: " + err.Error())
+				e.req.deadLetter(e.event, err)
+			} else {
+				e.req.log("handled sns notification for service: " + e.event.Detail.Group)
+				e.req.clearDeadLetter(e.event)
+			}
+			endSpan(e.span, err)
+		}
+	}
+}
+
+// applyChanges writes the changes of several events to a backend with one
+// update. The last change of each server wins
+func (req *request) applyChanges(backendName string, changes []serverChange) error {
+	final := make(map[string]serverChange)
+	for _, change := range changes {
+		final[change.address.String()] = change
+	}
+	add := make([]string, 0)
+	remove := make([]string, 0)
+	for addr, change := range final {
+		if change.running {
+			add = append(add, addr)
+		} else {
+			remove = append(remove, addr)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+	req.debug("coalesced " + strconv.Itoa(len(changes)) + " events of " + backendName + " into " +
+		strconv.Itoa(len(add)) + " added and " + strconv.Itoa(len(remove)) + " removed servers")
+
+	if err := req.updateServersDynamoDB(backendName, req.createBackend(add), remove); err != nil {
+		return errors.Wrap(err, "updateServersDynamoDB("+backendName+")")
+	}
+	for _, s := range req.sinks() {
+		for _, addr := range add {
+			if err := s.register(req, backendName, final[addr].address); err != nil {
+				return errors.Wrap(err, "register("+backendName+","+addr+")")
+			}
+		}
+		for _, addr := range remove {
+			if err := s.deregister(req, backendName, final[addr].address); err != nil {
+				return errors.Wrap(err, "deregister("+backendName+","+addr+")")
+			}
+		}
+	}
+	return nil
+}
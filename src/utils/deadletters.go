@@ -0,0 +1,440 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// DeadLetter is an event that failed to be handled. It is kept until the event
+// is handled, by a retry of sns or a replay
+type DeadLetter struct {
+	// ID is the sns message id of the event, or its ecs event id without one
+	ID          string    `json:"id"`
+	MessageID   string    `json:"messageId"`
+	Event       Event     `json:"event"`
+	Error       string    `json:"error"`
+	Attempts    int       `json:"attempts"`
+	FirstFailed time.Time `json:"firstFailed"`
+	LastFailed  time.Time `json:"lastFailed"`
+}
+
+// Replayed is the result of replaying a dead letter
+type Replayed struct {
+	ID     string
+	Result string
+}
+
+// String describes the result of the replay
+func (r Replayed) String() string {
+	return r.ID + " " + r.Result
+}
+
+// deadLetterStore keeps dead letters
+type deadLetterStore interface {
+	// failed records a failed attempt at handling the event of letter. Attempts
+	// add up for letters with the same id
+	failed(req *request, letter DeadLetter) error
+	get(req *request, id string) (DeadLetter, error)
+	list(req *request) ([]DeadLetter, error)
+	remove(req *request, id string) error
+}
+
+// newDeadLetters creates the dead letter store of a configuration. It is nil
+// when failed events aren't kept
+func newDeadLetters(cfg config.DeadLetters, prev deadLetterStore) deadLetterStore {
+	switch {
+	case cfg.Table != "":
+		return dynamoDeadLetters{table: cfg.Table}
+	case cfg.File != "":
+		if file, ok := prev.(*fileDeadLetters); ok && file.path == cfg.File {
+			return file
+		}
+		return &fileDeadLetters{path: cfg.File, mutex: &sync.Mutex{}}
+	}
+	return nil
+}
+
+// fileDeadLetters keeps dead letters in a json file. Each replica needs a file of its own
+type fileDeadLetters struct {
+	path  string
+	mutex *sync.Mutex
+}
+
+func (f *fileDeadLetters) load() (map[string]DeadLetter, error) {
+	letters := make(map[string]DeadLetter)
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return letters, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadFile("+f.path+")")
+	}
+	if err := json.Unmarshal(data, &letters); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal("+f.path+")")
+	}
+	return letters, nil
+}
+
+// save replaces the file so a crash never leaves half of it written
+func (f *fileDeadLetters) save(letters map[string]DeadLetter) error {
+	data, err := json.MarshalIndent(letters, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json.MarshalIndent()")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path))
+	if err != nil {
+		return errors.Wrap(err, "ioutil.TempFile()")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Write("+tmp.Name()+")")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Close("+tmp.Name()+")")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), f.path), "os.Rename("+f.path+")")
+}
+
+func (f *fileDeadLetters) failed(req *request, letter DeadLetter) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	letters, err := f.load()
+	if err != nil {
+		return err
+	}
+	if prev, exists := letters[letter.ID]; exists {
+		letter.Attempts += prev.Attempts
+		letter.FirstFailed = prev.FirstFailed
+	}
+	letters[letter.ID] = letter
+	return f.save(letters)
+}
+
+func (f *fileDeadLetters) get(req *request, id string) (DeadLetter, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	letters, err := f.load()
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	letter, exists := letters[id]
+	if !exists {
+		return DeadLetter{}, errors.Wrap(ErrItemNotFound, "dead letter "+id)
+	}
+	return letter, nil
+}
+
+func (f *fileDeadLetters) list(req *request) ([]DeadLetter, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	letters, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]DeadLetter, 0, len(letters))
+	for _, letter := range letters {
+		out = append(out, letter)
+	}
+	return out, nil
+}
+
+func (f *fileDeadLetters) remove(req *request, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	letters, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, exists := letters[id]; !exists {
+		return nil
+	}
+	delete(letters, id)
+	return f.save(letters)
+}
+
+// dynamoDeadLetters keeps dead letters in a dynamodb table shared by every
+// replica. The event is stored as json
+type dynamoDeadLetters struct {
+	table string
+}
+
+func (d dynamoDeadLetters) failed(req *request, letter DeadLetter) error {
+	event, err := json.Marshal(letter.Event)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal()")
+	}
+	params := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(letter.ID)},
+		},
+		UpdateExpression: aws.String("SET #m = :m, #ev = :ev, #er = :er, #l = :l, #f = if_not_exists(#f, :l) ADD #a :a"),
+		ExpressionAttributeNames: map[string]*string{
+			"#m":  aws.String("messageId"),
+			"#ev": aws.String("event"),
+			"#er": aws.String("error"),
+			"#l":  aws.String("lastFailed"),
+			"#f":  aws.String("firstFailed"),
+			"#a":  aws.String("attempts"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":m":  {S: aws.String(letter.MessageID)},
+			":ev": {S: aws.String(string(event))},
+			":er": {S: aws.String(letter.Error)},
+			":l":  {S: aws.String(letter.LastFailed.Format(time.RFC3339Nano))},
+			":a":  {N: aws.String(strconv.Itoa(letter.Attempts))},
+		},
+	}
+	if _, err := req.util.DynamoDB.UpdateItemWithContext(req.ctx, params); err != nil {
+		return errors.Wrap(classify(err), "dynamodb.UpdateItem()")
+	}
+	return nil
+}
+
+// deadLetterOf reads a dead letter out of its item
+func deadLetterOf(item map[string]*dynamodb.AttributeValue) (DeadLetter, error) {
+	letter := DeadLetter{
+		ID:        aws.StringValue(item["id"].S),
+		MessageID: aws.StringValue(attributeS(item["messageId"])),
+		Error:     aws.StringValue(attributeS(item["error"])),
+	}
+	if a := item["attempts"]; a != nil {
+		letter.Attempts, _ = strconv.Atoi(aws.StringValue(a.N))
+	}
+	letter.FirstFailed, _ = time.Parse(time.RFC3339Nano, aws.StringValue(attributeS(item["firstFailed"])))
+	letter.LastFailed, _ = time.Parse(time.RFC3339Nano, aws.StringValue(attributeS(item["lastFailed"])))
+	if err := json.Unmarshal([]byte(aws.StringValue(attributeS(item["event"]))), &letter.Event); err != nil {
+		return letter, errors.Wrap(err, "json.Unmarshal("+letter.ID+")")
+	}
+	return letter, nil
+}
+
+// attributeS is the string of an attribute that may be missing
+func attributeS(value *dynamodb.AttributeValue) *string {
+	if value == nil {
+		return nil
+	}
+	return value.S
+}
+
+func (d dynamoDeadLetters) get(req *request, id string) (DeadLetter, error) {
+	params := &dynamodb.GetItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+	}
+	resp, err := req.util.DynamoDB.GetItemWithContext(req.ctx, params)
+	if err != nil {
+		return DeadLetter{}, errors.Wrap(classify(err), "dynamodb.GetItem()")
+	}
+	if len(resp.Item) == 0 {
+		return DeadLetter{}, errors.Wrap(ErrItemNotFound, "dead letter "+id)
+	}
+	return deadLetterOf(resp.Item)
+}
+
+func (d dynamoDeadLetters) list(req *request) ([]DeadLetter, error) {
+	letters := make([]DeadLetter, 0)
+	var ierr error
+	params := &dynamodb.ScanInput{TableName: aws.String(d.table)}
+	err := req.util.DynamoDB.ScanPagesWithContext(req.ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			letter, err := deadLetterOf(item)
+			if err != nil {
+				ierr = err
+				return false
+			}
+			letters = append(letters, letter)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(classify(err), "dynamodb.Scan()")
+	}
+	return letters, ierr
+}
+
+func (d dynamoDeadLetters) remove(req *request, id string) error {
+	params := &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+	}
+	if _, err := req.util.DynamoDB.DeleteItemWithContext(req.ctx, params); err != nil {
+		return errors.Wrap(classify(err), "dynamodb.DeleteItem()")
+	}
+	return nil
+}
+
+// deadLetter keeps an event that failed to be handled so it can be replayed.
+// Nothing is kept in a dry run or without a dead letter store
+func (req *request) deadLetter(event Event, cause error) {
+	if req.dryRun() || req.util.deadLetters == nil {
+		return
+	}
+	id := req.deadLetterID(event)
+	now := time.Now()
+	letter := DeadLetter{
+		ID:          id,
+		MessageID:   req.messageID,
+		Event:       event,
+		Error:       cause.Error(),
+		Attempts:    1,
+		FirstFailed: now,
+		LastFailed:  now,
+	}
+	if err := req.util.deadLetters.failed(req, letter); err != nil {
+		req.error("error keeping dead letter " + id + ": " + err.Error())
+		return
+	}
+	deadLetters.Inc()
+	req.warn("kept failed event as dead letter " + id)
+}
+
+// clearDeadLetter removes the dead letter of an event that was handled, say
+// by an sns retry, so replaying it later can't undo newer changes
+func (req *request) clearDeadLetter(event Event) {
+	if req.dryRun() || req.util.deadLetters == nil {
+		return
+	}
+	id := req.deadLetterID(event)
+	if err := req.util.deadLetters.remove(req, id); err != nil {
+		req.error("error removing dead letter " + id + ": " + err.Error())
+	}
+}
+
+// deadLetterID is the sns message id of an event, or its ecs event id without one
+func (req *request) deadLetterID(event Event) string {
+	if req.messageID == "" {
+		return event.ID
+	}
+	return req.messageID
+}
+
+// ListDeadLetters lists the events that failed to be handled, the most recent failures first
+func ListDeadLetters() ([]DeadLetter, error) {
+	req := newRequest("DeadLetters::" + strconv.FormatInt(time.Now().Unix(), 10))
+	if req.util.deadLetters == nil {
+		return nil, ErrDeadLettersDisabled
+	}
+	letters, err := req.util.deadLetters.list(req)
+	if err != nil {
+		req.error("error listing dead letters: " + err.Error())
+		return nil, errors.Wrap(err, "list()")
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].LastFailed.After(letters[j].LastFailed) })
+	return letters, nil
+}
+
+// ReplayDeadLetter handles the event of a dead letter again with its original
+// sns message id. The dead letter is removed when it is handled, or was handled
+// since, and its attempts go up when it fails again. A dead letter of a running
+// task that ecs knows to have stopped since is removed without being handled
+func ReplayDeadLetter(id string) (Replayed, error) {
+	req := newRequest("Replay::" + id)
+	if req.util.deadLetters == nil {
+		return Replayed{ID: id}, ErrDeadLettersDisabled
+	}
+	letter, err := req.util.deadLetters.get(req, id)
+	if err != nil {
+		return Replayed{ID: id}, errors.Wrap(err, "get("+id+")")
+	}
+	return req.replay(letter)
+}
+
+// ReplayDeadLetters replays every dead letter, the oldest failures first, and
+// returns the result of each. It fails if any replay failed
+func ReplayDeadLetters() ([]Replayed, error) {
+	letters, err := ListDeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	replayed := make([]Replayed, 0, len(letters))
+	failed := 0
+	for i := len(letters) - 1; i >= 0; i-- {
+		r, err := newRequest("Replay::" + letters[i].ID).replay(letters[i])
+		if err != nil {
+			failed++
+		}
+		replayed = append(replayed, r)
+	}
+	if failed > 0 {
+		return replayed, errors.New(strconv.Itoa(failed) + " of " + strconv.Itoa(len(letters)) + " dead letters failed again")
+	}
+	return replayed, nil
+}
+
+func (req *request) replay(letter DeadLetter) (Replayed, error) {
+	req.messageID = letter.MessageID
+	result := "replayed"
+	stale, err := req.staleEvent(letter.Event)
+	if err == nil && stale != "" {
+		// the letter is removed without touching the backend
+		result = "stale, " + stale
+	} else if err == nil {
+		_, err = req.handleEvent(letter.Event)
+	}
+	switch {
+	case errors.Is(err, ErrDuplicateEvent):
+		result = "already handled"
+	case err != nil:
+		deadLetterReplays.WithLabelValues("failure").Inc()
+		return Replayed{ID: letter.ID, Result: "failed: " + err.Error()}, err
+	}
+	if stale != "" {
+		deadLetterReplays.WithLabelValues("stale").Inc()
+	} else {
+		deadLetterReplays.WithLabelValues("success").Inc()
+	}
+	if err := req.util.deadLetters.remove(req, letter.ID); err != nil {
+		req.error("error removing dead letter " + letter.ID + ": " + err.Error())
+		return Replayed{ID: letter.ID, Result: result + " but not removed"}, errors.Wrap(err, "remove("+letter.ID+")")
+	}
+	req.log(result + " dead letter " + letter.ID)
+	return Replayed{ID: letter.ID, Result: result}, nil
+}
+
+// staleEvent describes why ecs knows of a newer state of the task of an event
+// than the event itself. It is empty when the event can be replayed. Only
+// events of running tasks can be stale since a task never runs again once it
+// stopped
+func (req *request) staleEvent(event Event) (string, error) {
+	if event.Detail.LastStatus != Running || event.Detail.DesiredStatus != Running {
+		return "", nil
+	}
+	cluster, ok := req.eventCluster(event)
+	if !ok {
+		// handleEvent ignores it
+		return "", nil
+	}
+	arn := event.Detail.TaskArn
+	tasks, err := req.forCluster(cluster).getTasks([]*string{aws.String(arn)})
+	if err != nil {
+		return "", errors.Wrap(err, "getTasks("+arn+")")
+	}
+	for _, task := range tasks {
+		if aws.StringValue(task.TaskArn) != arn {
+			continue
+		}
+		if aws.StringValue(task.LastStatus) == Running && aws.StringValue(task.DesiredStatus) == Running {
+			return "", nil
+		}
+		return "the task is " + aws.StringValue(task.LastStatus) + " with desired status " + aws.StringValue(task.DesiredStatus), nil
+	}
+	// ecs forgets tasks a while after they stopped
+	return "the task is gone", nil
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/containous/traefik/types"
+	"github.com/pkg/errors"
+)
+
+// withDeadLetterFile keeps dead letters in a file of a temporary directory
+// until the returned func is called
+func withDeadLetterFile(t *testing.T) func() {
+	file := &fileDeadLetters{path: filepath.Join(t.TempDir(), "dead-letters.json"), mutex: &sync.Mutex{}}
+	return withUtil(func(u *Util) {
+		u.deadLetters = file
+		u.dedupe = newMemoryDedupe()
+	})
+}
+
+// backendServers reads the servers of a backend from the dynamodb mock
+func backendServers(t *testing.T, name string) map[string]types.Server {
+	backend := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items[name+"__backend"], &backend); err != nil {
+		t.Fatal(err)
+	}
+	return backend.Backend.Servers
+}
+
+func deadLetterEvent(id string, port int) Event {
+	return Event{
+		ID: id,
+		Detail: Detail{
+			Group:                "service:deadtask",
+			ContainerInstanceArn: "deadinstancearn",
+			DesiredStatus:        Running,
+			LastStatus:           Running,
+			TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/" + id,
+			Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: port}}}},
+		},
+	}
+}
+
+// deadLetterTask adds the task of a dead letter event to ecs with a status
+func deadLetterTask(id, status string) {
+	ecsM.AddTask(&ecs.Task{
+		ContainerInstanceArn: aws.String("deadinstancearn"),
+		TaskArn:              aws.String(deadLetterEvent(id, 0).Detail.TaskArn),
+		Group:                aws.String("service:deadtask"),
+		LastStatus:           aws.String(status),
+		DesiredStatus:        aws.String(status),
+	})
+}
+
+func stoppedEvent(id string, port int) Event {
+	event := deadLetterEvent(id, port)
+	event.ID = id + "-stopped"
+	event.Detail.LastStatus = Stopped
+	event.Detail.DesiredStatus = Stopped
+	return event
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	defer withDeadLetterFile(t)()
+	forgetInstances()
+	defer forgetInstances()
+	createEnv("deadinstancearn", "deadtask", "deadinstanceid", "10.0.0.13", 8300)
+	defer ecsM.RemoveTask("deadtask-arn")
+	event := deadLetterEvent("dead1", 8301)
+	deadLetterTask("dead1", Running)
+	defer ecsM.RemoveTask(event.Detail.TaskArn)
+
+	// sns delivers the event twice and it fails both times
+	dynamodbM.FailGet = true
+	for i := 0; i < 2; i++ {
+		if _, err := HandleSNS("TestDeadLetter::1", ioutil.NopCloser(snsEventBody(event)), false); err == nil {
+			t.Fatal("expected the event to fail")
+		}
+	}
+	dynamodbM.FailGet = false
+
+	letters, err := ListDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %v", letters)
+	}
+	letter := letters[0]
+	if letter.ID != "TestDeadLetter::1" || letter.Attempts != 2 || letter.Event.ID != "dead1" || letter.Error == "" {
+		t.Errorf("unexpected dead letter %+v", letter)
+	}
+	if !letter.FirstFailed.Before(letter.LastFailed) {
+		t.Error("expected the first failure to be kept")
+	}
+
+	replayed, err := ReplayDeadLetter(letter.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Result != "replayed" {
+		t.Errorf("expected the dead letter to be replayed, got %s", replayed)
+	}
+	if _, ok := backendServers(t, "deadtask")["10.0.0.13:8301"]; !ok {
+		t.Error("the replayed event didn't add its server")
+	}
+	if letters, _ := ListDeadLetters(); len(letters) != 0 {
+		t.Errorf("expected the replayed dead letter to be removed, got %v", letters)
+	}
+	if _, err := ReplayDeadLetter(letter.ID); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("expected a removed dead letter to be not found, got %v", err)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	defer withDeadLetterFile(t)()
+	forgetInstances()
+	defer forgetInstances()
+	createEnv("deadinstancearn", "deadtask", "deadinstanceid", "10.0.0.13", 8300)
+	defer ecsM.RemoveTask("deadtask-arn")
+
+	dynamodbM.FailGet = true
+	for _, id := range []string{"dead2", "dead3"} {
+		deadLetterTask(id, Running)
+		defer ecsM.RemoveTask(deadLetterEvent(id, 0).Detail.TaskArn)
+		HandleSNS("TestDeadLetter::"+id, ioutil.NopCloser(snsEventBody(deadLetterEvent(id, 8302))), false)
+	}
+	dynamodbM.FailGet = false
+	// sns retries dead2 after the failure went away
+	if _, err := HandleSNS("TestDeadLetter::dead2", ioutil.NopCloser(snsEventBody(deadLetterEvent("dead2", 8302))), false); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ := ListDeadLetters(); len(letters) != 1 || letters[0].ID != "TestDeadLetter::dead3" {
+		t.Errorf("expected the handled retry to remove its dead letter, got %v", letters)
+	}
+
+	replayed, err := ReplayDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]string, len(replayed))
+	for i, r := range replayed {
+		results[i] = r.String()
+	}
+	if got := strings.Join(results, ","); got != "TestDeadLetter::dead3 replayed" {
+		t.Errorf("unexpected replays %s", got)
+	}
+	if letters, _ := ListDeadLetters(); len(letters) != 0 {
+		t.Errorf("expected every dead letter to be removed, got %v", letters)
+	}
+}
+
+func TestReplayDeadLettersOfStoppedTasks(t *testing.T) {
+	defer withDeadLetterFile(t)()
+	forgetInstances()
+	defer forgetInstances()
+	createEnv("deadinstancearn", "deadtask", "deadinstanceid", "10.0.0.13", 8300)
+	defer ecsM.RemoveTask("deadtask-arn")
+
+	ports := map[string]int{"dead4": 8304, "dead5": 8305}
+
+	// dead4 fails and is handled by a retry of sns. dead5 is never retried
+	dynamodbM.FailGet = true
+	for id, port := range ports {
+		HandleSNS("TestDeadLetter::"+id, ioutil.NopCloser(snsEventBody(deadLetterEvent(id, port))), false)
+	}
+	dynamodbM.FailGet = false
+	if _, err := HandleSNS("TestDeadLetter::dead4", ioutil.NopCloser(snsEventBody(deadLetterEvent("dead4", 8304))), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// then both tasks stop
+	for id := range ports {
+		deadLetterTask(id, Stopped)
+		defer ecsM.RemoveTask(deadLetterEvent(id, 0).Detail.TaskArn)
+	}
+	for id, port := range ports {
+		if _, err := HandleSNS("TestDeadLetter::"+id+"-stopped", ioutil.NopCloser(snsEventBody(stoppedEvent(id, port))), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := backendServers(t, "deadtask")
+
+	replayed, err := ReplayDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 1 || replayed[0].String() != "TestDeadLetter::dead5 stale, the task is STOPPED with desired status STOPPED" {
+		t.Errorf("unexpected replays %v", replayed)
+	}
+	after := backendServers(t, "deadtask")
+	if len(after) != len(before) {
+		t.Errorf("expected the backend to be left alone, had %v and got %v", before, after)
+	}
+	for _, addr := range []string{"10.0.0.13:8304", "10.0.0.13:8305"} {
+		if _, ok := after[addr]; ok {
+			t.Errorf("the replay put the stopped server %s back", addr)
+		}
+	}
+	if letters, _ := ListDeadLetters(); len(letters) != 0 {
+		t.Errorf("expected the stale dead letter to be removed, got %v", letters)
+	}
+}
+
+func TestDeadLettersDisabled(t *testing.T) {
+	defer withUtil(func(u *Util) { u.deadLetters = nil })()
+	if _, err := ListDeadLetters(); !errors.Is(err, ErrDeadLettersDisabled) {
+		t.Errorf("expected ErrDeadLettersDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// dedupeStore remembers the events that were handled so ones sns delivers
+// again aren't. Sns delivers at least once so an old event delivered late
+// could otherwise undo the changes of newer ones
+type dedupeStore interface {
+	// claim records key until expires and reports whether it was already
+	// recorded by a claim that hasn't expired
+	claim(req *request, key string, now, expires time.Time) (bool, error)
+	// release forgets key so a delivery that failed is handled when sns retries it
+	release(req *request, key string) error
+}
+
+// newDedupe creates the dedupe store of a configuration. The events remembered
+// in memory are kept across reloads
+func newDedupe(cfg config.Dedupe, prev dedupeStore) dedupeStore {
+	if cfg.Table != "" {
+		return dynamoDedupe{table: cfg.Table}
+	}
+	if memory, ok := prev.(*memoryDedupe); ok {
+		return memory
+	}
+	return newMemoryDedupe()
+}
+
+// memoryDedupe remembers events in memory. Each replica only knows the events
+// it handled
+type memoryDedupe struct {
+	mutex   *sync.Mutex
+	expires map[string]time.Time
+	// nextSweep is when expired keys are dropped next
+	nextSweep time.Time
+}
+
+func newMemoryDedupe() *memoryDedupe {
+	return &memoryDedupe{mutex: &sync.Mutex{}, expires: make(map[string]time.Time)}
+}
+
+func (m *memoryDedupe) claim(req *request, key string, now, expires time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if now.After(m.nextSweep) {
+		for k, e := range m.expires {
+			if !e.After(now) {
+				delete(m.expires, k)
+			}
+		}
+		m.nextSweep = expires
+	}
+	if e, exists := m.expires[key]; exists && e.After(now) {
+		return true, nil
+	}
+	m.expires[key] = expires
+	return false, nil
+}
+
+func (m *memoryDedupe) release(req *request, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.expires, key)
+	return nil
+}
+
+// dynamoDedupe remembers events in a dynamodb table shared by every replica.
+// Items have an expires attribute in unix seconds which can be the time to
+// live attribute of the table
+type dynamoDedupe struct {
+	table string
+}
+
+func (d dynamoDedupe) claim(req *request, key string, now, expires time.Time) (bool, error) {
+	params := &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":      {S: aws.String(key)},
+			"expires": {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+		},
+		// expired items may not have been deleted by dynamodb yet
+		ConditionExpression:      aws.String("attribute_not_exists(id) OR #e <= :now"),
+		ExpressionAttributeNames: map[string]*string{"#e": aws.String("expires")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	}
+	_, err := req.util.DynamoDB.PutItemWithContext(req.ctx, params)
+	if err != nil {
+		err = classify(err)
+		if isVersionConflict(err) {
+			return true, nil
+		}
+		return false, errors.Wrap(err, "dynamodb.PutItem()")
+	}
+	return false, nil
+}
+
+func (d dynamoDedupe) release(req *request, key string) error {
+	params := &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(key)},
+		},
+	}
+	if _, err := req.util.DynamoDB.DeleteItemWithContext(req.ctx, params); err != nil {
+		return errors.Wrap(classify(err), "dynamodb.DeleteItem()")
+	}
+	return nil
+}
+
+// claimEvent claims the sns message id and the ecs event id of an event. It
+// returns ErrDuplicateEvent if either was claimed before, and a func that
+// releases the claims when handling the event fails
+func (req *request) claimEvent(messageID, eventID string) (func(), error) {
+	now := time.Now()
+	expires := now.Add(time.Duration(req.util.Dedupe.TTL))
+	claimed := make([]string, 0, 2)
+	release := func() {
+		for _, key := range claimed {
+			if err := req.util.dedupe.release(req, key); err != nil {
+				req.error("error releasing " + key + ": " + err.Error())
+			}
+		}
+	}
+	for _, id := range []struct{ label, key string }{
+		{"message_id", messageID},
+		{"event_id", eventID},
+	} {
+		if id.key == "" {
+			continue
+		}
+		key := id.label + ":" + id.key
+		duplicate, err := req.util.dedupe.claim(req, key, now, expires)
+		if err != nil {
+			release()
+			return nil, errors.Wrap(err, "claim("+key+")")
+		}
+		if duplicate {
+			duplicateEvents.WithLabelValues(id.label).Inc()
+			return nil, errors.Wrap(ErrDuplicateEvent, key)
+		}
+		claimed = append(claimed, key)
+	}
+	return release, nil
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func TestMemoryDedupeTTL(t *testing.T) {
+	store := newMemoryDedupe()
+	req := newRequest("TestMemoryDedupeTTL")
+	now := time.Now()
+	for _, c := range []struct {
+		at        time.Duration
+		duplicate bool
+	}{
+		{0, false},
+		{time.Minute, true},
+		{2 * time.Hour, false},
+		{2*time.Hour + time.Minute, true},
+	} {
+		at := now.Add(c.at)
+		duplicate, err := store.claim(req, "message_id:1", at, at.Add(time.Hour))
+		if err != nil || duplicate != c.duplicate {
+			t.Errorf("claim after %s: got duplicate %t, %v want %t", c.at, duplicate, err, c.duplicate)
+		}
+	}
+	if err := store.release(req, "message_id:1"); err != nil {
+		t.Fatal(err)
+	}
+	if duplicate, _ := store.claim(req, "message_id:1", now.Add(3*time.Hour), now.Add(4*time.Hour)); duplicate {
+		t.Error("a released key was still claimed")
+	}
+}
+
+func TestDynamoDedupe(t *testing.T) {
+	mock := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withUtil(func(u *Util) { u.DynamoDB = mock })()
+	store := dynamoDedupe{table: "dedupe"}
+	req := newRequest("TestDynamoDedupe")
+	now := time.Now()
+
+	if duplicate, err := store.claim(req, "event_id:1", now, now.Add(time.Hour)); err != nil || duplicate {
+		t.Fatalf("first claim: %t %v", duplicate, err)
+	}
+	if duplicate, err := store.claim(req, "event_id:1", now.Add(time.Minute), now.Add(time.Hour)); err != nil || !duplicate {
+		t.Errorf("second claim was not a duplicate: %v", err)
+	}
+	if duplicate, err := store.claim(req, "event_id:1", now.Add(2*time.Hour), now.Add(3*time.Hour)); err != nil || duplicate {
+		t.Errorf("an expired claim was a duplicate: %v", err)
+	}
+	if err := store.release(req, "event_id:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := mock.Items["event_id:1"]; exists {
+		t.Error("release didn't delete the claim")
+	}
+}
+
+// forgetInstances empties the instance caches. The mocks describe every
+// container instance whatever is asked so the caches end up wrong for later tests
+func forgetInstances() {
+	arnToInstanceIDs = make(map[string]*string)
+	instancePrivateIPs = make(map[string]string)
+}
+
+func TestHandleSNSDuplicate(t *testing.T) {
+	defer withUtil(func(u *Util) { u.dedupe = newMemoryDedupe() })()
+	defer forgetInstances()
+	createEnv("dupinstancearn", "duptask", "dupinstanceid", "10.0.0.9", 8098)
+	running := Event{
+		ID: "event-running",
+		Detail: Detail{
+			Group:                "service:duptask",
+			ContainerInstanceArn: "dupinstancearn",
+			DesiredStatus:        Running,
+			LastStatus:           Running,
+			TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/dup1",
+			Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 8098}}}},
+		},
+	}
+	stopped := running
+	stopped.ID = "event-stopped"
+	stopped.Detail.DesiredStatus, stopped.Detail.LastStatus = Stopped, Stopped
+	messageDuplicates := testutil.ToFloat64(duplicateEvents.WithLabelValues("message_id"))
+	eventDuplicates := testutil.ToFloat64(duplicateEvents.WithLabelValues("event_id"))
+
+	if _, err := HandleSNS("TestDup::Running", ioutil.NopCloser(snsEventBody(running)), false); err != nil {
+		t.Fatal(err)
+	}
+	ecsM.RemoveTask("duptask-arn")
+	if _, err := HandleSNS("TestDup::Stopped", ioutil.NopCloser(snsEventBody(stopped)), false); err != nil {
+		t.Fatal(err)
+	}
+	// sns redelivers the running event, then the same event arrives in another message
+	if _, err := HandleSNS("TestDup::Running", ioutil.NopCloser(snsEventBody(running)), false); !errors.Is(err, ErrDuplicateEvent) {
+		t.Errorf("expected a redelivered message to be a duplicate, got %v", err)
+	}
+	if _, err := HandleSNS("TestDup::Again", ioutil.NopCloser(snsEventBody(running)), false); !errors.Is(err, ErrDuplicateEvent) {
+		t.Errorf("expected an event delivered in another message to be a duplicate, got %v", err)
+	}
+
+	backend := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["duptask__backend"], &backend); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.Backend.Servers) != 0 {
+		t.Errorf("a duplicate event brought back a stopped task: %v", backend.Backend.Servers)
+	}
+	if got := testutil.ToFloat64(duplicateEvents.WithLabelValues("message_id")) - messageDuplicates; got != 1 {
+		t.Errorf("expected 1 duplicate message, got %v", got)
+	}
+	if got := testutil.ToFloat64(duplicateEvents.WithLabelValues("event_id")) - eventDuplicates; got != 1 {
+		t.Errorf("expected 1 duplicate event, got %v", got)
+	}
+}
+
+func TestHandleSNSReleasesFailedEvent(t *testing.T) {
+	defer withUtil(func(u *Util) { u.dedupe = newMemoryDedupe() })()
+	defer forgetInstances()
+	createEnv("failinstancearn", "failtask", "failinstanceid", "10.0.0.10", 8099)
+	defer ecsM.RemoveTask("failtask-arn")
+	event := Event{
+		ID: "event-fail",
+		Detail: Detail{
+			Group:                "service:failtask",
+			ContainerInstanceArn: "failinstancearn",
+			DesiredStatus:        Running,
+			LastStatus:           Running,
+			TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/fail1",
+			Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 8099}}}},
+		},
+	}
+	dynamodbM.FailGet = true
+	_, err := HandleSNS("TestDup::Fail", ioutil.NopCloser(snsEventBody(event)), false)
+	dynamodbM.FailGet = false
+	if err == nil {
+		t.Fatal("expected the event to fail")
+	}
+	if _, err := HandleSNS("TestDup::Fail", ioutil.NopCloser(snsEventBody(event)), false); err != nil {
+		t.Errorf("the retry of a failed event wasn't handled: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/containous/traefik/types"
+)
+
+const (
+	// MutationCreate creates an item
+	MutationCreate = "create"
+	// MutationUpdate changes an existing item
+	MutationUpdate = "update"
+	// MutationDelete deletes an item
+	MutationDelete = "delete"
+)
+
+// Mutation is a change to an item in dynamodb that a dry run planned instead of making
+type Mutation struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	// Add and Remove are the servers that are added to and removed from a backend
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+	// Version is the version of the item after the change
+	Version uint64 `json:"version,omitempty"`
+}
+
+// String describes the change like update web__backend to v3 +10.0.0.1:32768 -10.0.0.2:32768
+func (m Mutation) String() string {
+	out := m.Action + " " + m.ID
+	if m.Action != MutationDelete {
+		out += " to v" + strconv.FormatUint(m.Version, 10)
+	}
+	for _, server := range m.Add {
+		out += " +" + server
+	}
+	for _, server := range m.Remove {
+		out += " -" + server
+	}
+	return out
+}
+
+// plan collects the mutations of a dry run
+type plan struct {
+	mutations []Mutation
+}
+
+// withDryRun returns a copy of the request that plans changes to dynamodb and
+// the sinks instead of making them when dryRun or the global dry run is set
+func (req *request) withDryRun(dryRun bool) *request {
+	dreq := *req
+	if dryRun || req.util.DryRun {
+		dreq.plan = &plan{}
+	}
+	return &dreq
+}
+
+// dryRun checks whether the request only plans changes
+func (req *request) dryRun() bool {
+	return req.plan != nil
+}
+
+// planMutation records a change a dry run would have made
+func (req *request) planMutation(m Mutation) {
+	req.plan.mutations = append(req.plan.mutations, m)
+	req.log("dry run: would " + m.String())
+}
+
+// mutations are the changes a dry run planned. nil if the request isn't a dry run
+func (req *request) mutations() []Mutation {
+	if req.plan == nil {
+		return nil
+	}
+	if req.plan.mutations == nil {
+		return []Mutation{}
+	}
+	return req.plan.mutations
+}
+
+// sinks are the sinks to update. None in a dry run
+func (req *request) sinks() []Sink {
+	if req.dryRun() && len(req.util.Sinks) > 0 {
+		req.debug("dry run: not updating sinks")
+		return nil
+	}
+	return req.util.Sinks
+}
+
+// serverChanges lists the servers that are added and removed going from prev to next
+func serverChanges(prev, next types.Backend) ([]string, []string) {
+	add, remove := make([]string, 0), make([]string, 0)
+	for server := range next.Servers {
+		if _, exists := prev.Servers[server]; !exists {
+			add = append(add, server)
+		}
+	}
+	for server := range prev.Servers {
+		if _, exists := next.Servers[server]; !exists {
+			remove = append(remove, server)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+	return add, remove
+}
+
+// planBackendUpdate plans going from prev to next
+func (req *request) planBackendUpdate(prev, next BackendItem) {
+	add, remove := serverChanges(prev.Backend, next.Backend)
+	req.planMutation(Mutation{
+		ID:      next.ID,
+		Action:  MutationUpdate,
+		Add:     add,
+		Remove:  remove,
+		Version: prev.Version + 1,
+	})
+}
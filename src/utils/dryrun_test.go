@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func TestHandleSyncDryRun(t *testing.T) {
+	cluster := accountCluster("", "dryrun-instance-arn", "i-dryrun", "10.7.0.1")
+	cluster.ECS.(*utils_test.EcsMock).AddTask(&ecs.Task{
+		ContainerInstanceArn: aws.String("dryrun-instance-arn"),
+		TaskArn:              aws.String("arn:aws:ecs:us-east-1:123456789012:task/dryrun1"),
+		Group:                aws.String("service:checkout"),
+		Containers: []*ecs.Container{
+			{NetworkBindings: []*ecs.NetworkBinding{{HostPort: aws.Int64(9300)}}},
+		},
+	})
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withUtil(func(u *Util) { u.DynamoDB = table })()
+
+	req := newRequest("TestHandleSyncDryRun")
+	stale := req.createBackendItem("checkout", req.createBackend([]string{"10.7.0.9:9300"}))
+	stale.Version = 4
+	item, _ := dynamodbattribute.MarshalMap(stale)
+	table.PutBackend(item)
+
+	mutations, err := HandleSync("", "checkout", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutations) != 1 {
+		t.Fatalf("expected one planned change, got %v", mutations)
+	}
+	if got := mutations[0].String(); got != "update checkout__backend to v5 +10.7.0.1:9300 -10.7.0.9:9300" {
+		t.Errorf("unexpected plan: %s", got)
+	}
+	unchanged := BackendItem{}
+	dynamodbattribute.UnmarshalMap(table.Items["checkout__backend"], &unchanged)
+	if unchanged.Version != 4 || len(unchanged.Backend.Servers) != 1 {
+		t.Errorf("dry run changed the backend: %+v", unchanged)
+	}
+
+	mutations, err = HandleSync("", "checkout", false)
+	if err != nil || mutations != nil {
+		t.Fatalf("expected a real sync without a plan, got %v %v", mutations, err)
+	}
+}
+
+func TestHandleSNSDryRun(t *testing.T) {
+	cluster := accountCluster("", "dryrun-event-instance-arn", "i-dryrun-event", "10.7.0.2")
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withUtil(func(u *Util) {
+		u.DynamoDB = table
+		u.DryRun = true
+	})()
+
+	event := Event{
+		Detail: Detail{
+			Group:                "service:payments",
+			ContainerInstanceArn: "dryrun-event-instance-arn",
+			DesiredStatus:        Running,
+			LastStatus:           Running,
+			TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/dryrun2",
+			Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 9400}}}},
+		},
+	}
+	mutations, err := HandleSNS("TestDryRun::Add", ioutil.NopCloser(snsEventBody(event)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mutations) != 1 || mutations[0].String() != "create payments__backend to v0 +10.7.0.2:9400" {
+		t.Errorf("expected the global dry run to plan creating the backend, got %v", mutations)
+	}
+	if len(table.Items) != 0 {
+		t.Error("dry run wrote to dynamodb")
+	}
+}
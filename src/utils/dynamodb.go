@@ -2,14 +2,20 @@ package utils
 
 import (
 	"strconv"
-	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/containous/traefik/types"
 	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+const (
+	// WriteStrategyLock writes whole backends conditioned on their version. See config.WriteStrategyLock
+	WriteStrategyLock = config.WriteStrategyLock
+	// WriteStrategyPath writes single servers with map path updates. See config.WriteStrategyPath
+	WriteStrategyPath = config.WriteStrategyPath
 )
 
 // GetItem gets an item from a dynamodb table
@@ -20,17 +26,17 @@ func (req *request) getItem(primaryKey, value string) (map[string]*dynamodb.Attr
 				S: aws.String(value),
 			},
 		},
-		TableName:      aws.String(util.TraefikTable),
+		TableName:      aws.String(req.util.TraefikTable),
 		ConsistentRead: aws.Bool(true),
 	}
-	resp, err := util.DynamoDB.GetItem(params)
+	resp, err := req.util.DynamoDB.GetItemWithContext(req.ctx, params)
 	if err != nil {
 		req.debug("error getting item from dynamodb")
-		return nil, errors.Wrap(err, "dynamodb.GetItem()")
+		return nil, errors.Wrap(classify(err), "dynamodb.GetItem()")
 	}
 	if len(resp.Item) < 1 {
 		req.debug("warning no item returned from dynamodb")
-		return nil, errors.New(ErrItemNotFound)
+		return nil, ErrItemNotFound
 	}
 	req.debug("successfully got item from dynamodb")
 	return resp.Item, nil
@@ -39,7 +45,7 @@ func (req *request) getItem(primaryKey, value string) (map[string]*dynamodb.Attr
 // GetBackend gest the backend
 func (req *request) getBackendItem(backendName string) (BackendItem, error) {
 	backend := BackendItem{}
-	item, err := req.getItem("id", backendName+"__backend")
+	item, err := req.getItem("id", req.backendID(backendName))
 	if err != nil {
 		req.debug("error getting backend from dynamodb: " + backendName)
 		return backend, errors.Wrap(err, "getItem(id, "+backendName+")")
@@ -67,46 +73,46 @@ func (req *request) updateBackendWithLock(endItem BackendItem) error {
 	if err != nil {
 		return errors.Wrap(err, "dynamodbattribute.Marshal()")
 	}
+	// backends created before owners existed are claimed by whoever updates them first
 	params := &dynamodb.UpdateItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {S: aws.String(endItem.ID)},
 		},
-		TableName:           aws.String(util.TraefikTable),
+		TableName:           aws.String(req.util.TraefikTable),
 		ConditionExpression: aws.String("#v = :v"),
-		UpdateExpression:    aws.String("SET #v = #v + :one, #b = :b"),
+		UpdateExpression:    aws.String("SET #v = #v + :one, #b = :b, #o = if_not_exists(#o, :o)"),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":v":   {N: aws.String(version)},
 			":one": {N: aws.String("1")},
 			":b":   backendAttribute,
+			":o":   {S: aws.String(req.util.Owner)},
 		},
 		ExpressionAttributeNames: map[string]*string{
 			"#v": aws.String("version"),
 			"#b": aws.String("backend"),
+			"#o": aws.String("owner"),
 		},
 	}
-	_, err = util.DynamoDB.UpdateItem(params)
+	_, err = req.util.DynamoDB.UpdateItemWithContext(req.ctx, params)
 	if err != nil {
 		req.debug("error updataing backend in dynamodb")
-		return errors.Wrap(err, "dynamodb.UpdateItem()")
+		return errors.Wrap(classify(err), "dynamodb.UpdateItem()")
 	}
 	return nil
 }
 
 // UpdateBackendDynamoDB updates the backend. If it doesn't exist it is created
-// It will attempt as many times as MaxTries if the version is off
+// Version conflicts are retried with the backoff of the retry policy
 func (req *request) updateBackendDynamoDB(backendName string, traefikBackend types.Backend, overwriteServers bool) error {
-	var err error
-	var backend BackendItem
-	for i := 0; i < util.MaxTries; i++ {
+	return req.util.retry.do(isVersionConflict, func() error {
 		// Get backend
-		backend, err = req.getBackendItem(backendName)
+		backend, err := req.getBackendItem(backendName)
 		if err != nil {
 			// Create Item if it doesn't exist
-			if strings.Contains(err.Error(), ErrItemNotFound) {
+			if errors.Is(err, ErrItemNotFound) {
 				req.debug("backend not found: " + backendName)
 				backendItem := req.createBackendItem(backendName, traefikBackend)
-				err := req.createBackendDynamoDB(backendName, backendItem)
-				return err
+				return req.createBackendDynamoDB(backendName, backendItem)
 			}
 			// if we get here then we got other issues
 			return errors.Wrap(err, "getBackendItem("+backendName+")")
@@ -121,50 +127,194 @@ func (req *request) updateBackendDynamoDB(backendName string, traefikBackend typ
 			updatedBackend = req.updateBackendItemServers(backend, traefikBackend)
 		}
 
-		// Attempt to update dynamodb
-		err = req.updateBackendWithLock(updatedBackend)
-		if err == nil {
-			req.debug("successfully updated backend: " + backendName)
+		if req.dryRun() {
+			req.planBackendUpdate(backend, updatedBackend)
 			return nil
 		}
 
-		// if the error is because of something other than the condition not being met
-		// then bail otherwise try again
-		if !strings.Contains(err.Error(), dynamodb.ErrCodeConditionalCheckFailedException) {
-			req.debug("error updating backend: " + backendName + " on try: " + strconv.Itoa(i))
-			break
+		// Attempt to update dynamodb
+		if err := req.updateBackendWithLock(updatedBackend); err != nil {
+			req.debug("error updating backend: " + backendName)
+			return err
+		}
+		req.debug("successfully updated backend: " + backendName)
+		return nil
+	})
+}
+
+// addServersDynamoDB adds the servers of traefikBackend to a backend. With the
+// path write strategy each server is set on its own so events for the same
+// backend don't conflict. Backends that don't exist yet or have no servers are
+// written whole
+func (req *request) addServersDynamoDB(backendName string, traefikBackend types.Backend) error {
+	if req.util.WriteStrategy != WriteStrategyPath || req.dryRun() {
+		return req.updateBackendDynamoDB(backendName, traefikBackend, false)
+	}
+	for addr, server := range traefikBackend.Servers {
+		err := req.setServerWithPath(backendName, addr, server)
+		// the condition only fails when there are no servers to add to
+		if errors.Is(err, ErrVersionConflict) {
+			req.debug("no servers in " + backendName + ". writing the whole backend")
+			return req.updateBackendDynamoDB(backendName, traefikBackend, false)
+		}
+		if err != nil {
+			return errors.Wrap(err, "setServerWithPath("+addr+")")
 		}
-		req.debug("item locked. trying again...")
-		time.Sleep(100 * time.Millisecond)
 	}
-	return errors.Wrap(err, "tried to update "+strconv.Itoa(util.MaxTries)+" times")
+	return nil
+}
+
+// setServerWithPath sets a single server of a backend with a map path update
+// expression and bumps its version so traefik picks up the change
+func (req *request) setServerWithPath(backendName, addr string, server types.Server) error {
+	serverAttribute, err := dynamodbattribute.Marshal(server)
+	if err != nil {
+		return errors.Wrap(err, "dynamodbattribute.Marshal()")
+	}
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(req.backendID(backendName))},
+		},
+		TableName:           aws.String(req.util.TraefikTable),
+		ConditionExpression: aws.String("attribute_exists(#b.#s)"),
+		UpdateExpression:    aws.String("SET #b.#s.#addr = :srv, #v = #v + :one, #o = if_not_exists(#o, :o)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":srv": serverAttribute,
+			":one": {N: aws.String("1")},
+			":o":   {S: aws.String(req.util.Owner)},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#b":    aws.String("backend"),
+			"#s":    aws.String("servers"),
+			"#addr": aws.String(addr),
+			"#v":    aws.String("version"),
+			"#o":    aws.String("owner"),
+		},
+	}
+	if _, err := req.util.DynamoDB.UpdateItemWithContext(req.ctx, params); err != nil {
+		req.debug("error setting server " + addr + " of " + backendName)
+		return errors.Wrap(classify(err), "dynamodb.UpdateItem()")
+	}
+	return nil
+}
+
+// removeServerWithPath removes a single server of a backend with a map path
+// update expression and bumps its version. A server that is already gone is
+// left alone
+func (req *request) removeServerWithPath(backendName, addr string) error {
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(req.backendID(backendName))},
+		},
+		TableName:           aws.String(req.util.TraefikTable),
+		ConditionExpression: aws.String("attribute_exists(#b.#s.#addr)"),
+		UpdateExpression:    aws.String("REMOVE #b.#s.#addr SET #v = #v + :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#b":    aws.String("backend"),
+			"#s":    aws.String("servers"),
+			"#addr": aws.String(addr),
+			"#v":    aws.String("version"),
+		},
+	}
+	if _, err := req.util.DynamoDB.UpdateItemWithContext(req.ctx, params); err != nil {
+		err = classify(err)
+		if errors.Is(err, ErrVersionConflict) {
+			req.debug("server " + addr + " is not in " + backendName)
+			return nil
+		}
+		return errors.Wrap(err, "dynamodb.UpdateItem()")
+	}
+	return nil
 }
 
 // RemoveServerFromBackendDynamoDB removes a server from a backend
 func (req *request) removeServerFromBackendDynamoDB(backendName, portIP string) error {
 	req.debug("removing server: " + portIP + " from " + backendName)
-	var err error
-	var backend BackendItem
-	for i := 0; i < util.MaxTries; i++ {
-		backend, err = req.getBackendItem(backendName)
+	if req.util.WriteStrategy == WriteStrategyPath && !req.dryRun() {
+		return req.removeServerWithPath(backendName, portIP)
+	}
+	return req.util.retry.do(isVersionConflict, func() error {
+		backend, err := req.getBackendItem(backendName)
 		if err != nil {
 			return errors.Wrap(err, "getBackendItem("+backendName+")")
 		}
-		delete(backend.Backend.Servers, portIP)
-		err = req.updateBackendWithLock(backend)
-		if err == nil {
+		if req.dryRun() {
+			updated := backend
+			updated.Backend.Servers = make(map[string]types.Server)
+			for server, s := range backend.Backend.Servers {
+				if server != portIP {
+					updated.Backend.Servers[server] = s
+				}
+			}
+			req.planBackendUpdate(backend, updated)
 			return nil
 		}
-
-		if !strings.Contains(err.Error(), dynamodb.ErrCodeConditionalCheckFailedException) {
+		delete(backend.Backend.Servers, portIP)
+		if err := req.updateBackendWithLock(backend); err != nil {
 			return errors.Wrap(err, "updateBackendWithLock()")
 		}
+		return nil
+	})
+}
+
+// updateServersDynamoDB adds and removes servers of a backend with one update.
+// With the path write strategy each server is written on its own instead.
+// A backend that doesn't exist is created when there are servers to add
+func (req *request) updateServersDynamoDB(backendName string, add types.Backend, remove []string) error {
+	if req.util.WriteStrategy == WriteStrategyPath && !req.dryRun() {
+		if len(add.Servers) > 0 {
+			if err := req.addServersDynamoDB(backendName, add); err != nil {
+				return errors.Wrap(err, "addServersDynamoDB()")
+			}
+		}
+		for _, addr := range remove {
+			if err := req.removeServerWithPath(backendName, addr); err != nil {
+				return errors.Wrap(err, "removeServerWithPath("+addr+")")
+			}
+		}
+		return nil
 	}
-	return err
+	return req.util.retry.do(isVersionConflict, func() error {
+		backend, err := req.getBackendItem(backendName)
+		if errors.Is(err, ErrItemNotFound) && len(add.Servers) > 0 {
+			req.debug("backend not found: " + backendName)
+			return req.createBackendDynamoDB(backendName, req.createBackendItem(backendName, add))
+		}
+		if err != nil {
+			return errors.Wrap(err, "getBackendItem("+backendName+")")
+		}
+		updated := backend
+		updated.Backend.Servers = make(map[string]types.Server)
+		for addr, server := range backend.Backend.Servers {
+			updated.Backend.Servers[addr] = server
+		}
+		for addr, server := range add.Servers {
+			updated.Backend.Servers[addr] = server
+		}
+		for _, addr := range remove {
+			delete(updated.Backend.Servers, addr)
+		}
+		if req.dryRun() {
+			req.planBackendUpdate(backend, updated)
+			return nil
+		}
+		if err := req.updateBackendWithLock(updated); err != nil {
+			return errors.Wrap(err, "updateBackendWithLock()")
+		}
+		return nil
+	})
 }
 
 // CreateBackendDynamoDB creates a backend item in dynamodb
 func (req *request) createBackendDynamoDB(name string, backend BackendItem) error {
+	if req.dryRun() {
+		add, _ := serverChanges(types.Backend{}, backend.Backend)
+		req.planMutation(Mutation{ID: backend.ID, Action: MutationCreate, Add: add, Version: backend.Version})
+		return nil
+	}
 	req.debug("creating backend in dynamodb: " + name)
 	backendItem, err := dynamodbattribute.MarshalMap(backend)
 	if err != nil {
@@ -173,13 +323,267 @@ func (req *request) createBackendDynamoDB(name string, backend BackendItem) erro
 	}
 	params := &dynamodb.PutItemInput{
 		Item:      backendItem,
-		TableName: aws.String(util.TraefikTable),
+		TableName: aws.String(req.util.TraefikTable),
 	}
-	_, err = util.DynamoDB.PutItem(params)
+	_, err = req.util.DynamoDB.PutItemWithContext(req.ctx, params)
 	if err != nil {
 		req.debug("error putting item in dynamodb: " + name)
-		return errors.Wrap(err, "dynamodb.PutItem()")
+		return errors.Wrap(classify(err), "dynamodb.PutItem()")
 	}
 	req.debug("successfully created backend in dynamodb: " + name)
 	return nil
 }
+
+// deleteItem deletes an item from the traefik table
+func (req *request) deleteItem(id string) error {
+	if req.dryRun() {
+		req.planMutation(Mutation{ID: id, Action: MutationDelete})
+		return nil
+	}
+	params := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+		TableName: aws.String(req.util.TraefikTable),
+	}
+	_, err := req.util.DynamoDB.DeleteItemWithContext(req.ctx, params)
+	if err != nil {
+		req.debug("error deleting item from dynamodb: " + id)
+		return errors.Wrap(classify(err), "dynamodb.DeleteItem()")
+	}
+	return nil
+}
+
+// renameFrontendBackends points every frontend that uses the backend named from at to
+func (req *request) renameFrontendBackends(from, to string) error {
+	frontends := make([]FrontendItem, 0)
+	params := &dynamodb.ScanInput{
+		TableName:        aws.String(req.util.TraefikTable),
+		FilterExpression: aws.String("#f.#b = :b"),
+		ExpressionAttributeNames: map[string]*string{
+			"#f": aws.String("frontend"),
+			"#b": aws.String("backend"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":b": {S: aws.String(from)},
+		},
+	}
+	var err error
+	scanErr := req.util.DynamoDB.ScanPagesWithContext(req.ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			frontend := FrontendItem{}
+			if err = dynamodbattribute.UnmarshalMap(item, &frontend); err != nil {
+				return false
+			}
+			if frontend.Frontend.Backend == from {
+				frontends = append(frontends, frontend)
+			}
+		}
+		return !lastPage
+	})
+	if scanErr != nil {
+		req.debug("error scanning for frontends of " + from)
+		return errors.Wrap(classify(scanErr), "dynamodb.ScanPages()")
+	}
+	if err != nil {
+		return errors.Wrap(err, "dynamodbattribute.UnmarshalMap()")
+	}
+
+	for _, frontend := range frontends {
+		version := strconv.FormatUint(frontend.Version, 10)
+		frontend.Frontend.Backend = to
+		frontend.Version++
+		if req.dryRun() {
+			req.planMutation(Mutation{ID: frontend.ID, Action: MutationUpdate, Version: frontend.Version})
+			continue
+		}
+		item, err := dynamodbattribute.MarshalMap(frontend)
+		if err != nil {
+			return errors.Wrap(err, "dynamodbattribute.MarshalMap()")
+		}
+		params := &dynamodb.PutItemInput{
+			Item:                item,
+			TableName:           aws.String(req.util.TraefikTable),
+			ConditionExpression: aws.String("#v = :v"),
+			ExpressionAttributeNames: map[string]*string{
+				"#v": aws.String("version"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":v": {N: aws.String(version)},
+			},
+		}
+		if _, err := req.util.DynamoDB.PutItemWithContext(req.ctx, params); err != nil {
+			req.debug("error updating frontend: " + frontend.Name)
+			return errors.Wrap(classify(err), "dynamodb.PutItem("+frontend.ID+")")
+		}
+		req.log("pointed frontend " + frontend.Name + " at " + to)
+	}
+	return nil
+}
+
+// putBackendItemWithLock replaces prev, a backend item as it was read, with
+// backendItem as long as nothing else has updated it since. The version is incremented
+func (req *request) putBackendItemWithLock(prev, backendItem BackendItem) error {
+	if req.dryRun() {
+		req.planBackendUpdate(prev, backendItem)
+		return nil
+	}
+	version := strconv.FormatUint(backendItem.Version, 10)
+	backendItem.Version++
+	item, err := dynamodbattribute.MarshalMap(backendItem)
+	if err != nil {
+		return errors.Wrap(err, "dynamodbattribute.MarshalMap()")
+	}
+	params := &dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(req.util.TraefikTable),
+		ConditionExpression: aws.String("#v = :v"),
+		ExpressionAttributeNames: map[string]*string{
+			"#v": aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": {N: aws.String(version)},
+		},
+	}
+	if _, err := req.util.DynamoDB.PutItemWithContext(req.ctx, params); err != nil {
+		req.debug("error putting backend: " + backendItem.ID)
+		return errors.Wrap(classify(err), "dynamodb.PutItem()")
+	}
+	return nil
+}
+
+// setOrphanedAt stores the unix time pruning found a backend orphaned, or
+// clears it when orphanedAt is zero, as long as nothing else has updated the
+// backend since it was read. The version is left alone because the servers
+// don't change and traefik reloads the backends on every new version
+func (req *request) setOrphanedAt(backendItem BackendItem, orphanedAt int64) error {
+	if req.dryRun() {
+		return nil
+	}
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(backendItem.ID)},
+		},
+		TableName:           aws.String(req.util.TraefikTable),
+		UpdateExpression:    aws.String("REMOVE #oa"),
+		ConditionExpression: aws.String("#v = :v"),
+		ExpressionAttributeNames: map[string]*string{
+			"#oa": aws.String("orphanedAt"),
+			"#v":  aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": {N: aws.String(strconv.FormatUint(backendItem.Version, 10))},
+		},
+	}
+	if orphanedAt != 0 {
+		params.UpdateExpression = aws.String("SET #oa = :oa")
+		params.ExpressionAttributeValues[":oa"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(orphanedAt, 10))}
+	}
+	if _, err := req.util.DynamoDB.UpdateItemWithContext(req.ctx, params); err != nil {
+		req.debug("error setting orphanedAt of backend: " + backendItem.ID)
+		return errors.Wrap(classify(err), "dynamodb.UpdateItem()")
+	}
+	return nil
+}
+
+// deleteBackendItemWithLock deletes a backend item as long as nothing else has
+// updated it since it was read
+func (req *request) deleteBackendItemWithLock(backendItem BackendItem) error {
+	if req.dryRun() {
+		_, remove := serverChanges(backendItem.Backend, types.Backend{})
+		req.planMutation(Mutation{ID: backendItem.ID, Action: MutationDelete, Remove: remove, Version: backendItem.Version})
+		return nil
+	}
+	params := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(backendItem.ID)},
+		},
+		TableName:           aws.String(req.util.TraefikTable),
+		ConditionExpression: aws.String("#v = :v"),
+		ExpressionAttributeNames: map[string]*string{
+			"#v": aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": {N: aws.String(strconv.FormatUint(backendItem.Version, 10))},
+		},
+	}
+	if _, err := req.util.DynamoDB.DeleteItemWithContext(req.ctx, params); err != nil {
+		req.debug("error deleting backend: " + backendItem.ID)
+		return errors.Wrap(classify(err), "dynamodb.DeleteItem()")
+	}
+	return nil
+}
+
+// getOwnedBackendItems gets every backend item in the table this tracker owns
+func (req *request) getOwnedBackendItems() ([]BackendItem, error) {
+	backends := make([]BackendItem, 0)
+	params := &dynamodb.ScanInput{
+		TableName:        aws.String(req.util.TraefikTable),
+		FilterExpression: aws.String("#o = :o AND attribute_exists(#b)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#o": aws.String("owner"),
+			"#b": aws.String("backend"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":o": {S: aws.String(req.util.Owner)},
+		},
+	}
+	var err error
+	scanErr := req.util.DynamoDB.ScanPagesWithContext(req.ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if _, isBackend := item["backend"]; !isBackend {
+				continue
+			}
+			backend := BackendItem{}
+			if err = dynamodbattribute.UnmarshalMap(item, &backend); err != nil {
+				return false
+			}
+			if backend.Owner == req.util.Owner {
+				backends = append(backends, backend)
+			}
+		}
+		return !lastPage
+	})
+	if scanErr != nil {
+		req.debug("error scanning for owned backends")
+		return nil, errors.Wrap(classify(scanErr), "dynamodb.ScanPages()")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dynamodbattribute.UnmarshalMap()")
+	}
+	return backends, nil
+}
+
+// getBackendItems gets every backend item in the table
+func (req *request) getBackendItems() ([]BackendItem, error) {
+	backends := make([]BackendItem, 0)
+	params := &dynamodb.ScanInput{
+		TableName:        aws.String(req.util.TraefikTable),
+		FilterExpression: aws.String("attribute_exists(#b)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#b": aws.String("backend"),
+		},
+	}
+	var err error
+	scanErr := req.util.DynamoDB.ScanPagesWithContext(req.ctx, params, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if _, isBackend := item["backend"]; !isBackend {
+				continue
+			}
+			backend := BackendItem{}
+			if err = dynamodbattribute.UnmarshalMap(item, &backend); err != nil {
+				return false
+			}
+			backends = append(backends, backend)
+		}
+		return !lastPage
+	})
+	if scanErr != nil {
+		req.debug("error scanning for backends")
+		return nil, errors.Wrap(classify(scanErr), "dynamodb.ScanPages()")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dynamodbattribute.UnmarshalMap()")
+	}
+	return backends, nil
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func TestPathWriteStrategy(t *testing.T) {
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withUtil(func(u *Util) {
+		u.DynamoDB, u.WriteStrategy = table, WriteStrategyPath
+	})()
+	req := newRequest("TestPathWriteStrategy")
+	backend := func() BackendItem {
+		item := BackendItem{}
+		if err := dynamodbattribute.UnmarshalMap(table.Items["paths__backend"], &item); err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+
+	// a backend that doesn't exist yet is written whole
+	if err := req.addServersDynamoDB("paths", req.createBackend([]string{"10.9.0.1:80"})); err != nil {
+		t.Fatal(err)
+	}
+	created := backend()
+	if err := req.addServersDynamoDB("paths", req.createBackend([]string{"10.9.0.2:80"})); err != nil {
+		t.Fatal(err)
+	}
+	added := backend()
+	if len(added.Backend.Servers) != 2 || added.Version != created.Version+1 {
+		t.Errorf("expected two servers at v%d, got %v at v%d", created.Version+1, added.Backend.Servers, added.Version)
+	}
+
+	if err := req.removeServerFromBackendDynamoDB("paths", "10.9.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	removed := backend()
+	if _, ok := removed.Backend.Servers["10.9.0.1:80"]; ok || removed.Version != added.Version+1 {
+		t.Errorf("expected 10.9.0.1:80 removed at v%d, got %v at v%d", added.Version+1, removed.Backend.Servers, removed.Version)
+	}
+
+	// removing a server that is already gone changes nothing
+	if err := req.removeServerFromBackendDynamoDB("paths", "10.9.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	if backend().Version != removed.Version {
+		t.Error("removing a missing server bumped the version")
+	}
+}
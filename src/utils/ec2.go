@@ -11,29 +11,30 @@ var instancePrivateIPs map[string]string
 // GetInstancePrivateIP gets the private ip
 func (req *request) getInstancePrivateIP(instanceID string) (string, error) {
 	// check to see if we already have it
-	util.Mutex.Lock()
-	if address, exists := instancePrivateIPs[instanceID]; exists {
-		util.Mutex.Unlock()
+	req.util.Mutex.Lock()
+	address, exists := instancePrivateIPs[instanceID]
+	req.util.Mutex.Unlock()
+	req.cacheLookup("instance_ips", exists)
+	if exists {
 		return address, nil
 	}
-	util.Mutex.Unlock()
 
 	params := &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{
 			aws.String(instanceID),
 		},
 	}
-	resp, err := util.EC2.DescribeInstances(params)
+	resp, err := req.cluster.EC2.DescribeInstancesWithContext(req.ctx, params)
 	if err != nil {
-		return "", errors.Wrap(err, "ec2.DescribeInstances()")
+		return "", errors.Wrap(classify(err), "ec2.DescribeInstances()")
 	}
 	if len(resp.Reservations) < 1 || len(resp.Reservations[0].Instances) < 1 {
 		return "", errors.New("not instances found")
 	}
 	// save for later
 	req.debug("saving instance and ip: " + instanceID + " " + *resp.Reservations[0].Instances[0].PrivateIpAddress)
-	util.Mutex.Lock()
+	req.util.Mutex.Lock()
 	instancePrivateIPs[instanceID] = *resp.Reservations[0].Instances[0].PrivateIpAddress
-	util.Mutex.Unlock()
+	req.util.Mutex.Unlock()
 	return *resp.Reservations[0].Instances[0].PrivateIpAddress, nil
 }
@@ -12,6 +12,10 @@ import (
 
 var arnToInstanceIDs map[string]*string
 
+// containerLabels holds the docker labels of each container of a task definition
+// task definitions never change so they never have to be looked up twice
+var containerLabels map[string]map[string]map[string]*string
+
 func (req *request) getInstanceIDs(containerInstanceARNS []*string) ([]*string, error) {
 	// list to return
 	instanceIDs := make([]*string, 0)
@@ -20,25 +24,27 @@ func (req *request) getInstanceIDs(containerInstanceARNS []*string) ([]*string,
 	// add arns that aren't already stored in memory to list of arns to send to api
 	// or get instanceID from memory and add to list of instanceIDs
 	for _, arn := range containerInstanceARNS {
-		util.Mutex.Lock()
-		if id, exists := arnToInstanceIDs[*arn]; exists {
+		req.util.Mutex.Lock()
+		id, exists := arnToInstanceIDs[*arn]
+		req.util.Mutex.Unlock()
+		req.cacheLookup("instance_ids", exists)
+		if exists {
 			instanceIDs = append(instanceIDs, id)
 		} else {
 			paramsArns = append(paramsArns, arn)
 		}
-		util.Mutex.Unlock()
 	}
 	if len(paramsArns) < 1 {
 		return instanceIDs, nil
 	}
 	params := &ecs.DescribeContainerInstancesInput{
 		ContainerInstances: paramsArns,
-		Cluster:            aws.String(util.ECSCluster),
+		Cluster:            aws.String(req.cluster.Name),
 	}
-	resp, err := util.ECS.DescribeContainerInstances(params)
+	resp, err := req.cluster.ECS.DescribeContainerInstancesWithContext(req.ctx, params)
 	if err != nil {
 		req.debug("error getting instance ids")
-		return instanceIDs, errors.Wrap(err, "ecs.DescribeContainerInstances()")
+		return instanceIDs, errors.Wrap(classify(err), "ecs.DescribeContainerInstances()")
 	}
 	for _, instance := range resp.ContainerInstances {
 		instanceIDs = append(instanceIDs, instance.Ec2InstanceId)
@@ -46,9 +52,9 @@ func (req *request) getInstanceIDs(containerInstanceARNS []*string) ([]*string,
 		for i := range containerInstanceARNS {
 			if *containerInstanceARNS[i] == *instance.ContainerInstanceArn {
 				req.debug("saving instanceID: " + *instance.Ec2InstanceId)
-				util.Mutex.Lock()
+				req.util.Mutex.Lock()
 				arnToInstanceIDs[*containerInstanceARNS[i]] = instance.Ec2InstanceId
-				util.Mutex.Unlock()
+				req.util.Mutex.Unlock()
 				break
 			}
 		}
@@ -67,21 +73,23 @@ func (req *request) getInstanceID(ctrInstanceArn string) (*string, error) {
 func (req *request) listServices() ([]string, error) {
 	services := make([]*string, 0)
 	params := &ecs.ListServicesInput{
-		Cluster: aws.String(util.ECSCluster),
+		Cluster: aws.String(req.cluster.Name),
 	}
-	err := util.ECS.ListServicesPages(params,
+	err := req.cluster.ECS.ListServicesPagesWithContext(req.ctx, params,
 		func(page *ecs.ListServicesOutput, lastPage bool) bool {
 			services = append(services, page.ServiceArns...)
 			return !lastPage
 		})
 	if err != nil {
 		req.debug("error listing services")
-		return []string{}, errors.Wrap(err, "ecs.ListServicesPages()")
+		return []string{}, errors.Wrap(classify(err), "ecs.ListServicesPages()")
 	}
 
-	serviceNames := make([]string, len(services))
-	for i := range serviceNames {
-		serviceNames[i] = strings.Split(*services[i], "/")[1]
+	serviceNames := make([]string, 0, len(services))
+	for i := range services {
+		// arn:aws:ecs:region:account:service/[cluster/]name
+		parts := strings.Split(*services[i], "/")
+		serviceNames = append(serviceNames, parts[len(parts)-1])
 	}
 	req.debug(strconv.Itoa(len(serviceNames)) + " services listed")
 	return serviceNames, nil
@@ -90,16 +98,16 @@ func (req *request) listServices() ([]string, error) {
 func (req *request) getTaskArns(service string) ([]*string, error) {
 	taskArns := make([]*string, 0)
 	params := &ecs.ListTasksInput{
-		Cluster: aws.String(util.ECSCluster),
+		Cluster: aws.String(req.cluster.Name),
 	}
 	if service != "" {
 		params.ServiceName = aws.String(service)
 	}
-	err := util.ECS.ListTasksPages(params, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+	err := req.cluster.ECS.ListTasksPagesWithContext(req.ctx, params, func(page *ecs.ListTasksOutput, lastPage bool) bool {
 		taskArns = append(taskArns, page.TaskArns...)
 		return lastPage
 	})
-	return taskArns, err
+	return taskArns, classify(err)
 }
 
 func (req *request) getTasks(arns []*string) ([]*ecs.Task, error) {
@@ -109,54 +117,176 @@ func (req *request) getTasks(arns []*string) ([]*ecs.Task, error) {
 
 	params := &ecs.DescribeTasksInput{
 		Tasks:   arns,
-		Cluster: aws.String(util.ECSCluster),
+		Cluster: aws.String(req.cluster.Name),
 	}
-	resp, err := util.ECS.DescribeTasks(params)
+	resp, err := req.cluster.ECS.DescribeTasksWithContext(req.ctx, params)
 	if err != nil {
 		req.debug("error getting tasks: " + err.Error())
-		return []*ecs.Task{}, err
+		return []*ecs.Task{}, classify(err)
 	}
 	return resp.Tasks, nil
 }
 
-func (req *request) getAddressOfTasks(tasks []*ecs.Task) []string {
-	addresses := make([]string, 0)
+// taskAddress is the network location of a single task
+type taskAddress struct {
+	TaskArn           string
+	TaskDefinitionArn string
+	IP                string
+	Port              int64
+}
+
+// String returns the address in the form ip:port
+func (t taskAddress) String() string {
+	return t.IP + ":" + strconv.FormatInt(t.Port, 10)
+}
+
+// getTaskAddresses gets the addresses of the tasks that have a host port.
+// Failing to look up the port or ip of a task is an error so a backend is
+// never written without its server
+func (req *request) getTaskAddresses(tasks []*ecs.Task) ([]taskAddress, error) {
+	addresses := make([]taskAddress, 0)
 	for _, task := range tasks {
-		port := ""
-		// we assume only one container and one networkbinding...
-		if len(task.Containers) > 0 && len(task.Containers[0].NetworkBindings) > 0 {
-			port = strconv.FormatInt(*task.Containers[0].NetworkBindings[0].HostPort, 10)
-		}
 		// skip entirely if no hostPort is mapped
-		if port == "" {
+		if len(task.Containers) < 1 {
 			continue
 		}
-		ip, err := req.getIP(*task.ContainerInstanceArn)
+		port, err := req.hostPort(aws.StringValue(task.TaskDefinitionArn), containersOfTask(task))
 		if err != nil {
-			req.debug("error getting ip: " + err.Error())
+			return nil, errors.Wrap(err, "hostPort("+aws.StringValue(task.TaskArn)+")")
+		}
+		if port == 0 {
 			continue
 		}
-		addresses = append(addresses, ip+":"+port)
+		ip, err := req.getIP(*task.ContainerInstanceArn)
+		if err != nil {
+			return nil, errors.Wrap(err, "getIP("+aws.StringValue(task.ContainerInstanceArn)+")")
+		}
+		addresses = append(addresses, taskAddress{
+			TaskArn:           aws.StringValue(task.TaskArn),
+			TaskDefinitionArn: aws.StringValue(task.TaskDefinitionArn),
+			IP:                ip,
+			Port:              int64(port),
+		})
+	}
+	return addresses, nil
+}
+
+// containersOfTask converts the containers of a task to the containers found in events
+func containersOfTask(task *ecs.Task) []Container {
+	containers := make([]Container, len(task.Containers))
+	for i, container := range task.Containers {
+		containers[i] = Container{
+			ContainerArn:    aws.StringValue(container.ContainerArn),
+			LastStatus:      aws.StringValue(container.LastStatus),
+			Name:            aws.StringValue(container.Name),
+			NetworkBindings: make([]NetworkBinding, len(container.NetworkBindings)),
+		}
+		for j, binding := range container.NetworkBindings {
+			containers[i].NetworkBindings[j] = NetworkBinding{
+				ContainerPort: int(aws.Int64Value(binding.ContainerPort)),
+				HostPort:      int(aws.Int64Value(binding.HostPort)),
+			}
+		}
 	}
-	return addresses
+	return containers
 }
 
-func (req *request) getBackendECS(service string) (types.Backend, error) {
-	var backend types.Backend
+// getContainerLabels gets the docker labels of each container in a task definition
+func (req *request) getContainerLabels(taskDefinitionArn string) (map[string]map[string]*string, error) {
+	req.util.Mutex.Lock()
+	labels, exists := containerLabels[taskDefinitionArn]
+	req.util.Mutex.Unlock()
+	req.cacheLookup("container_labels", exists)
+	if exists {
+		return labels, nil
+	}
+
+	params := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinitionArn),
+	}
+	resp, err := req.cluster.ECS.DescribeTaskDefinitionWithContext(req.ctx, params)
+	if err != nil {
+		req.debug("error describing task definition: " + taskDefinitionArn)
+		return nil, errors.Wrap(classify(err), "ecs.DescribeTaskDefinition()")
+	}
+	labels = make(map[string]map[string]*string)
+	for _, definition := range resp.TaskDefinition.ContainerDefinitions {
+		labels[aws.StringValue(definition.Name)] = definition.DockerLabels
+	}
+
+	req.util.Mutex.Lock()
+	containerLabels[taskDefinitionArn] = labels
+	req.util.Mutex.Unlock()
+	return labels, nil
+}
+
+// hostPort finds the host port traffic should be sent to. When a port label is
+// configured and a container has it, the binding of that container for the
+// labelled container port is used. Otherwise the first binding of the first
+// container is used. Returns 0 if there is no such binding
+func (req *request) hostPort(taskDefinitionArn string, containers []Container) (int, error) {
+	if req.util.PortLabel != "" && taskDefinitionArn != "" {
+		labels, err := req.getContainerLabels(taskDefinitionArn)
+		if err != nil {
+			return 0, errors.Wrap(err, "getContainerLabels("+taskDefinitionArn+")")
+		}
+		for _, container := range containers {
+			value := labels[container.Name][req.util.PortLabel]
+			if value == nil {
+				continue
+			}
+			containerPort, err := strconv.Atoi(*value)
+			if err != nil {
+				return 0, errors.Wrap(err, "label "+req.util.PortLabel+" of "+container.Name+" is not a port")
+			}
+			for _, binding := range container.NetworkBindings {
+				if binding.ContainerPort == containerPort {
+					return binding.HostPort, nil
+				}
+			}
+			return 0, nil
+		}
+	}
+
+	// we assume only one container and one networkbinding...
+	if len(containers) < 1 || len(containers[0].NetworkBindings) < 1 {
+		return 0, nil
+	}
+	return containers[0].NetworkBindings[0].HostPort, nil
+}
+
+// getTaskAddressesECS gets the address of every task in a service
+func (req *request) getTaskAddressesECS(service string) ([]taskAddress, error) {
 	taskArns, err := req.getTaskArns(service)
 	if err != nil {
 		req.debug("error listing tasks: " + err.Error())
-		return backend, errors.Wrap(err, "getTaskArns()")
+		return nil, errors.Wrap(err, "getTaskArns()")
 	}
 	tasks, err := req.getTasks(taskArns)
 	if err != nil {
 		req.debug("error getting tasks: " + err.Error())
-		return backend, errors.Wrap(err, "getTasks()")
+		return nil, errors.Wrap(err, "getTasks()")
+	}
+	addresses, err := req.getTaskAddresses(tasks)
+	if err != nil {
+		return nil, errors.Wrap(err, "getTaskAddresses()")
+	}
+	if len(tasks) > 0 && len(addresses) == 0 {
+		return nil, errors.Wrap(ErrNoNetworkBindings, service)
+	}
+	return addresses, nil
+}
+
+func (req *request) getBackendECS(service string) (types.Backend, error) {
+	var backend types.Backend
+	taskAddresses, err := req.getTaskAddressesECS(service)
+	// a service without network bindings has nothing to put in a backend
+	if err != nil && !errors.Is(err, ErrNoNetworkBindings) {
+		return backend, errors.Wrap(err, "getTaskAddressesECS()")
 	}
-	addresses := req.getAddressOfTasks(tasks)
-	backend = req.createBackend(addresses)
+	backend = req.createBackendFromTasks(taskAddresses)
 
-	if len(addresses) < 1 {
+	if len(taskAddresses) < 1 {
 		req.debug(service + " has no network attached")
 	}
 
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestHostPortLabel(t *testing.T) {
+	ecsM.TaskDefinitions = map[string]*ecs.TaskDefinition{
+		"web:1": {
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("sidecar")},
+				{Name: aws.String("app"), DockerLabels: map[string]*string{"traefik.port": aws.String("8080")}},
+			},
+		},
+	}
+	defer withUtil(func(u *Util) { u.PortLabel = "traefik.port" })()
+
+	req := newRequest("TestHostPortLabel")
+	req = req.forCluster(req.util.Clusters[0])
+	containers := []Container{
+		{Name: "sidecar", NetworkBindings: []NetworkBinding{{ContainerPort: 9000, HostPort: 32001}}},
+		{Name: "app", NetworkBindings: []NetworkBinding{
+			{ContainerPort: 9090, HostPort: 32002},
+			{ContainerPort: 8080, HostPort: 32003},
+		}},
+	}
+	port, err := req.hostPort("web:1", containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 32003 {
+		t.Errorf("expected the host port of the labelled container port, got %d", port)
+	}
+
+	// without the label the first binding of the first container is used
+	req.util.PortLabel = ""
+	port, err = req.hostPort("web:1", containers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 32001 {
+		t.Errorf("expected the first binding, got %d", port)
+	}
+}
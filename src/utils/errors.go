@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/pkg/errors"
+)
+
+// Errors callers can check for with errors.Is however deeply they are wrapped
+var (
+	// ErrItemNotFound is returned when an item isn't found in the database or a service isn't found in ecs
+	ErrItemNotFound = errors.New("ItemNotFound")
+	// ErrNoNetworkBindings is returned when none of the tasks of a service have a host port
+	ErrNoNetworkBindings = errors.New("NoNetworkBindings")
+	// ErrVersionConflict is returned when an item changed since it was read
+	ErrVersionConflict = errors.New("VersionConflict")
+	// ErrThrottled is returned when aws is still throttling a call after it was retried
+	ErrThrottled = errors.New("Throttled")
+	// ErrInvalidEvent is returned when an sns notification or the ecs event in it can't be decoded
+	ErrInvalidEvent = errors.New("InvalidEvent")
+	// ErrUnknownCluster is returned when a cluster is not one of the configured clusters
+	ErrUnknownCluster = errors.New("UnknownCluster")
+	// ErrTableNotFound is returned when the traefik table doesn't exist
+	ErrTableNotFound = errors.New("TableNotFound")
+	// ErrInvalidTable is returned when the traefik table isn't keyed the way traefik expects
+	ErrInvalidTable = errors.New("InvalidTable")
+	// ErrEmptyBackendName is returned when the naming template gives a backend no name
+	ErrEmptyBackendName = errors.New("EmptyBackendName")
+	// ErrDuplicateEvent is returned when an event was handled before. It should be acknowledged
+	ErrDuplicateEvent = errors.New("DuplicateEvent")
+	// ErrQueueFull is returned when too many events of a service are waiting to be handled
+	ErrQueueFull = errors.New("QueueFull")
+	// ErrQueueStopped is returned when events are queued after the queue was drained
+	ErrQueueStopped = errors.New("QueueStopped")
+	// ErrDeadLettersDisabled is returned when dead letters are used without a file or table to keep them in
+	ErrDeadLettersDisabled = errors.New("DeadLettersDisabled")
+)
+
+// kindError marks an error from elsewhere, like the aws sdk, as one of the
+// errors above while keeping its message and cause
+type kindError struct {
+	kind error
+	err  error
+}
+
+// withKind marks err as kind
+func withKind(kind, err error) error {
+	return kindError{kind: kind, err: err}
+}
+
+func (e kindError) Error() string { return e.err.Error() }
+
+// Is matches the kind of the error
+func (e kindError) Is(target error) bool { return target == e.kind }
+
+// Unwrap and Cause return the marked error
+func (e kindError) Unwrap() error { return e.err }
+func (e kindError) Cause() error  { return e.err }
+
+// classify marks version conflicts, throttling, missing tables and missing cloud map instances in the error of an aws call so
+// they can be checked with errors.Is. Other errors are returned unchanged
+func classify(err error) error {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	switch {
+	case !ok:
+		return err
+	case aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException:
+		return withKind(ErrVersionConflict, err)
+	case aerr.Code() == dynamodb.ErrCodeResourceNotFoundException:
+		return withKind(ErrTableNotFound, err)
+	case aerr.Code() == servicediscovery.ErrCodeInstanceNotFound:
+		return withKind(ErrItemNotFound, err)
+	case isThrottle(aerr):
+		return withKind(ErrThrottled, err)
+	}
+	return err
+}
+
+// isVersionConflict checks whether an error is an optimistic locking condition failing
+func isVersionConflict(err error) bool {
+	return errors.Is(err, ErrVersionConflict)
+}
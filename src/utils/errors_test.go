@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/containous/traefik/types"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func TestHandleSNSInvalidEvent(t *testing.T) {
+	notification, _ := json.Marshal(&Notification{Message: "{not an event"})
+	for _, body := range [][]byte{[]byte("{not a notification"), notification} {
+		_, err := HandleSNS("TestInvalidEvent", ioutil.NopCloser(bytes.NewReader(body)), false)
+		if !errors.Is(err, ErrInvalidEvent) {
+			t.Errorf("expected an invalid event for %s, got %v", body, err)
+		}
+	}
+}
+
+func TestHandleSyncUnknownCluster(t *testing.T) {
+	_, err := HandleSync("nowhere", "api", false)
+	if !errors.Is(err, ErrUnknownCluster) {
+		t.Errorf("expected an unknown cluster, got %v", err)
+	}
+}
+
+func TestSyncNoNetworkBindings(t *testing.T) {
+	cluster := accountCluster("", "worker-instance-arn", "i-worker", "10.8.0.1")
+	ecsMock := cluster.ECS.(*utils_test.EcsMock)
+	ecsMock.AddService("worker")
+	ecsMock.AddTask(&ecs.Task{
+		ContainerInstanceArn: aws.String("worker-instance-arn"),
+		TaskArn:              aws.String("arn:aws:ecs:us-east-1:123456789012:task/worker1"),
+		Group:                aws.String("service:worker"),
+		Containers:           []*ecs.Container{{Name: aws.String("worker")}},
+	})
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer seedBackend(t, "worker", "10.8.0.1:8000")()
+
+	req := newRequest("TestSyncNoNetworkBindings").forCluster(cluster)
+	if err := req.sync("worker"); !errors.Is(err, ErrNoNetworkBindings) {
+		t.Errorf("expected no network bindings, got %v", err)
+	}
+	if servers := backendServers(t, "worker"); len(servers) != 0 {
+		t.Errorf("expected the servers of the unbound tasks to be removed, got %v", servers)
+	}
+	if err := req.syncAll(0); err != nil {
+		t.Errorf("expected services without network bindings to be skipped, got %v", err)
+	}
+}
+
+// seedBackend puts a backend with servers in the dynamodb mock until the returned func is called
+func seedBackend(t *testing.T, name string, servers ...string) func() {
+	backend := BackendItem{
+		EndItem: EndItem{ID: name + "__backend", Name: name},
+		Backend: types.Backend{Servers: make(map[string]types.Server)},
+	}
+	for _, addr := range servers {
+		backend.Backend.Servers[addr] = types.Server{URL: "http://" + addr}
+	}
+	item, err := dynamodbattribute.MarshalMap(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamodbM.Items[backend.ID] = item
+	return func() { delete(dynamodbM.Items, backend.ID) }
+}
+
+func TestSyncLookupFailure(t *testing.T) {
+	cluster := accountCluster("", "lookup-instance-arn", "i-lookup", "10.8.0.2")
+	ecsMock := cluster.ECS.(*utils_test.EcsMock)
+	ecsMock.AddTask(&ecs.Task{
+		ContainerInstanceArn: aws.String("lookup-instance-arn"),
+		TaskArn:              aws.String("arn:aws:ecs:us-east-1:123456789012:task/lookup1"),
+		Group:                aws.String("service:lookup"),
+		Containers:           []*ecs.Container{{NetworkBindings: []*ecs.NetworkBinding{{HostPort: aws.Int64(8000)}}}},
+	})
+	cluster.EC2.(*utils_test.Ec2Mock).ReturnError = true
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer seedBackend(t, "lookup", "10.8.0.2:8000")()
+	forgetInstances()
+	defer forgetInstances()
+
+	req := newRequest("TestSyncLookupFailure").forCluster(cluster)
+	if err := req.sync("lookup"); err == nil || errors.Is(err, ErrNoNetworkBindings) {
+		t.Errorf("expected the failed ip lookup to fail the sync, got %v", err)
+	}
+	if err := req.syncAll(0); err == nil {
+		t.Error("expected the failed ip lookup to fail syncing every service")
+	}
+	if _, ok := backendServers(t, "lookup")["10.8.0.2:8000"]; !ok {
+		t.Error("expected the backend to be left alone when a lookup fails")
+	}
+}
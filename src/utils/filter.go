@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+const (
+	// StatusInSync means dynamodb matches ecs
+	StatusInSync = "in sync"
+	// StatusOutOfSync means dynamodb does not match ecs
+	StatusOutOfSync = "out of sync"
+	// StatusIgnored means the service is excluded by the service filters
+	StatusIgnored = "ignored"
+)
+
+// serviceFilter decides which ecs services are tracked
+type serviceFilter struct {
+	include      []string
+	exclude      []string
+	includeRegex []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+	tags         map[string]string
+	tagCacheTTL  time.Duration
+}
+
+// serviceTags caches the tags of services by cluster/service
+var serviceTags map[string]cachedTags
+
+type cachedTags struct {
+	tags    map[string]string
+	fetched time.Time
+}
+
+// newServiceFilter compiles the service filters of a configuration
+// The configuration must already be validated
+func newServiceFilter(cfg config.Services) *serviceFilter {
+	filter := &serviceFilter{
+		include:     cfg.Include,
+		exclude:     cfg.Exclude,
+		tags:        cfg.Tags,
+		tagCacheTTL: time.Duration(cfg.TagCacheTTL),
+	}
+	for _, pattern := range cfg.IncludeRegex {
+		if re, err := regexp.Compile(pattern); err == nil {
+			filter.includeRegex = append(filter.includeRegex, re)
+		}
+	}
+	for _, pattern := range cfg.ExcludeRegex {
+		if re, err := regexp.Compile(pattern); err == nil {
+			filter.excludeRegex = append(filter.excludeRegex, re)
+		}
+	}
+	return filter
+}
+
+// matchesName checks whether a service name is tracked. A name is tracked if it
+// matches an include glob or regex, or there are none, and doesn't match any
+// exclude glob or regex
+func (f *serviceFilter) matchesName(service string) bool {
+	for _, pattern := range f.exclude {
+		if matched, _ := path.Match(pattern, service); matched {
+			return false
+		}
+	}
+	for _, re := range f.excludeRegex {
+		if re.MatchString(service) {
+			return false
+		}
+	}
+	if len(f.include) == 0 && len(f.includeRegex) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matched, _ := path.Match(pattern, service); matched {
+			return true
+		}
+	}
+	for _, re := range f.includeRegex {
+		if re.MatchString(service) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesTags checks whether a service has every required tag
+func (f *serviceFilter) matchesTags(tags map[string]string) bool {
+	for key, value := range f.tags {
+		if tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// included checks whether a service in the requests cluster is tracked according
+// to the service filters. Tags are only looked up when tags are required
+func (req *request) included(service string) (bool, error) {
+	filter := req.util.filter
+	if !filter.matchesName(service) {
+		return false, nil
+	}
+	if len(filter.tags) == 0 {
+		return true, nil
+	}
+	tags, err := req.getServiceTags(service)
+	if err != nil {
+		return false, errors.Wrap(err, "getServiceTags("+service+")")
+	}
+	return filter.matchesTags(tags), nil
+}
+
+// getServiceTags gets the tags of a service in the requests cluster
+func (req *request) getServiceTags(service string) (map[string]string, error) {
+	key := req.cluster.Name + "/" + service
+	req.util.Mutex.Lock()
+	cached, exists := serviceTags[key]
+	req.util.Mutex.Unlock()
+	fresh := exists && time.Since(cached.fetched) < req.util.filter.tagCacheTTL
+	req.cacheLookup("service_tags", fresh)
+	if fresh {
+		return cached.tags, nil
+	}
+	if err := req.loadServiceTags([]string{service}); err != nil {
+		return nil, err
+	}
+	req.util.Mutex.Lock()
+	cached = serviceTags[key]
+	req.util.Mutex.Unlock()
+	return cached.tags, nil
+}
+
+// loadServiceTags looks up the tags of services in the requests cluster ten at
+// a time, which is as many as ecs describes at once, and caches them
+func (req *request) loadServiceTags(services []string) error {
+	for start := 0; start < len(services); start += 10 {
+		end := start + 10
+		if end > len(services) {
+			end = len(services)
+		}
+		params := &ecs.DescribeServicesInput{
+			Cluster:  aws.String(req.cluster.Name),
+			Services: aws.StringSlice(services[start:end]),
+			Include:  []*string{aws.String(ecs.ServiceFieldTags)},
+		}
+		resp, err := req.cluster.ECS.DescribeServicesWithContext(req.ctx, params)
+		if err != nil {
+			req.debug("error describing services: " + err.Error())
+			return errors.Wrap(classify(err), "ecs.DescribeServices()")
+		}
+		now := time.Now()
+		req.util.Mutex.Lock()
+		// services that weren't found have no tags
+		for _, service := range services[start:end] {
+			serviceTags[req.cluster.Name+"/"+service] = cachedTags{fetched: now}
+		}
+		for _, service := range resp.Services {
+			tags := make(map[string]string)
+			for _, tag := range service.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			serviceTags[req.cluster.Name+"/"+aws.StringValue(service.ServiceName)] = cachedTags{tags: tags, fetched: now}
+		}
+		req.util.Mutex.Unlock()
+	}
+	return nil
+}
+
+// partitionServices splits services into the ones that are tracked and the ones
+// that are ignored according to the service filters
+func (req *request) partitionServices(services []string) ([]string, []string, error) {
+	tracked := make([]string, 0, len(services))
+	ignored := make([]string, 0)
+	if len(req.util.filter.tags) > 0 {
+		// look up the tags of everything at once rather than one service at a time
+		named := make([]string, 0, len(services))
+		for _, service := range services {
+			if req.util.filter.matchesName(service) {
+				named = append(named, service)
+			}
+		}
+		if err := req.loadServiceTags(named); err != nil {
+			return nil, nil, errors.Wrap(err, "loadServiceTags()")
+		}
+	}
+	for _, service := range services {
+		ok, err := req.included(service)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "included("+service+")")
+		}
+		if ok {
+			tracked = append(tracked, service)
+		} else {
+			ignored = append(ignored, service)
+		}
+	}
+	return tracked, ignored, nil
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+func withServiceFilter(services config.Services) func() {
+	return withUtil(func(u *Util) {
+		u.filter = newServiceFilter(services)
+	})
+}
+
+func TestServiceFilterNames(t *testing.T) {
+	filter := newServiceFilter(config.Services{
+		Include:      []string{"api-*"},
+		IncludeRegex: []string{"^web-(blue|green)$"},
+		Exclude:      []string{"*-canary"},
+		ExcludeRegex: []string{"-test$"},
+	})
+	cases := map[string]bool{
+		"api-orders":    true,
+		"api-canary":    false,
+		"api-load-test": false,
+		"web-blue":      true,
+		"web-red":       false,
+		"billing":       false,
+	}
+	for service, want := range cases {
+		if got := filter.matchesName(service); got != want {
+			t.Errorf("%s: got %v want %v", service, got, want)
+		}
+	}
+}
+
+func TestServiceFilterTags(t *testing.T) {
+	ecsM.AddService("tagged")
+	ecsM.AddService("untagged")
+	defer ecsM.RemoveService("tagged")
+	defer ecsM.RemoveService("untagged")
+	ecsM.ServiceTags = map[string]map[string]string{
+		"tagged": {"traefik": "enabled"},
+	}
+	defer func() { ecsM.ServiceTags = nil }()
+	defer withServiceFilter(config.Services{Tags: map[string]string{"traefik": "enabled"}})()
+
+	req := newRequest("TestServiceFilterTags").forCluster(current.Load().(*Util).Clusters[0])
+	tracked, ignored, err := req.partitionServices([]string{"tagged", "untagged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracked) != 1 || tracked[0] != "tagged" {
+		t.Errorf("expected only the tagged service to be tracked, got %v", tracked)
+	}
+	if len(ignored) != 1 || ignored[0] != "untagged" {
+		t.Errorf("expected the untagged service to be ignored, got %v", ignored)
+	}
+}
+
+func TestHandleDiffIgnored(t *testing.T) {
+	createEnv("myinstancearn", "hello", "myinstanceid", "10.0.0.4", 8090)
+	defer withServiceFilter(config.Services{Exclude: []string{"hel*"}})()
+
+	status, err := HandleDiff("", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != StatusIgnored {
+		t.Errorf("expected an excluded service to be %s, got %s", StatusIgnored, status)
+	}
+	outOfSync, ignored, err := HandleDiffAll("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range outOfSync {
+		if service == "hello" {
+			t.Error("excluded service was reported out of sync")
+		}
+	}
+	found := false
+	for _, service := range ignored {
+		found = found || service == "hello"
+	}
+	if !found {
+		t.Errorf("expected hello to be reported as ignored, got %v", ignored)
+	}
+}
@@ -0,0 +1,227 @@
+package utils
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+const (
+	// TaskPolicyIgnore skips standalone tasks no task group matches. See config.TaskPolicyIgnore
+	TaskPolicyIgnore = config.TaskPolicyIgnore
+	// TaskPolicyGroup tracks standalone tasks no task group matches. See config.TaskPolicyGroup
+	TaskPolicyGroup = config.TaskPolicyGroup
+)
+
+// groupService gets the service of a task group or an empty string if the
+// task isn't part of a service
+// service:api -> api
+func groupService(group string) string {
+	if !strings.HasPrefix(group, "service:") {
+		return ""
+	}
+	return strings.TrimPrefix(group, "service:")
+}
+
+// groupName is the name of a task group without the family: prefix ecs gives
+// tasks started without a group
+// family:batch -> batch
+func groupName(group string) string {
+	return strings.TrimPrefix(group, "family:")
+}
+
+// taskFamily gets the family of a task definition from its arn
+// arn:aws:ecs:us-east-1:123456789012:task-definition/batch:3 -> batch
+func taskFamily(taskDefinitionArn string) string {
+	parts := strings.Split(taskDefinitionArn, "/")
+	return strings.Split(parts[len(parts)-1], ":")[0]
+}
+
+// matchesTaskGroup checks whether a standalone task matches every field of a task group that is set
+func matchesTaskGroup(g config.TaskGroup, group, family, startedBy string) bool {
+	if g.Group != "" {
+		if matched, _ := path.Match(g.Group, group); !matched {
+			return false
+		}
+	}
+	if g.Family != "" && g.Family != family {
+		return false
+	}
+	if g.StartedBy != "" && g.StartedBy != startedBy {
+		return false
+	}
+	return true
+}
+
+// groupBackend gets the backend a standalone task belongs to before the name
+// policy is applied. Returns false if the task is ignored
+func (req *request) groupBackend(group, family, startedBy string) (string, bool) {
+	for _, g := range req.util.TaskGroups {
+		if matchesTaskGroup(g, group, family, startedBy) {
+			return g.Backend, true
+		}
+	}
+	if req.util.TaskPolicy == TaskPolicyGroup && groupName(group) != "" {
+		return groupName(group), true
+	}
+	return "", false
+}
+
+// eventBackendName gets the name of the backend the task of an event belongs
+// to. Returns false if the task isn't tracked
+func (req *request) eventBackendName(msg Detail) (string, bool, error) {
+	if service := groupService(msg.Group); service != "" {
+		tracked, err := req.included(service)
+		if err != nil {
+			return "", false, errors.Wrap(err, "included("+service+")")
+		}
+		if !tracked {
+			return "", false, nil
+		}
+		// the task definition of the task rather than the one the service runs
+		// now, so the tasks of a deploy that changes labels keep their backend
+		name, err := req.backendName(service, msg.TaskDefinitionArn)
+		if err != nil {
+			return "", false, errors.Wrap(err, "backendName("+service+")")
+		}
+		return name, true, nil
+	}
+	backend, tracked := req.groupBackend(msg.Group, taskFamily(msg.TaskDefinitionArn), msg.StartedBy)
+	if !tracked {
+		return "", false, nil
+	}
+	name, err := req.backendName(backend, msg.TaskDefinitionArn)
+	if err != nil {
+		return "", false, errors.Wrap(err, "backendName("+backend+")")
+	}
+	return name, true, nil
+}
+
+// getStandaloneTasks lists the tasks that could belong to a task group. Every
+// task is listed when unmatched groups are tracked, otherwise only the tasks
+// with the family or startedBy of a group are
+func (req *request) getStandaloneTasks() ([]*ecs.Task, error) {
+	inputs := make([]*ecs.ListTasksInput, 0)
+	if req.util.TaskPolicy == TaskPolicyGroup {
+		inputs = append(inputs, &ecs.ListTasksInput{})
+	} else {
+		for _, g := range req.util.TaskGroups {
+			input := &ecs.ListTasksInput{}
+			// ecs can only filter by one of these. the rest are matched afterwards
+			if g.Family != "" {
+				input.Family = aws.String(g.Family)
+			} else if g.StartedBy != "" {
+				input.StartedBy = aws.String(g.StartedBy)
+			}
+			inputs = append(inputs, input)
+		}
+	}
+
+	seen := make(map[string]bool)
+	taskArns := make([]*string, 0)
+	for _, params := range inputs {
+		params.Cluster = aws.String(req.cluster.Name)
+		err := req.cluster.ECS.ListTasksPagesWithContext(req.ctx, params, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+			for _, arn := range page.TaskArns {
+				if !seen[aws.StringValue(arn)] {
+					seen[aws.StringValue(arn)] = true
+					taskArns = append(taskArns, arn)
+				}
+			}
+			return !lastPage
+		})
+		if err != nil {
+			req.debug("error listing standalone tasks: " + err.Error())
+			return nil, errors.Wrap(classify(err), "ecs.ListTasksPages()")
+		}
+	}
+
+	tasks := make([]*ecs.Task, 0, len(taskArns))
+	// ecs describes at most 100 tasks at once
+	for start := 0; start < len(taskArns); start += 100 {
+		end := start + 100
+		if end > len(taskArns) {
+			end = len(taskArns)
+		}
+		described, err := req.getTasks(taskArns[start:end])
+		if err != nil {
+			return nil, errors.Wrap(err, "getTasks()")
+		}
+		tasks = append(tasks, described...)
+	}
+	return tasks, nil
+}
+
+// getGroupAddresses gets the addresses of the tasks of every tracked task group
+// by backend before the naming is applied. Configured groups without any
+// tasks are included so their backends get emptied
+func (req *request) getGroupAddresses() (map[string][]taskAddress, error) {
+	backends := make(map[string][]taskAddress)
+	for _, g := range req.util.TaskGroups {
+		backends[g.Backend] = make([]taskAddress, 0)
+	}
+	if len(req.util.TaskGroups) == 0 && req.util.TaskPolicy != TaskPolicyGroup {
+		return backends, nil
+	}
+
+	tasks, err := req.getStandaloneTasks()
+	if err != nil {
+		return nil, errors.Wrap(err, "getStandaloneTasks()")
+	}
+	for _, task := range tasks {
+		group := aws.StringValue(task.Group)
+		if groupService(group) != "" {
+			continue
+		}
+		backend, tracked := req.groupBackend(group, taskFamily(aws.StringValue(task.TaskDefinitionArn)), aws.StringValue(task.StartedBy))
+		if !tracked {
+			continue
+		}
+		addresses, err := req.getTaskAddresses([]*ecs.Task{task})
+		if err != nil {
+			return nil, errors.Wrap(err, "getTaskAddresses()")
+		}
+		backends[backend] = append(backends[backend], addresses...)
+	}
+	return backends, nil
+}
+
+// syncGroups syncs the backends of every tracked task group to dynamodb
+func (req *request) syncGroups() error {
+	backends, err := req.getGroupAddresses()
+	if err != nil {
+		return errors.Wrap(err, "getGroupAddresses()")
+	}
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		greq := req.withService(name)
+		greq.debug("syncing task group: " + name)
+		backendName, err := greq.groupBackendName(name, backends[name])
+		if err != nil {
+			return errors.Wrap(err, "groupBackendName("+name+")")
+		}
+		if err := greq.syncBackend(backendName, backends[name]); err != nil {
+			return errors.Wrap(err, "syncBackend("+name+")")
+		}
+	}
+	return nil
+}
+
+// groupBackendName is the name of the backend of a task group. Labels are read
+// from the task definition of its first task
+func (req *request) groupBackendName(backend string, addresses []taskAddress) (string, error) {
+	taskDefinitionArn := ""
+	if len(addresses) > 0 {
+		taskDefinitionArn = addresses[0].TaskDefinitionArn
+	}
+	return req.backendName(backend, taskDefinitionArn)
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func withTaskGroups(policy string, groups []config.TaskGroup) func() {
+	return withUtil(func(u *Util) {
+		u.TaskPolicy, u.TaskGroups = policy, groups
+	})
+}
+
+func TestGroupBackend(t *testing.T) {
+	groups := []config.TaskGroup{
+		{Backend: "reports", StartedBy: "events-rule/nightly"},
+		{Backend: "batch", Group: "family:batch-*"},
+		{Backend: "migrations", Family: "migrate", Group: "deploy"},
+	}
+	cases := []struct {
+		policy, group, family, startedBy string
+		want                             string
+		tracked                          bool
+	}{
+		{TaskPolicyIgnore, "family:report", "report", "events-rule/nightly", "reports", true},
+		{TaskPolicyIgnore, "family:batch-import", "batch-import", "", "batch", true},
+		{TaskPolicyIgnore, "deploy", "migrate", "", "migrations", true},
+		{TaskPolicyIgnore, "deploy", "other", "", "", false},
+		{TaskPolicyIgnore, "family:other", "other", "", "", false},
+		{TaskPolicyGroup, "family:other", "other", "", "other", true},
+		{TaskPolicyGroup, "custom", "other", "", "custom", true},
+	}
+	for _, c := range cases {
+		restore := withTaskGroups(c.policy, groups)
+		got, tracked := newRequest("TestGroupBackend").groupBackend(c.group, c.family, c.startedBy)
+		if got != c.want || tracked != c.tracked {
+			t.Errorf("%s with %s policy: got %q %v want %q %v", c.group, c.policy, got, tracked, c.want, c.tracked)
+		}
+		restore()
+	}
+}
+
+func TestTaskFamily(t *testing.T) {
+	if family := taskFamily("arn:aws:ecs:us-east-1:123456789012:task-definition/batch:3"); family != "batch" {
+		t.Errorf("expected batch, got %s", family)
+	}
+}
+
+func TestHandleSNSScheduledTask(t *testing.T) {
+	cluster := accountCluster("", "scheduled-instance-arn", "i-scheduled", "10.3.0.1")
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withTaskGroups(TaskPolicyIgnore, []config.TaskGroup{{Backend: "nightly", StartedBy: "events-rule/nightly"}})()
+
+	event := Event{
+		Detail: Detail{
+			ClusterArn:           "arn:aws:ecs:us-east-1:123456789012:cluster/web",
+			Group:                "family:report",
+			StartedBy:            "events-rule/nightly",
+			ContainerInstanceArn: "scheduled-instance-arn",
+			DesiredStatus:        Running,
+			LastStatus:           Running,
+			TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/nightly1",
+			TaskDefinitionArn:    "arn:aws:ecs:us-east-1:123456789012:task-definition/report:1",
+			Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 9100}}}},
+		},
+	}
+	if _, err := HandleSNS("TestScheduled::Add", ioutil.NopCloser(snsEventBody(event)), false); err != nil {
+		t.Fatal(err)
+	}
+	backend := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["nightly__backend"], &backend); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Backend.Servers["10.3.0.1:9100"]; !ok {
+		t.Errorf("expected the scheduled task in the nightly backend, got %v", backend.Backend.Servers)
+	}
+	if _, exists := dynamodbM.Items["report__backend"]; exists {
+		t.Error("scheduled task was registered under its family")
+	}
+}
+
+func TestSyncGroups(t *testing.T) {
+	cluster := accountCluster("", "batch-instance-arn", "i-batch", "10.4.0.1")
+	cluster.ECS.(*utils_test.EcsMock).AddTask(&ecs.Task{
+		ContainerInstanceArn: aws.String("batch-instance-arn"),
+		TaskArn:              aws.String("arn:aws:ecs:us-east-1:123456789012:task/batch1"),
+		TaskDefinitionArn:    aws.String("arn:aws:ecs:us-east-1:123456789012:task-definition/batch-import:7"),
+		Group:                aws.String("family:batch-import"),
+		Containers: []*ecs.Container{
+			{NetworkBindings: []*ecs.NetworkBinding{{HostPort: aws.Int64(9200)}}},
+		},
+	})
+	defer withClusters([]*Cluster{cluster}, NamePolicyCluster)()
+	defer withTaskGroups(TaskPolicyIgnore, []config.TaskGroup{
+		{Backend: "batch", Family: "batch-import"},
+		{Backend: "idle", Family: "idle"},
+	})()
+
+	req := newRequest("TestSyncGroups").forCluster(cluster)
+	if err := req.syncGroups(); err != nil {
+		t.Fatal(err)
+	}
+	backend := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["web-batch__backend"], &backend); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Backend.Servers["10.4.0.1:9200"]; !ok {
+		t.Errorf("expected the batch task in the batch backend, got %v", backend.Backend.Servers)
+	}
+	if _, exists := dynamodbM.Items["web-idle__backend"]; !exists {
+		t.Error("expected an empty backend for a group without tasks")
+	}
+}
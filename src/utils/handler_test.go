@@ -13,6 +13,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/containous/traefik/types"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
 	"github.com/tskinn/ecs-task-tracker/src/utils_test"
 )
 
@@ -36,19 +38,31 @@ func init() {
 		Items: make(map[string]map[string]*dynamodb.AttributeValue),
 	}
 
-	Init("test", "test", 1, dynamodbM, ec2M, ecsM, "")
+	cfg := config.Default()
+	cfg.Tables.Traefik = "test"
+	cfg.Retry.MaxTries = 1
+	Init(cfg, []*Cluster{{Name: "test"}}, nil, dynamodbM, ec2M, ecsM, nil)
+}
+
+// withUtil changes a copy of the current settings and returns a func that restores them
+func withUtil(change func(u *Util)) func() {
+	prev := current.Load().(*Util)
+	u := *prev
+	change(&u)
+	current.Store(&u)
+	return func() { current.Store(prev) }
 }
 
 func TestHandleDiffSame(t *testing.T) {
 	//	ecsM.AddService("hello")
 	createEnv("myinstancearn", "hello", "myinstanceid", "10.0.0.4", 8090)
-	good, err := HandleDiff("hello")
+	status, err := HandleDiff("", "hello")
 	if err != nil {
 		t.Log("there was an error")
 		t.Log(err)
 		t.Fail()
 	}
-	if !good {
+	if status != StatusInSync {
 		t.Log(dynamodbM.Items)
 		t.Log(ecsM.Tasks)
 		t.Log("dynamodb is not in sync with ecs")
@@ -61,7 +75,7 @@ func TestHandleDiffDifferent(t *testing.T) {
 }
 
 func TestHandleDiffAll(t *testing.T) {
-	notSynced, err := HandleDiffAll()
+	notSynced, _, err := HandleDiffAll("")
 	if err != nil {
 		t.Log("its not synced up yo")
 		t.Log(notSynced)
@@ -75,7 +89,7 @@ func TestHandleSNSNotificationRemoveBackend(t *testing.T) {
 
 	msg, _ := json.Marshal(&Event{
 		Detail: Detail{
-			Group:                "garbage:" + taskName,
+			Group:                "service:" + taskName,
 			ContainerInstanceArn: instanceArn,
 			DesiredStatus:        "STOPPED",
 			LastStatus:           "RUNNING",
@@ -89,7 +103,7 @@ func TestHandleSNSNotificationRemoveBackend(t *testing.T) {
 	}
 	notificationEncoded, _ := json.Marshal(notification)
 	body := ioutil.NopCloser(bytes.NewReader(notificationEncoded))
-	err := HandleSNS("TestNotification::Remove", body)
+	_, err := HandleSNS("TestNotification::Remove", body, false)
 	if err != nil {
 		t.Fail()
 	}
@@ -101,7 +115,7 @@ func TestHandleSNSNotificationAddBackend(t *testing.T) {
 	instanceArn, taskName, instanceID, instanceIP, hostPort = "myinstancearn", "secondtask", "instanceid", "10.0.0.4", 8999
 	msg, _ := json.Marshal(&Event{
 		Detail: Detail{
-			Group:                "garbage:" + taskName,
+			Group:                "service:" + taskName,
 			ContainerInstanceArn: instanceArn,
 			DesiredStatus:        "RUNNING",
 			LastStatus:           "RUNNING",
@@ -115,7 +129,7 @@ func TestHandleSNSNotificationAddBackend(t *testing.T) {
 	}
 	notificationEncoded, _ := json.Marshal(notification)
 	body := ioutil.NopCloser(bytes.NewReader(notificationEncoded))
-	err := HandleSNS("TestNotification::Add", body)
+	_, err := HandleSNS("TestNotification::Add", body, false)
 	if err != nil {
 		t.Log(err)
 		t.Fail()
@@ -126,7 +140,7 @@ func TestHandleSNSUnknownType(t *testing.T) {
 	notification := &Notification{}
 	notificationEncoded, _ := json.Marshal(notification)
 	body := ioutil.NopCloser(bytes.NewReader(notificationEncoded))
-	err := HandleSNS("somemessageid", body)
+	_, err := HandleSNS("somemessageid", body, false)
 	if err == nil { // should throw an error
 		t.Fail()
 	}
@@ -140,7 +154,7 @@ func TestHandleSyncOutOfSync(t *testing.T) {
 	ecsM.AddTask(&ecs.Task{
 		ContainerInstanceArn: aws.String(instanceArn),
 		TaskArn:              aws.String(taskName + "-arn2"),
-		Group:                aws.String("garbage:" + taskName),
+		Group:                aws.String("service:" + taskName),
 		Containers: []*ecs.Container{
 			{
 				NetworkBindings: []*ecs.NetworkBinding{
@@ -152,7 +166,7 @@ func TestHandleSyncOutOfSync(t *testing.T) {
 		},
 	})
 
-	err := HandleSync(taskName)
+	_, err := HandleSync("", taskName, false)
 	if err != nil {
 		t.Log("broked")
 		t.Fail()
@@ -163,7 +177,7 @@ func TestHandleSyncInSync(t *testing.T) {
 	instanceArn, taskName, instanceID, instanceIP, hostPort := "myinstancearn", "taskname", "instanceid", "10.0.0.4", 8080
 	createEnv(instanceArn, taskName, instanceID, instanceIP, hostPort)
 
-	err := HandleSync(taskName)
+	_, err := HandleSync("", taskName, false)
 	if err != nil {
 		t.Log("broked")
 		t.Fail()
@@ -179,9 +193,9 @@ func TestHandleSyncAll(t *testing.T) {
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {S: &taskName}},
 	}
-	dynamodbM.DeleteItem(params)
+	dynamodbM.DeleteItemWithContext(aws.BackgroundContext(), params)
 
-	err := HandleSyncAll()
+	_, err := HandleSyncAll("", false)
 	if err != nil {
 		t.Log("kdjosk")
 		t.Fail()
@@ -193,7 +207,7 @@ func createEnv(instanceArn, taskName, instanceID, instanceIP string, hostPort in
 	ecsM.AddTask(&ecs.Task{
 		ContainerInstanceArn: aws.String(instanceArn),
 		TaskArn:              aws.String(taskName + "-arn"),
-		Group:                aws.String("garbage:" + taskName),
+		Group:                aws.String("service:" + taskName),
 		Containers: []*ecs.Container{
 			{
 				NetworkBindings: []*ecs.NetworkBinding{
@@ -241,3 +255,81 @@ func createEnv(instanceArn, taskName, instanceID, instanceIP string, hostPort in
 	}
 	dynamodbM.PutBackend(item)
 }
+
+func TestReloadKeepsInFlightSettings(t *testing.T) {
+	prev := current.Load().(*Util)
+	defer current.Store(prev)
+
+	inFlight := newRequest("TestReload::InFlight")
+
+	cfg := config.Default()
+	cfg.Tables.Traefik = "reloaded"
+	cfg.Services.Exclude = []string{"*-worker"}
+	Reload(cfg, []*Cluster{{Name: "test"}}, nil)
+
+	if ok, _ := inFlight.included("billing-worker"); inFlight.util.TraefikTable != "test" || !ok {
+		t.Error("request in flight saw the reloaded settings")
+	}
+	next := newRequest("TestReload::Next")
+	if ok, _ := next.included("billing-worker"); next.util.TraefikTable != "reloaded" || ok {
+		t.Error("new request did not get the reloaded settings")
+	}
+	if next.util.DynamoDB != prev.DynamoDB || next.util.Mutex != prev.Mutex {
+		t.Error("reload did not keep the aws clients and lock")
+	}
+}
+
+func TestHandleBackends(t *testing.T) {
+	createEnv("backendsinstancearn", "backendstask", "backendsinstanceid", "10.0.0.15", 8500)
+	defer ecsM.RemoveTask("backendstask-arn")
+
+	backends, err := HandleBackends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for i, backend := range backends {
+		if i > 0 && backends[i-1].Name > backend.Name {
+			t.Errorf("expected the backends sorted by name, got %s before %s", backends[i-1].Name, backend.Name)
+		}
+		found = found || backend.Name == "backendstask"
+	}
+	if !found {
+		t.Error("expected the backendstask backend to be listed")
+	}
+
+	backend, err := HandleBackend("backendstask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend.ID != "backendstask__backend" || backend.Name != "backendstask" {
+		t.Errorf("unexpected backend item %+v", backend)
+	}
+	if _, ok := backend.Backend.Servers["10.0.0.15:8500"]; !ok {
+		t.Errorf("expected the server of the task, got %v", backend.Backend.Servers)
+	}
+	if _, err := HandleBackend("nosuchbackend"); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("expected ErrItemNotFound, got %v", err)
+	}
+}
+
+func TestHandleServers(t *testing.T) {
+	forgetInstances()
+	defer forgetInstances()
+	createEnv("serversinstancearn", "serverstask", "serversinstanceid", "10.0.0.16", 8600)
+	defer ecsM.RemoveTask("serverstask-arn")
+
+	servers, err := HandleServers("", "serverstask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		if server.TaskArn == "serverstask-arn" {
+			if server.Address != "10.0.0.16:8600" || server.Backend != "serverstask" || server.Cluster != "test" {
+				t.Errorf("unexpected server %+v", server)
+			}
+			return
+		}
+	}
+	t.Errorf("expected the task of the service, got %+v", servers)
+}
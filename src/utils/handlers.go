@@ -3,49 +3,83 @@ package utils
 import (
 	"encoding/json"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// HandleDiff diffs one service
-func HandleDiff(serviceName string) (bool, error) {
-	req := request{id: "DiffOne:::" + strconv.FormatInt(time.Now().Unix(), 10)}
-	synced, err := req.diff(serviceName)
+// HandleDiff diffs one service. If cluster is empty the service is diffed
+// in every tracked cluster it runs in. Returns StatusOutOfSync if it is out of
+// sync in any cluster, StatusIgnored if it is ignored in every cluster and
+// StatusInSync otherwise
+func HandleDiff(cluster, serviceName string) (string, error) {
+	req := newRequest("DiffOne:::" + strconv.FormatInt(time.Now().Unix(), 10))
+	clusters, err := req.serviceClusters(cluster, serviceName)
 	if err != nil {
-		req.log("error diffing service: " + serviceName + " : " + err.Error())
-		return false, err
+		req.withService(serviceName).error("error finding clusters for service: " + serviceName + " : " + err.Error())
+		return "", err
 	}
-	if !synced {
-		req.log(serviceName + " is not in sync")
-	} else {
-		req.log(serviceName + " is in sync")
+	status := StatusIgnored
+	for _, c := range clusters {
+		creq := req.forCluster(c).withService(serviceName)
+		cstatus, err := creq.diff(serviceName)
+		if err != nil {
+			creq.error("error diffing service: " + creq.qualifiedName(serviceName) + " : " + err.Error())
+			return "", err
+		}
+		creq.log(creq.qualifiedName(serviceName) + " is " + cstatus)
+		if cstatus == StatusOutOfSync || (cstatus == StatusInSync && status == StatusIgnored) {
+			status = cstatus
+		}
 	}
-	return synced, nil
+	return status, nil
 }
 
-// HandleDiffAll diffs all services in an ecs cluster
-func HandleDiffAll() ([]string, error) {
+// HandleDiffAll diffs all services in an ecs cluster. If cluster is empty
+// every tracked cluster is diffed. Returns the services that are out of sync
+// and the services that are ignored by the service filters
+func HandleDiffAll(cluster string) ([]string, []string, error) {
 	outOfSync := make([]string, 0)
-	req := request{id: "DiffAll:::" + strconv.FormatInt(time.Now().Unix(), 10)}
-	services, err := req.listServices()
+	ignored := make([]string, 0)
+	req := newRequest("DiffAll:::" + strconv.FormatInt(time.Now().Unix(), 10))
+	clusters, err := req.clustersFor(cluster)
 	if err != nil {
-		return outOfSync, errors.Wrap(err, "listServices()")
+		return outOfSync, ignored, err
 	}
 
-	for _, service := range services {
-		inSync, ierr := req.diff(service)
+	for _, c := range clusters {
+		creq := req.forCluster(c)
+		services, ierr := creq.listServices()
 		if ierr != nil {
-			if err == nil {
-				err = errors.New("")
-			}
-			err = errors.Wrap(ierr, "diff("+service+"): "+err.Error())
-			req.debug("error diffing service: " + service)
+			return outOfSync, ignored, errors.Wrap(ierr, "listServices("+c.Name+")")
+		}
+		services, ignoredServices, ierr := creq.partitionServices(services)
+		if ierr != nil {
+			return outOfSync, ignored, errors.Wrap(ierr, "partitionServices("+c.Name+")")
 		}
-		if !inSync {
-			outOfSync = append(outOfSync, service)
+		for _, service := range ignoredServices {
+			ignored = append(ignored, creq.qualifiedName(service))
+		}
+
+		for _, service := range services {
+			status, ierr := creq.withService(service).diff(service)
+			if ierr != nil {
+				if err == nil {
+					err = errors.New("")
+				}
+				err = errors.Wrap(ierr, "diff("+creq.qualifiedName(service)+"): "+err.Error())
+				creq.debug("error diffing service: " + service)
+			}
+			if status == StatusIgnored {
+				ignored = append(ignored, creq.qualifiedName(service))
+			} else if status != StatusInSync {
+				outOfSync = append(outOfSync, creq.qualifiedName(service))
+			}
 		}
 	}
 	if len(outOfSync) > 0 {
@@ -53,74 +87,273 @@ func HandleDiffAll() ([]string, error) {
 	} else {
 		req.log("all services are in sync")
 	}
-	return outOfSync, err
+	if len(ignored) > 0 {
+		req.log("services that are ignored: " + strings.Join(ignored, ", "))
+	}
+	return outOfSync, ignored, err
 }
 
 // HandleSNS parses a message from AWS SNS which contains info about ECS task
 // updates (is it running or stopping, and port mapping) which is pushed to dynamodb
-func HandleSNS(messageID string, body io.ReadCloser) error {
-	req := request{
-		id: "SNSNotif::" + messageID,
+// In a dry run nothing is changed and the planned changes are returned
+func HandleSNS(messageID string, body io.ReadCloser, dryRun bool) ([]Mutation, error) {
+	req := newRequest("SNSNotif::" + messageID).withDryRun(dryRun)
+	req.messageID = messageID
+	event, err := req.decodeEvent(body)
+	if err != nil {
+		return nil, err
 	}
+	return req.handleEvent(event)
+}
+
+// decodeEvent reads the ecs event out of an sns notification
+func (req *request) decodeEvent(body io.ReadCloser) (Event, error) {
+	event := Event{}
 	// Note the same endpoint needs to be able to handle subscription confirmations from sns
 	notif, err := DecodeNotification(body)
 	if err != nil {
-		req.log("error decoding notfiction: DecodeNotification() " + err.Error())
-		return errors.Wrap(err, "Notififcation DecodeNotification()")
+		req.error("error decoding notfiction: DecodeNotification() " + err.Error())
+		return event, errors.Wrap(err, "Notififcation DecodeNotification()")
 	}
 	req.debug("type is notification")
-	event := Event{}
 	err = json.Unmarshal([]byte(notif.Message), &event)
 	if err != nil {
-		req.log("failed to unmarshall message: " + err.Error())
-		return errors.Wrap(err, "Unmarshal()")
+		req.error("failed to unmarshall message: " + err.Error())
+		return event, errors.Wrap(withKind(ErrInvalidEvent, err), "Unmarshal()")
 	}
+	return event, nil
+}
+
+// handleEvent claims an ecs event so it isn't handled twice and processes it
+func (req *request) handleEvent(event Event) (mutations []Mutation, err error) {
+	req, span, tracked := req.startEvent(event)
+	defer func() { endEventSpan(span, err) }()
+	if !tracked {
+		return req.mutations(), nil
+	}
+	release, err := req.claim(event)
+	if err != nil {
+		if !errors.Is(err, ErrDuplicateEvent) {
+			req.deadLetter(event, err)
+		}
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
 	err = req.processECSEventMessage(event.Detail)
 	if err != nil {
-		req.log("error processing ecs event message: " + err.Error())
-		return err
+		req.error("error processing ecs event message: " + err.Error())
+		req.deadLetter(event, err)
+		return req.mutations(), err
 	}
 	req.log("handled sns notification for service: " + event.Detail.Group)
-	return nil
+	req.clearDeadLetter(event)
+	return req.mutations(), nil
+}
+
+// startEvent starts the span of an event and finds its cluster. Events from
+// clusters that aren't tracked are not handled
+func (req *request) startEvent(event Event) (*request, trace.Span, bool) {
+	req, span := req.startSpan("HandleSNS")
+	req = req.withTask(event.Detail.TaskArn)
+	req.annotate(attribute.String("ecs.task.arn", event.Detail.TaskArn))
+	cluster, ok := req.eventCluster(event)
+	if !ok {
+		req.warn("ignoring event from untracked cluster: " + event.Detail.ClusterArn)
+		return req, span, false
+	}
+	req.cluster = cluster
+	req.annotate(attribute.String("ecs.cluster", clusterName(cluster.Name)))
+	return req, span, true
+}
+
+// claim claims an event so it isn't handled again. The returned func releases
+// the claim when handling it fails
+func (req *request) claim(event Event) (func(), error) {
+	// a dry run changes nothing so it doesn't count as handling the event
+	if req.dryRun() {
+		return func() {}, nil
+	}
+	release, err := req.claimEvent(req.messageID, event.ID)
+	if errors.Is(err, ErrDuplicateEvent) {
+		req.warn("ignoring duplicate event: " + err.Error())
+		req.annotate(attribute.Bool("event.duplicate", true))
+		return nil, err
+	}
+	if err != nil {
+		req.error("error claiming event: " + err.Error())
+		return nil, errors.Wrap(err, "claimEvent()")
+	}
+	return release, nil
+}
+
+// endEventSpan ends the span of an event. Duplicates are acknowledged rather than failed
+func endEventSpan(span trace.Span, err error) {
+	if errors.Is(err, ErrDuplicateEvent) {
+		span.End()
+		return
+	}
+	endSpan(span, err)
 }
 
 // HandleSync syncs all tasks of one service with dynamodb
 // It gets host ip and port on which the services tasks are listening and
-// puts those in dynamodb as a backend
-func HandleSync(service string) error {
-	req := request{id: "SyncOne:::" + strconv.FormatInt(time.Now().Unix(), 10)}
-	err := req.sync(service)
+// puts those in dynamodb as a backend. If cluster is empty the service is
+// synced in every tracked cluster it runs in. In a dry run nothing is changed
+// and the planned changes are returned
+func HandleSync(cluster, service string, dryRun bool) ([]Mutation, error) {
+	req := newRequest("SyncOne:::" + strconv.FormatInt(time.Now().Unix(), 10)).withDryRun(dryRun)
+	clusters, err := req.serviceClusters(cluster, service)
 	if err != nil {
-		req.log("error syncing service '" + service + "': " + err.Error())
-		return errors.Wrap(err, "sync("+service+")")
+		req.withService(service).error("error finding clusters for service '" + service + "': " + err.Error())
+		return nil, err
 	}
-	req.log("successfully synced service: " + service)
-	return nil
+	for _, c := range clusters {
+		creq := req.forCluster(c).withService(service)
+		err := creq.sync(service)
+		if err != nil {
+			creq.error("error syncing service '" + creq.qualifiedName(service) + "': " + err.Error())
+			return req.mutations(), errors.Wrap(err, "sync("+creq.qualifiedName(service)+")")
+		}
+		creq.log("successfully synced service: " + creq.qualifiedName(service))
+	}
+	return req.mutations(), nil
 }
 
 // HandleSyncAll syncs all the clusters tasks networking information to dynamodb
-func HandleSyncAll() error {
-	req := request{id: "SyncAll:::" + strconv.FormatInt(time.Now().Unix(), 10)}
+// If cluster is empty every tracked cluster is synced. In a dry run nothing is
+// changed and the planned changes are returned
+func HandleSyncAll(cluster string, dryRun bool) ([]Mutation, error) {
+	req := newRequest("SyncAll:::" + strconv.FormatInt(time.Now().Unix(), 10)).withDryRun(dryRun)
 	req.debug("syncing all")
-	err := req.syncAll(0)
+	err := req.syncClusters(cluster, 0)
 	if err != nil {
-		req.log("error syncying one or more services: " + err.Error())
-		return errors.Wrap(err, "syncAll(0)")
+		req.error("error syncying one or more services: " + err.Error())
+		return req.mutations(), errors.Wrap(err, "syncAll(0)")
 	}
 	req.log("sucessfully synced all services")
-	return nil
+	return req.mutations(), nil
 }
 
 // HandleSyncSlow syncs every service in an ECS cluster with the dynamodb table
-// and sleeps 'seconds' in between syncing each service
-func HandleSyncSlow(milliseconds int) error {
-	req := request{id: "SyncSlow::" + strconv.FormatInt(time.Now().Unix(), 10)}
+// and sleeps 'seconds' in between syncing each service. If cluster is empty
+// every tracked cluster is synced. In a dry run nothing is changed and the
+// planned changes are logged
+func HandleSyncSlow(cluster string, milliseconds int, dryRun bool) error {
+	req := newRequest("SyncSlow::" + strconv.FormatInt(time.Now().Unix(), 10)).withDryRun(dryRun)
 	req.debug("syncing all services at a rate of one service every " + strconv.Itoa(milliseconds) + " milliseconds")
-	err := req.syncAll(milliseconds)
+	err := req.syncClusters(cluster, milliseconds)
 	if err != nil {
-		req.log("error slow syncing all services: " + err.Error())
+		req.error("error slow syncing all services: " + err.Error())
 		return errors.Wrap(err, "syncAll("+strconv.Itoa(milliseconds)+")")
 	}
 	req.log("successfully synced all services, sycing one service every " + strconv.Itoa(milliseconds) + " milliseconds")
 	return nil
 }
+
+// syncClusters syncs every service in each cluster a request acts on
+func (req *request) syncClusters(cluster string, milliseconds int) error {
+	clusters, err := req.clustersFor(cluster)
+	if err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		creq := req.forCluster(c)
+		ierr := creq.syncAll(milliseconds)
+		if ierr != nil {
+			if err == nil {
+				err = errors.New("")
+			}
+			err = errors.Wrap(ierr, "syncAll("+c.Name+"): "+err.Error())
+		}
+	}
+	return err
+}
+
+// HandlePrune deletes or empties the backends this tracker owns that no
+// tracked service or task group in any cluster has had for the grace period.
+// Nothing is changed when dryRun, prune.dryRun or the global dry run is set
+func HandlePrune(dryRun bool) ([]Pruned, error) {
+	req := newRequest("Prune::" + strconv.FormatInt(time.Now().Unix(), 10))
+	req = req.withDryRun(dryRun || req.util.Prune.DryRun)
+	pruned, err := req.prune(time.Now())
+	if err != nil {
+		req.error("error pruning backends: " + err.Error())
+		return pruned, errors.Wrap(err, "prune()")
+	}
+	req.log("pruned backends: " + strconv.Itoa(len(pruned)) + " orphans found")
+	return pruned, nil
+}
+
+// ServiceServer is the address a task of a service is reached at according to ecs
+type ServiceServer struct {
+	Cluster string `json:"cluster"`
+	// Backend is the backend the address belongs in
+	Backend           string `json:"backend"`
+	Address           string `json:"address"`
+	TaskArn           string `json:"taskArn"`
+	TaskDefinitionArn string `json:"taskDefinitionArn"`
+}
+
+// HandleBackends lists every backend in the traefik table sorted by name
+func HandleBackends() ([]BackendItem, error) {
+	req := newRequest("Backends:::" + strconv.FormatInt(time.Now().Unix(), 10))
+	backends, err := req.getBackendItems()
+	if err != nil {
+		req.error("error listing backends: " + err.Error())
+		return nil, errors.Wrap(err, "getBackendItems()")
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].Name < backends[j].Name })
+	return backends, nil
+}
+
+// HandleBackend gets the item of a backend by its name
+func HandleBackend(name string) (BackendItem, error) {
+	req := newRequest("Backends:::" + strconv.FormatInt(time.Now().Unix(), 10)).withService(name)
+	backend, err := req.getBackendItem(name)
+	if err != nil {
+		if !errors.Is(err, ErrItemNotFound) {
+			req.error("error getting backend " + name + ": " + err.Error())
+		}
+		return backend, errors.Wrap(err, "getBackendItem("+name+")")
+	}
+	return backend, nil
+}
+
+// HandleServers lists the addresses of the tasks of a service as ecs reports
+// them. If cluster is empty every tracked cluster the service runs in is listed
+func HandleServers(cluster, service string) ([]ServiceServer, error) {
+	req := newRequest("Servers:::" + strconv.FormatInt(time.Now().Unix(), 10)).withService(service)
+	clusters, err := req.serviceClusters(cluster, service)
+	if err != nil {
+		req.error("error finding clusters for service " + service + ": " + err.Error())
+		return nil, err
+	}
+	servers := make([]ServiceServer, 0)
+	for _, c := range clusters {
+		creq := req.forCluster(c)
+		addresses, err := creq.getTaskAddressesECS(service)
+		if err != nil && !errors.Is(err, ErrNoNetworkBindings) {
+			creq.error("error getting addresses of " + creq.qualifiedName(service) + ": " + err.Error())
+			return nil, errors.Wrap(err, "getTaskAddressesECS("+creq.qualifiedName(service)+")")
+		}
+		backendName, err := creq.serviceBackendName(service)
+		if err != nil {
+			return nil, errors.Wrap(err, "serviceBackendName("+service+")")
+		}
+		for _, addr := range addresses {
+			servers = append(servers, ServiceServer{
+				Cluster:           clusterName(c.Name),
+				Backend:           backendName,
+				Address:           addr.String(),
+				TaskArn:           addr.TaskArn,
+				TaskDefinitionArn: addr.TaskDefinitionArn,
+			})
+		}
+	}
+	sort.SliceStable(servers, func(i, j int) bool { return servers[i].Address < servers[j].Address })
+	return servers, nil
+}
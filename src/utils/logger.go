@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Level is how important a log record is
+type Level int
+
+const (
+	// LevelDebug is what every operation is doing
+	LevelDebug Level = iota
+	// LevelInfo is the outcome of operations
+	LevelInfo
+	// LevelWarn is what was skipped or retried
+	LevelWarn
+	// LevelError is a failure
+	LevelError
+)
+
+var levelNames = []string{config.LogLevelDebug, config.LogLevelInfo, config.LogLevelWarn, config.LogLevelError}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// MarshalText writes the name of a level so it is a string in json
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// ParseLevel parses the name of a level like info
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New("unknown log level: " + name)
+}
+
+// Record is one log line. Request ids, message ids, services, clusters and
+// task arns are only set when the operation logging knows them
+type Record struct {
+	Time      time.Time `json:"time"`
+	Level     Level     `json:"level"`
+	Component string    `json:"component,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	MessageID string    `json:"message_id,omitempty"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Service   string    `json:"service,omitempty"`
+	TaskArn   string    `json:"task_arn,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Caller    string    `json:"caller,omitempty"`
+	Message   string    `json:"msg"`
+}
+
+// Logger writes log records. Tests replace it to check what is logged
+type Logger interface {
+	Log(record Record)
+}
+
+// jsonLogger writes every record as a line of json
+type jsonLogger struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// NewJSONLogger creates a logger writing a json object per line to out
+func NewJSONLogger(out io.Writer) Logger {
+	return &jsonLogger{out: out}
+}
+
+func (l *jsonLogger) Log(record Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// levels are the lowest level logged by each component
+type levels struct {
+	base       Level
+	components map[string]Level
+}
+
+// newLevels creates the levels of a configuration. debug lowers the base level to debug
+func newLevels(cfg config.Logging, debug bool) levels {
+	l := levels{base: LevelInfo, components: make(map[string]Level)}
+	if level, err := ParseLevel(cfg.Level); err == nil {
+		l.base = level
+	}
+	if debug {
+		l.base = LevelDebug
+	}
+	for component, name := range cfg.Components {
+		if level, err := ParseLevel(name); err == nil {
+			l.components[component] = level
+		}
+	}
+	return l
+}
+
+func (l levels) enabled(component string, level Level) bool {
+	if min, ok := l.components[component]; ok {
+		return level >= min
+	}
+	return level >= l.base
+}
+
+// operationComponents are the components the operations in request ids belong to
+var operationComponents = map[string]string{
+	"SNSNotif":       "events",
+	"Replay":         "events",
+	"DeadLetters":    "events",
+	"Capture":        "events",
+	"SyncOne":        "sync",
+	"SyncAll":        "sync",
+	"SyncSlow":       "sync",
+	"DiffOne":        "diff",
+	"DiffAll":        "diff",
+	"Prune":          "prune",
+	"Backends":       "backends",
+	"Servers":        "backends",
+	"MigrateNames":   "migrate",
+	"Reload":         "config",
+	"BootstrapTable": "table",
+	"Ready":          "ready",
+}
+
+// operation is the operation a request id starts with, like SyncOne in SyncOne:::1500000000
+func (req *request) operation() string {
+	if i := strings.Index(req.id, "::"); i >= 0 {
+		return req.id[:i]
+	}
+	return req.id
+}
+
+// withService creates a copy of a request acting on a service or task group backend
+func (req *request) withService(service string) *request {
+	sreq := *req
+	sreq.service = service
+	return &sreq
+}
+
+// withTask creates a copy of a request acting on a task
+func (req *request) withTask(taskArn string) *request {
+	treq := *req
+	treq.taskArn = taskArn
+	return &treq
+}
+
+// emit logs msg at level with everything known about the request. depth is
+// how many calls up the line that logged is
+func (req *request) emit(level Level, msg string, depth int) {
+	operation := req.operation()
+	component := operationComponents[operation]
+	if !req.util.levels.enabled(component, level) || req.util.Logger == nil {
+		return
+	}
+	record := Record{
+		Time:      time.Now().UTC(),
+		Level:     level,
+		Component: component,
+		Operation: operation,
+		RequestID: req.id,
+		MessageID: req.messageID,
+		Service:   req.service,
+		TaskArn:   req.taskArn,
+		Message:   msg,
+	}
+	if req.cluster != nil {
+		record.Cluster = clusterName(req.cluster.Name)
+	}
+	if span := trace.SpanContextFromContext(req.ctx); span.HasTraceID() {
+		record.TraceID = span.TraceID().String()
+	}
+	if _, file, line, ok := runtime.Caller(depth); ok {
+		record.Caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	req.util.Logger.Log(record)
+}
+
+func (req *request) debug(str string) {
+	req.emit(LevelDebug, str, 2)
+}
+
+func (req *request) log(str string) {
+	req.emit(LevelInfo, str, 2)
+}
+
+func (req *request) warn(str string) {
+	req.emit(LevelWarn, str, 2)
+}
+
+func (req *request) error(str string) {
+	req.emit(LevelError, str, 2)
+}
+
+// Log writes a record for code that isn't part of a request, like startup in main
+func Log(level Level, component, msg string) {
+	util, ok := current.Load().(*Util)
+	if !ok || !util.levels.enabled(component, level) || util.Logger == nil {
+		return
+	}
+	record := Record{
+		Time:      time.Now().UTC(),
+		Level:     level,
+		Component: component,
+		Message:   msg,
+	}
+	if _, file, line, ok := runtime.Caller(1); ok {
+		record.Caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	util.Logger.Log(record)
+}
+
+// defaultLogger writes json lines to stdout
+var defaultLogger = NewJSONLogger(os.Stdout)
+
+// LogTo makes Init use a logger writing json lines to out. Commands that print
+// their results to stdout log to stderr
+func LogTo(out io.Writer) {
+	defaultLogger = NewJSONLogger(out)
+}
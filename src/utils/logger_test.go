@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// recordingLogger keeps the records it is given so tests can check them
+type recordingLogger struct {
+	mutex   sync.Mutex
+	records []Record
+}
+
+func (l *recordingLogger) Log(record Record) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.records = append(l.records, record)
+}
+
+// withLogger records what is logged with the levels of cfg
+func withLogger(cfg config.Logging) (*recordingLogger, func()) {
+	logger := &recordingLogger{}
+	return logger, withUtil(func(u *Util) {
+		u.Logger, u.levels = logger, newLevels(cfg, false)
+	})
+}
+
+func TestLogCorrelatesEvent(t *testing.T) {
+	logger, restore := withLogger(config.Logging{Level: config.LogLevelDebug})
+	defer restore()
+	createEnv("loginstancearn", "logtask", "loginstanceid", "10.0.0.7", 8095)
+
+	detail := Detail{
+		Group:                "service:logtask",
+		ContainerInstanceArn: "loginstancearn",
+		DesiredStatus:        Running,
+		LastStatus:           Running,
+		TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/log1",
+		Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 8095}}}},
+	}
+	if _, err := HandleSNS("TestLog::Add", ioutil.NopCloser(snsBody(detail)), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.records) == 0 {
+		t.Fatal("nothing was logged")
+	}
+	correlated := false
+	for _, r := range logger.records {
+		if r.Operation != "SNSNotif" || r.Component != "events" || r.RequestID != "SNSNotif::TestLog::Add" || r.MessageID != "TestLog::Add" {
+			t.Errorf("record is not correlated with the notification: %+v", r)
+		}
+		if r.Cluster == "test" && r.Service == "logtask" && r.TaskArn == detail.TaskArn {
+			correlated = true
+		}
+	}
+	if !correlated {
+		t.Errorf("no record has the cluster, service and task: %+v", logger.records)
+	}
+}
+
+func TestLogComponentLevels(t *testing.T) {
+	logger, restore := withLogger(config.Logging{
+		Level:      config.LogLevelError,
+		Components: map[string]string{"sync": config.LogLevelDebug},
+	})
+	defer restore()
+
+	newRequest("SyncOne:::1").debug("kept")
+	newRequest("DiffOne:::1").log("dropped")
+	newRequest("DiffOne:::1").error("kept")
+	Log(LevelWarn, "main", "dropped")
+	if len(logger.records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", logger.records)
+	}
+	if logger.records[0].Component != "sync" || logger.records[1].Level != LevelError {
+		t.Errorf("unexpected records: %+v", logger.records)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	NewJSONLogger(out).Log(Record{Level: LevelWarn, Component: "sync", Service: "api", Message: "hi"})
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["level"] != "warn" || fields["component"] != "sync" || fields["service"] != "api" || fields["msg"] != "hi" {
+		t.Errorf("unexpected line: %s", out)
+	}
+	if _, ok := fields["task_arn"]; ok {
+		t.Errorf("empty fields should be left out: %s", out)
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_task_tracker_config_reloads_total",
+		Help: "Configuration reloads by result.",
+	}, []string{"result"})
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ecs_task_tracker_config_last_reload_success_timestamp_seconds",
+		Help: "Time of the last successful configuration reload.",
+	})
+	duplicateEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_task_tracker_duplicate_events_total",
+		Help: "Events that were acknowledged without handling them because they were handled before, by the id they were recognized by.",
+	}, []string{"key"})
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ecs_task_tracker_queue_depth",
+		Help: "Events waiting in the queue to be handled.",
+	})
+	queueCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ecs_task_tracker_queue_capacity",
+		Help: "Events that can wait in the queue, the number of workers times queue.size.",
+	})
+	rejectedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ecs_task_tracker_queue_rejected_total",
+		Help: "Events rejected because the worker of their service had a full queue.",
+	})
+	queueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ecs_task_tracker_queue_wait_seconds",
+		Help:    "Time events waited in the queue before a worker took them.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	coalescedEvents = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ecs_task_tracker_coalesced_events",
+		Help:    "Events whose changes were written to a backend with one update.",
+		Buckets: prometheus.ExponentialBuckets(2, 2, 8),
+	})
+	deadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ecs_task_tracker_dead_letters_total",
+		Help: "Failed attempts at handling events that were kept as dead letters.",
+	})
+	deadLetterReplays = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecs_task_tracker_dead_letter_replays_total",
+		Help: "Replays of dead letters by result.",
+	}, []string{"result"})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ecs_task_tracker_build_info",
+		Help: "Always 1. Labeled with the build of the binary and the hash of the configuration in use.",
+	}, []string{"version", "commit", "build_time", "go_version", "config_hash"})
+)
+
+func init() {
+	prometheus.MustRegister(configReloads, configLastReload, duplicateEvents, queueDepth, queueCapacity, rejectedEvents, queueWait, coalescedEvents, deadLetters, deadLetterReplays, buildInfo)
+}
+
+// RecordBuildInfo replaces the labels of the build info metric. It is called
+// again whenever the configuration hash changes
+func RecordBuildInfo(version, commit, buildTime, goVersion, configHash string) {
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(version, commit, buildTime, goVersion, configHash).Set(1)
+}
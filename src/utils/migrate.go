@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// MigrateNames renames the backends of every tracked service and task group
+// from the names and ids the naming of from gives them to the ones the current
+// configuration gives them. Frontends using a renamed backend are pointed at
+// the new name. Backends whose new name is already taken are left alone. The
+// changes are only logged in a global dry run
+func MigrateNames(from *config.Config) error {
+	req := newRequest("MigrateNames::" + strconv.FormatInt(time.Now().Unix(), 10)).withDryRun(false)
+	fromUtil := newUtil(from, req.util.Clusters, nil, req.util)
+	// only the naming comes from the old configuration
+	fromUtil.TraefikTable = req.util.TraefikTable
+
+	var err error
+	for _, c := range req.util.Clusters {
+		creq := req.forCluster(c)
+		// a copy keeps the context and cluster of creq
+		from := *creq
+		from.util = fromUtil
+		fromReq := &from
+		if ierr := creq.migrateCluster(fromReq); ierr != nil {
+			if err == nil {
+				err = errors.New("")
+			}
+			err = errors.Wrap(ierr, "migrateCluster("+c.Name+"): "+err.Error())
+		}
+	}
+	return err
+}
+
+// migrateCluster renames the backends in the requests cluster from the names fromReq gives them
+func (req *request) migrateCluster(fromReq *request) error {
+	services, err := req.listServices()
+	if err != nil {
+		return errors.Wrap(err, "listServices()")
+	}
+	services, _, err = req.partitionServices(services)
+	if err != nil {
+		return errors.Wrap(err, "partitionServices()")
+	}
+	for _, service := range services {
+		oldName, err := fromReq.serviceBackendName(service)
+		if err != nil {
+			return errors.Wrap(err, "serviceBackendName("+service+")")
+		}
+		newName, err := req.serviceBackendName(service)
+		if err != nil {
+			return errors.Wrap(err, "serviceBackendName("+service+")")
+		}
+		if err := req.renameBackend(fromReq, oldName, newName); err != nil {
+			return errors.Wrap(err, "renameBackend("+oldName+")")
+		}
+	}
+
+	groups, err := req.getGroupAddresses()
+	if err != nil {
+		return errors.Wrap(err, "getGroupAddresses()")
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldName, err := fromReq.groupBackendName(name, groups[name])
+		if err != nil {
+			return errors.Wrap(err, "groupBackendName("+name+")")
+		}
+		newName, err := req.groupBackendName(name, groups[name])
+		if err != nil {
+			return errors.Wrap(err, "groupBackendName("+name+")")
+		}
+		if err := req.renameBackend(fromReq, oldName, newName); err != nil {
+			return errors.Wrap(err, "renameBackend("+oldName+")")
+		}
+	}
+	return nil
+}
+
+// renameBackend copies the backend fromReq names oldName to the item the
+// request names newName, moves its frontends and deletes the old item
+func (req *request) renameBackend(fromReq *request, oldName, newName string) error {
+	oldID, newID := fromReq.backendID(oldName), req.backendID(newName)
+	if oldID == newID {
+		return nil
+	}
+	item, err := fromReq.getBackendItem(oldName)
+	if err != nil {
+		if errors.Is(err, ErrItemNotFound) {
+			req.debug("nothing to rename for " + oldID)
+			return nil
+		}
+		return errors.Wrap(err, "getBackendItem("+oldName+")")
+	}
+	_, err = req.getBackendItem(newName)
+	if err == nil {
+		req.warn("not renaming " + oldID + " because " + newID + " already exists")
+		return nil
+	}
+	if !errors.Is(err, ErrItemNotFound) {
+		return errors.Wrap(err, "getBackendItem("+newName+")")
+	}
+
+	if err := req.createBackendDynamoDB(newName, req.createBackendItem(newName, item.Backend)); err != nil {
+		return errors.Wrap(err, "createBackendDynamoDB("+newName+")")
+	}
+	if oldName != newName {
+		if err := req.renameFrontendBackends(oldName, newName); err != nil {
+			return errors.Wrap(err, "renameFrontendBackends("+oldName+")")
+		}
+	}
+	if err := req.deleteItem(oldID); err != nil {
+		return errors.Wrap(err, "deleteItem("+oldID+")")
+	}
+	req.log("renamed " + oldID + " to " + newID)
+	return nil
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// naming holds the compiled naming templates. A nil backend template means
+// backends are named by the name policy
+type naming struct {
+	backend *template.Template
+	id      *template.Template
+	// labels is whether the backend template reads docker labels
+	labels bool
+}
+
+// backendNameData is what the backend naming template is executed with
+type backendNameData struct {
+	Service string
+	Cluster string
+	Account string
+	Region  string
+	Labels  map[string]string
+}
+
+// newNaming compiles the naming templates of a configuration
+// The configuration must already be validated
+func newNaming(cfg config.Naming) *naming {
+	n := &naming{
+		labels: strings.Contains(cfg.Backend, ".Labels"),
+	}
+	if cfg.Backend != "" {
+		n.backend, _ = template.New("backend").Option("missingkey=error").Parse(cfg.Backend)
+	}
+	if cfg.ID != "" {
+		n.id, _ = template.New("id").Option("missingkey=error").Parse(cfg.ID)
+	}
+	return n
+}
+
+// backendName is the name of the backend for a service or task group in the
+// requests cluster. taskDefinitionArn is where docker labels are read from and
+// may be empty when the naming template doesn't use them
+func (req *request) backendName(service, taskDefinitionArn string) (string, error) {
+	if req.util.naming.backend == nil {
+		return req.policyName(service), nil
+	}
+	data := backendNameData{
+		Service: service,
+		Cluster: clusterName(req.cluster.Name),
+		Account: req.cluster.Account,
+		Region:  req.cluster.Region,
+		Labels:  make(map[string]string),
+	}
+	if req.util.naming.labels && taskDefinitionArn != "" {
+		labels, err := req.getContainerLabels(taskDefinitionArn)
+		if err != nil {
+			return "", errors.Wrap(err, "getContainerLabels("+taskDefinitionArn+")")
+		}
+		// when containers disagree on a label the first by name wins
+		containers := make([]string, 0, len(labels))
+		for container := range labels {
+			containers = append(containers, container)
+		}
+		sort.Strings(containers)
+		for _, container := range containers {
+			for key, value := range labels[container] {
+				if _, exists := data.Labels[key]; !exists {
+					data.Labels[key] = aws.StringValue(value)
+				}
+			}
+		}
+	}
+	var name bytes.Buffer
+	if err := req.util.naming.backend.Execute(&name, data); err != nil {
+		return "", errors.Wrap(err, "naming template")
+	}
+	if strings.TrimSpace(name.String()) == "" {
+		return "", errors.Wrap(ErrEmptyBackendName, service)
+	}
+	return strings.TrimSpace(name.String()), nil
+}
+
+// policyName is the name of the backend for a service in the requests cluster
+// according to the name policy
+func (req *request) policyName(service string) string {
+	switch req.util.NamePolicy {
+	case NamePolicyCluster:
+		return clusterName(req.cluster.Name) + "-" + service
+	case NamePolicyFirst:
+		if len(req.util.Clusters) > 0 && req.util.Clusters[0] == req.cluster {
+			return service
+		}
+		return clusterName(req.cluster.Name) + "-" + service
+	}
+	return service
+}
+
+// serviceBackendName is the name of the backend for a service in the requests
+// cluster. Labels are read from the task definition the service is deploying
+func (req *request) serviceBackendName(service string) (string, error) {
+	if !req.util.naming.labels {
+		return req.backendName(service, "")
+	}
+	taskDefinitionArn, err := req.serviceTaskDefinition(service)
+	if err != nil {
+		return "", errors.Wrap(err, "serviceTaskDefinition("+service+")")
+	}
+	return req.backendName(service, taskDefinitionArn)
+}
+
+// serviceTaskDefinition gets the arn of the task definition of a service
+func (req *request) serviceTaskDefinition(service string) (string, error) {
+	params := &ecs.DescribeServicesInput{
+		Cluster:  aws.String(req.cluster.Name),
+		Services: []*string{aws.String(service)},
+	}
+	resp, err := req.cluster.ECS.DescribeServicesWithContext(req.ctx, params)
+	if err != nil {
+		req.debug("error describing service: " + service)
+		return "", errors.Wrap(classify(err), "ecs.DescribeServices()")
+	}
+	if len(resp.Services) < 1 {
+		return "", errors.Wrap(ErrItemNotFound, "service "+service)
+	}
+	return aws.StringValue(resp.Services[0].TaskDefinition), nil
+}
+
+// backendID is the id of the dynamodb item of a backend
+func (req *request) backendID(name string) string {
+	if req.util.naming.id == nil {
+		return name + "__backend"
+	}
+	var id bytes.Buffer
+	if err := req.util.naming.id.Execute(&id, map[string]string{"Name": name}); err != nil {
+		// the template was checked when the configuration was validated
+		req.debug("error executing id template: " + err.Error())
+		return name + "__backend"
+	}
+	return id.String()
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/containous/traefik/types"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func withNaming(n config.Naming) func() {
+	return withUtil(func(u *Util) {
+		u.naming = newNaming(n)
+	})
+}
+
+func TestBackendNameTemplate(t *testing.T) {
+	cluster := &Cluster{Name: "arn:aws:ecs:us-east-1:123456789012:cluster/prod", Account: "123456789012", Region: "us-east-1"}
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withNaming(config.Naming{Backend: "{{.Cluster}}-{{.Region}}-{{.Service}}", ID: "shared/{{.Name}}"})()
+
+	req := newRequest("TestBackendNameTemplate").forCluster(cluster)
+	name, err := req.backendName("api", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "prod-us-east-1-api" {
+		t.Errorf("expected prod-us-east-1-api, got %s", name)
+	}
+	if id := req.backendID(name); id != "shared/prod-us-east-1-api" {
+		t.Errorf("expected shared/prod-us-east-1-api, got %s", id)
+	}
+}
+
+func TestBackendNameLabels(t *testing.T) {
+	ecsM.TaskDefinitions = map[string]*ecs.TaskDefinition{
+		"named:1": {
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), DockerLabels: map[string]*string{"traefik.backend": aws.String("storefront")}},
+			},
+		},
+	}
+	defer withNaming(config.Naming{Backend: `{{index .Labels "traefik.backend"}}`, ID: "{{.Name}}__backend"})()
+
+	req := newRequest("TestBackendNameLabels")
+	req = req.forCluster(req.util.Clusters[0])
+	name, err := req.backendName("web", "named:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "storefront" {
+		t.Errorf("expected the name from the label, got %s", name)
+	}
+	if _, err := req.backendName("web", ""); err == nil {
+		t.Error("expected an error for an empty backend name")
+	}
+}
+
+func TestEventBackendNameLabels(t *testing.T) {
+	ecsM.TaskDefinitions = map[string]*ecs.TaskDefinition{
+		"relabelled:1": {
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), DockerLabels: map[string]*string{"traefik.backend": aws.String("storefront")}},
+			},
+		},
+		"relabelled:2": {
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), DockerLabels: map[string]*string{"traefik.backend": aws.String("shop")}},
+			},
+		},
+	}
+	defer withNaming(config.Naming{Backend: `{{index .Labels "traefik.backend"}}`, ID: "{{.Name}}__backend"})()
+
+	// a deploy moves web from relabelled:1 to relabelled:2. The old tasks stop
+	// in the backend they were added to
+	req := newRequest("TestEventBackendNameLabels")
+	req = req.forCluster(req.util.Clusters[0])
+	for taskDefinition, expected := range map[string]string{"relabelled:1": "storefront", "relabelled:2": "shop"} {
+		name, tracked, err := req.eventBackendName(Detail{Group: "service:web", TaskDefinitionArn: taskDefinition})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tracked || name != expected {
+			t.Errorf("expected the task of %s in %s, got %s", taskDefinition, expected, name)
+		}
+	}
+}
+
+func TestMigrateNames(t *testing.T) {
+	cluster := accountCluster("", "migrate-instance-arn", "i-migrate", "10.5.0.1")
+	cluster.ECS.(*utils_test.EcsMock).AddService("orders")
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withNaming(config.Naming{Backend: "{{.Cluster}}-{{.Service}}", ID: "{{.Name}}__backend"})()
+
+	req := newRequest("TestMigrateNames").forCluster(cluster)
+	backend := req.createBackend([]string{"10.5.0.1:8000"})
+	old, _ := dynamodbattribute.MarshalMap(BackendItem{Backend: backend, EndItem: EndItem{ID: "orders__backend", Name: "orders"}})
+	dynamodbM.PutBackend(old)
+	frontend, _ := dynamodbattribute.MarshalMap(FrontendItem{
+		Frontend: types.Frontend{Backend: "orders"},
+		EndItem:  EndItem{ID: "orders__frontend", Name: "orders"},
+	})
+	dynamodbM.PutBackend(frontend)
+
+	if err := MigrateNames(config.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := dynamodbM.Items["orders__backend"]; exists {
+		t.Error("old backend was not removed")
+	}
+	renamed := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["web-orders__backend"], &renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := renamed.Backend.Servers["10.5.0.1:8000"]; !ok || renamed.Name != "web-orders" {
+		t.Errorf("backend was not copied to its new name, got %+v", renamed)
+	}
+	moved := FrontendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["orders__frontend"], &moved); err != nil {
+		t.Fatal(err)
+	}
+	if moved.Frontend.Backend != "web-orders" {
+		t.Errorf("frontend still points at %s", moved.Frontend.Backend)
+	}
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+const (
+	// PruneDelete deletes an orphaned backend. See config.PruneDelete
+	PruneDelete = config.PruneDelete
+	// PruneEmpty removes every server from an orphaned backend. See config.PruneEmpty
+	PruneEmpty = config.PruneEmpty
+	// PruneMarked means a backend was found orphaned for the first time and its grace period started
+	PruneMarked = "mark"
+	// PruneWaiting means an orphaned backend is still in its grace period
+	PruneWaiting = "wait"
+	// PruneRevived means a backend that was orphaned is in use again and its grace period was cleared
+	PruneRevived = "revive"
+)
+
+// Pruned is what pruning did, or would do in a dry run, to a backend
+type Pruned struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+}
+
+// String describes what happened to the backend
+func (p Pruned) String() string {
+	return p.Action + " " + p.ID
+}
+
+// expectedBackendIDs gets the ids of the backends of every tracked service and
+// task group in every tracked cluster
+func (req *request) expectedBackendIDs() (map[string]bool, error) {
+	ids := make(map[string]bool)
+	for _, c := range req.util.Clusters {
+		creq := req.forCluster(c)
+		services, err := creq.listServices()
+		if err != nil {
+			return nil, errors.Wrap(err, "listServices("+c.Name+")")
+		}
+		services, _, err = creq.partitionServices(services)
+		if err != nil {
+			return nil, errors.Wrap(err, "partitionServices("+c.Name+")")
+		}
+		for _, service := range services {
+			name, err := creq.serviceBackendName(service)
+			if err != nil {
+				return nil, errors.Wrap(err, "serviceBackendName("+service+")")
+			}
+			ids[creq.backendID(name)] = true
+		}
+
+		groups, err := creq.getGroupAddresses()
+		if err != nil {
+			return nil, errors.Wrap(err, "getGroupAddresses("+c.Name+")")
+		}
+		for group, addresses := range groups {
+			name, err := creq.groupBackendName(group, addresses)
+			if err != nil {
+				return nil, errors.Wrap(err, "groupBackendName("+group+")")
+			}
+			ids[creq.backendID(name)] = true
+		}
+	}
+	return ids, nil
+}
+
+// prune finds the backends this tracker owns that no tracked service or task
+// group has anymore. Orphans are marked the first time they are found and
+// deleted or emptied once they have been orphaned for the grace period. If any
+// cluster can't be listed nothing is pruned
+func (req *request) prune(now time.Time) ([]Pruned, error) {
+	expected, err := req.expectedBackendIDs()
+	if err != nil {
+		return nil, errors.Wrap(err, "expectedBackendIDs()")
+	}
+	backends, err := req.getOwnedBackendItems()
+	if err != nil {
+		return nil, errors.Wrap(err, "getOwnedBackendItems()")
+	}
+	sort.Slice(backends, func(i, j int) bool { return backends[i].ID < backends[j].ID })
+
+	pruned := make([]Pruned, 0)
+	for _, backend := range backends {
+		prev := backend
+		action := ""
+		switch {
+		case expected[backend.ID] && backend.OrphanedAt != 0:
+			action = PruneRevived
+			backend.OrphanedAt = 0
+		case expected[backend.ID]:
+			continue
+		case backend.OrphanedAt == 0:
+			action = PruneMarked
+			backend.OrphanedAt = now.Unix()
+		case now.Sub(time.Unix(backend.OrphanedAt, 0)) < time.Duration(req.util.Prune.GracePeriod):
+			pruned = append(pruned, Pruned{ID: backend.ID, Action: PruneWaiting})
+			continue
+		case req.util.Prune.Action == PruneEmpty && len(backend.Backend.Servers) == 0:
+			continue
+		default:
+			action = req.util.Prune.Action
+		}
+		pruned = append(pruned, Pruned{ID: backend.ID, Action: action})
+		switch action {
+		case PruneDelete:
+			err = req.deleteBackendItemWithLock(backend)
+		case PruneEmpty:
+			backend.Backend.Servers = nil
+			err = req.putBackendItemWithLock(prev, backend)
+		default:
+			// marks don't change the servers so they don't get a new version
+			err = req.setOrphanedAt(prev, backend.OrphanedAt)
+		}
+		if err != nil {
+			return pruned, errors.Wrap(err, action+"("+backend.ID+")")
+		}
+		if !req.dryRun() {
+			req.log("pruning: " + action + " " + backend.ID)
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func TestPrune(t *testing.T) {
+	cluster := accountCluster("", "prune-instance-arn", "i-prune", "10.6.0.1")
+	cluster.ECS.(*utils_test.EcsMock).AddService("live")
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withUtil(func(u *Util) {
+		u.DynamoDB = table
+		u.Prune.GracePeriod = config.Duration(time.Hour)
+		u.Prune.Action = PruneDelete
+	})()
+
+	req := newRequest("TestPrune")
+	for _, name := range []string{"live", "gone"} {
+		item, _ := dynamodbattribute.MarshalMap(req.createBackendItem(name, req.createBackend([]string{"10.6.0.1:8000"})))
+		table.PutBackend(item)
+	}
+	manual, _ := dynamodbattribute.MarshalMap(BackendItem{EndItem: EndItem{ID: "manual__backend", Name: "manual"}})
+	table.PutBackend(manual)
+
+	now := time.Now()
+	pruned, err := req.withDryRun(true).prune(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0].String() != "mark gone__backend" {
+		t.Fatalf("expected to mark only gone, got %v", pruned)
+	}
+	item := BackendItem{}
+	dynamodbattribute.UnmarshalMap(table.Items["gone__backend"], &item)
+	if item.OrphanedAt != 0 {
+		t.Fatal("dry run marked the backend")
+	}
+
+	if _, err := req.prune(now); err != nil {
+		t.Fatal(err)
+	}
+	dynamodbattribute.UnmarshalMap(table.Items["gone__backend"], &item)
+	if item.OrphanedAt != now.Unix() {
+		t.Fatalf("expected gone to be marked orphaned at %d, got %d", now.Unix(), item.OrphanedAt)
+	}
+	if item.Version != 0 {
+		t.Errorf("expected marking gone to keep its version, got %d", item.Version)
+	}
+
+	pruned, _ = req.prune(now.Add(30 * time.Minute))
+	if len(pruned) != 1 || pruned[0].Action != PruneWaiting {
+		t.Fatalf("expected gone to wait out its grace period, got %v", pruned)
+	}
+	pruned, _ = req.prune(now.Add(2 * time.Hour))
+	if len(pruned) != 1 || pruned[0].Action != PruneDelete {
+		t.Fatalf("expected gone to be deleted, got %v", pruned)
+	}
+	if _, exists := table.Items["gone__backend"]; exists {
+		t.Error("orphaned backend was not deleted")
+	}
+	if _, exists := table.Items["live__backend"]; !exists {
+		t.Error("backend of a live service was deleted")
+	}
+	if _, exists := table.Items["manual__backend"]; !exists {
+		t.Error("backend without an owner was deleted")
+	}
+}
+
+func TestPruneRevived(t *testing.T) {
+	cluster := accountCluster("", "revive-instance-arn", "i-revive", "10.6.0.2")
+	cluster.ECS.(*utils_test.EcsMock).AddService("back")
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withUtil(func(u *Util) { u.DynamoDB = table })()
+
+	req := newRequest("TestPruneRevived")
+	backend := req.createBackendItem("back", req.createBackend(nil))
+	backend.OrphanedAt = time.Now().Add(-time.Minute).Unix()
+	item, _ := dynamodbattribute.MarshalMap(backend)
+	table.PutBackend(item)
+
+	pruned, err := req.prune(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0].Action != PruneRevived {
+		t.Fatalf("expected back to be revived, got %v", pruned)
+	}
+	revived := BackendItem{}
+	dynamodbattribute.UnmarshalMap(table.Items["back__backend"], &revived)
+	if revived.OrphanedAt != 0 {
+		t.Error("revived backend is still marked orphaned")
+	}
+	if revived.Version != backend.Version {
+		t.Errorf("expected reviving back to keep version %d, got %d", backend.Version, revived.Version)
+	}
+}
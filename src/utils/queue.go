@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// queue is nil until StartQueue is called
+var queue *eventQueue
+
+// eventQueue hands ecs events to workers by the cluster and group of their
+// task. The events of a service are handled by one worker in the order they
+// arrived while the events of different services are handled at the same time
+type eventQueue struct {
+	// mutex keeps events from being sent to shards that are being closed
+	mutex   *sync.RWMutex
+	stopped bool
+	shards  []chan queuedEvent
+	// depth is the number of events waiting
+	depth int64
+	done  *sync.WaitGroup
+	// window and maxDelay bound how long a worker collects events to coalesce
+	window   time.Duration
+	maxDelay time.Duration
+}
+
+type queuedEvent struct {
+	req    *request
+	event  Event
+	queued time.Time
+}
+
+// StartQueue starts the workers that handle the events queued by EnqueueSNS.
+// It is called once before events arrive
+func StartQueue(cfg config.Queue) {
+	q := &eventQueue{
+		mutex:    &sync.RWMutex{},
+		shards:   make([]chan queuedEvent, cfg.Workers),
+		done:     &sync.WaitGroup{},
+		window:   time.Duration(cfg.CoalesceWindow),
+		maxDelay: time.Duration(cfg.CoalesceMaxDelay),
+	}
+	for i := range q.shards {
+		q.shards[i] = make(chan queuedEvent, cfg.Size)
+		q.done.Add(1)
+		go q.work(q.shards[i])
+	}
+	queueCapacity.Set(float64(cfg.Workers * cfg.Size))
+	queueDepth.Set(0)
+	queue = q
+}
+
+// Queueing reports whether events are queued rather than handled right away
+func Queueing() bool {
+	return queue != nil
+}
+
+// EnqueueSNS decodes an sns notification and queues its ecs event to be
+// handled in the background. It returns ErrQueueFull when the worker of the
+// service already has queue.size events waiting and ErrQueueStopped once the
+// queue is drained
+func EnqueueSNS(messageID string, body io.ReadCloser) error {
+	req := newRequest("SNSNotif::" + messageID)
+	req.messageID = messageID
+	event, err := req.decodeEvent(body)
+	if err != nil {
+		return err
+	}
+	return queue.enqueue(req, event)
+}
+
+func (q *eventQueue) enqueue(req *request, event Event) error {
+	if q == nil {
+		return ErrQueueStopped
+	}
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	q.add(1)
+	select {
+	case q.shards[q.shardOf(event)] <- queuedEvent{req: req, event: event, queued: time.Now()}:
+		req.debug("queued event of " + event.Detail.Group)
+		return nil
+	default:
+		q.add(-1)
+		rejectedEvents.Inc()
+		req.withTask(event.Detail.TaskArn).warn("rejecting event, the queue of " + event.Detail.Group + " is full")
+		return ErrQueueFull
+	}
+}
+
+// shardOf picks the worker of the cluster and group of the task of an event
+func (q *eventQueue) shardOf(event Event) int {
+	h := fnv.New32a()
+	h.Write([]byte(groupOf(event)))
+	return int(h.Sum32() % uint32(len(q.shards)))
+}
+
+// groupOf is the cluster and group of the task of an event
+func groupOf(event Event) string {
+	return event.Detail.ClusterArn + "/" + event.Detail.Group
+}
+
+func (q *eventQueue) add(n int64) {
+	queueDepth.Set(float64(atomic.AddInt64(&q.depth, n)))
+}
+
+// take marks an event as taken out of the queue by a worker
+func (q *eventQueue) take(e queuedEvent) {
+	q.add(-1)
+	queueWait.Observe(time.Since(e.queued).Seconds())
+}
+
+// work handles the events of a shard until it is closed
+func (q *eventQueue) work(shard chan queuedEvent) {
+	defer q.done.Done()
+	for e := range shard {
+		q.take(e)
+		if q.window <= 0 {
+			// handleEvent logs its errors
+			e.req.handleEvent(e.event)
+			continue
+		}
+		for _, events := range byGroup(q.collect(e, shard)) {
+			handleCoalesced(events)
+		}
+	}
+}
+
+// collect takes the events that arrive in a shard until none arrived for the
+// coalescing window or the max delay passed since first was taken
+func (q *eventQueue) collect(first queuedEvent, shard chan queuedEvent) []queuedEvent {
+	events := []queuedEvent{first}
+	deadline := time.NewTimer(q.maxDelay)
+	defer deadline.Stop()
+	quiet := time.NewTimer(q.window)
+	defer quiet.Stop()
+	for {
+		select {
+		case e, ok := <-shard:
+			if !ok {
+				return events
+			}
+			q.take(e)
+			events = append(events, e)
+			if !quiet.Stop() {
+				<-quiet.C
+			}
+			quiet.Reset(q.window)
+		case <-quiet.C:
+			return events
+		case <-deadline.C:
+			return events
+		}
+	}
+}
+
+// byGroup splits events by the cluster and group of their task keeping the
+// order they arrived in
+func byGroup(events []queuedEvent) [][]queuedEvent {
+	groups := make([][]queuedEvent, 0)
+	index := make(map[string]int)
+	for _, e := range events {
+		group := groupOf(e.event)
+		i, exists := index[group]
+		if !exists {
+			i = len(groups)
+			index[group] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], e)
+	}
+	return groups
+}
+
+// DrainQueue stops queueing events and waits until the events already queued
+// are handled or ctx is done
+func DrainQueue(ctx context.Context) error {
+	q := queue
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	if !q.stopped {
+		q.stopped = true
+		for _, shard := range q.shards {
+			close(shard)
+		}
+	}
+	q.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.done.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), strconv.FormatInt(atomic.LoadInt64(&q.depth), 10)+" queued events were not handled")
+	}
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+func TestQueueKeepsServiceOrder(t *testing.T) {
+	defer func() { queue = nil }()
+	forgetInstances()
+	defer forgetInstances()
+	StartQueue(config.Queue{Workers: 4, Size: 10})
+	createEnv("queueinstancearn", "queuetask", "queueinstanceid", "10.0.0.11", 8100)
+	ecsM.RemoveTask("queuetask-arn")
+
+	// the task starts and stops several times. Only the order of the events
+	// decides whether its server is left in the backend
+	detail := Detail{
+		Group:                "service:queuetask",
+		ContainerInstanceArn: "queueinstancearn",
+		TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/queue1",
+		Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 8100}}}},
+	}
+	for i := 0; i < 10; i++ {
+		status := Running
+		if i%2 == 1 {
+			status = Stopped
+		}
+		detail.DesiredStatus, detail.LastStatus = status, status
+		id := "TestQueue::" + strconv.Itoa(i)
+		if err := EnqueueSNS(id, ioutil.NopCloser(snsEventBody(Event{ID: id, Detail: detail}))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DrainQueue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["queuetask__backend"], &backend); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.Backend.Servers) != 0 {
+		t.Errorf("expected the last stop to win, got %v", backend.Backend.Servers)
+	}
+	if got := testutil.ToFloat64(queueDepth); got != 0 {
+		t.Errorf("expected an empty queue after draining, got %v", got)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	// a queue with a worker that never takes anything out of it
+	q := &eventQueue{mutex: &sync.RWMutex{}, shards: []chan queuedEvent{make(chan queuedEvent, 1)}, done: &sync.WaitGroup{}}
+	q.done.Add(1)
+	defer q.done.Done()
+	rejected := testutil.ToFloat64(rejectedEvents)
+	req := newRequest("TestQueueFull")
+	event := Event{Detail: Detail{Group: "service:full"}}
+
+	if err := q.enqueue(req, event); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.enqueue(req, event); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if got := testutil.ToFloat64(rejectedEvents) - rejected; got != 1 {
+		t.Errorf("expected 1 rejected event, got %v", got)
+	}
+
+	queue = q
+	defer func() { queue = nil }()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := DrainQueue(ctx); err == nil {
+		t.Error("expected draining to time out with an event left")
+	}
+	if err := q.enqueue(req, event); !errors.Is(err, ErrQueueStopped) {
+		t.Errorf("expected ErrQueueStopped after draining, got %v", err)
+	}
+}
+
+func TestQueueCoalescesEvents(t *testing.T) {
+	defer func() { queue = nil }()
+	forgetInstances()
+	defer forgetInstances()
+	StartQueue(config.Queue{Workers: 2, Size: 20, CoalesceWindow: config.Duration(100 * time.Millisecond), CoalesceMaxDelay: config.Duration(5 * time.Second)})
+	createEnv("coalesceinstancearn", "coalescetask", "coalesceinstanceid", "10.0.0.12", 8200)
+	defer ecsM.RemoveTask("coalescetask-arn")
+	before := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["coalescetask__backend"], &before); err != nil {
+		t.Fatal(err)
+	}
+
+	// a deploy replaces the task on 8200 with tasks on 8201 and 8204. The
+	// tasks on 8202 and 8203 stop again before the deploy is done
+	events := []struct {
+		port   int
+		status string
+	}{
+		{8201, Running}, {8202, Running}, {8203, Running}, {8202, Stopped},
+		{8204, Running}, {8203, Stopped}, {8200, Stopped},
+	}
+	for i, e := range events {
+		id := "TestCoalesce::" + strconv.Itoa(i)
+		detail := Detail{
+			Group:                "service:coalescetask",
+			ContainerInstanceArn: "coalesceinstancearn",
+			DesiredStatus:        e.status,
+			LastStatus:           e.status,
+			TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/coalesce" + strconv.Itoa(e.port),
+			Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: e.port}}}},
+		}
+		if err := EnqueueSNS(id, ioutil.NopCloser(snsEventBody(Event{ID: id, Detail: detail}))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DrainQueue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	after := BackendItem{}
+	if err := dynamodbattribute.UnmarshalMap(dynamodbM.Items["coalescetask__backend"], &after); err != nil {
+		t.Fatal(err)
+	}
+	servers := make([]string, 0)
+	for addr := range after.Backend.Servers {
+		servers = append(servers, addr)
+	}
+	sort.Strings(servers)
+	if strings.Join(servers, ",") != "10.0.0.12:8201,10.0.0.12:8204" {
+		t.Errorf("expected the last state of every task, got %v", servers)
+	}
+	if after.Version != before.Version+1 {
+		t.Errorf("expected one update of the backend, got %d", after.Version-before.Version)
+	}
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CheckOK means a dependency can be used
+	CheckOK = "ok"
+	// CheckFailed means a dependency can't be used
+	CheckFailed = "failed"
+	// CheckSkipped means a dependency isn't checked, like sns without auth.topicArns
+	CheckSkipped = "skipped"
+)
+
+// Check is the result of checking a single dependency
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Millis is how long the check took
+	Millis int64 `json:"millis"`
+}
+
+// Readiness is the result of checking every dependency
+type Readiness struct {
+	Ready  bool    `json:"ready"`
+	Checks []Check `json:"checks"`
+}
+
+// readyCheck checks one dependency and describes what it found
+type readyCheck struct {
+	name  string
+	check func(ctx aws.Context) (string, error)
+	// skipped is why a dependency isn't checked
+	skipped string
+}
+
+// HandleReady checks every dependency at once with cheap calls, each limited
+// to ready.timeout: the traefik table, every tracked cluster, the ec2 api each
+// cluster uses and the sns subscriptions of auth.topicArns
+func HandleReady() Readiness {
+	req := newRequest("Ready::" + strconv.FormatInt(time.Now().Unix(), 10))
+	checks := req.readyChecks()
+
+	readiness := Readiness{Ready: true, Checks: make([]Check, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readyCheck) {
+			defer wg.Done()
+			readiness.Checks[i] = req.runCheck(c)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, c := range readiness.Checks {
+		if c.Status == CheckFailed {
+			readiness.Ready = false
+			req.warn("not ready: " + c.Name + ": " + c.Detail)
+		}
+	}
+	return readiness
+}
+
+// readyChecks lists the checks of every dependency
+func (req *request) readyChecks() []readyCheck {
+	checks := []readyCheck{{name: "dynamodb", check: req.checkTable}}
+	for _, c := range req.util.Clusters {
+		creq := req.forCluster(c)
+		name := clusterName(c.Name)
+		checks = append(checks,
+			readyCheck{name: "ecs:" + name, check: creq.checkCluster},
+			readyCheck{name: "ec2:" + name, check: creq.checkEC2},
+		)
+	}
+	switch {
+	case len(req.util.TopicArns) == 0:
+		return append(checks, readyCheck{name: "sns", skipped: "auth.topicArns is empty"})
+	case req.util.SNS == nil:
+		return append(checks, readyCheck{name: "sns", skipped: "no sns client"})
+	}
+	for _, topicArn := range req.util.TopicArns {
+		topicArn := topicArn
+		checks = append(checks, readyCheck{name: "sns:" + topicArn, check: func(ctx aws.Context) (string, error) {
+			return req.checkSubscription(ctx, topicArn)
+		}})
+	}
+	return checks
+}
+
+// runCheck runs a check limited to the ready timeout
+func (req *request) runCheck(c readyCheck) Check {
+	if c.skipped != "" {
+		return Check{Name: c.name, Status: CheckSkipped, Detail: c.skipped}
+	}
+	ctx, cancel := context.WithTimeout(req.ctx, time.Duration(req.util.Ready.Timeout))
+	defer cancel()
+	start := time.Now()
+	detail, err := c.check(ctx)
+	result := Check{Name: c.name, Status: CheckOK, Detail: detail, Millis: time.Since(start).Nanoseconds() / int64(time.Millisecond)}
+	if err != nil {
+		result.Status, result.Detail = CheckFailed, err.Error()
+	}
+	return result
+}
+
+// checkTable checks the traefik table exists, is keyed by id and can be used
+func (req *request) checkTable(ctx aws.Context) (string, error) {
+	status, err := req.describeTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	if status != dynamodb.TableStatusActive && status != dynamodb.TableStatusUpdating {
+		return "", errors.New("table " + req.util.TraefikTable + " is " + status)
+	}
+	return "table " + req.util.TraefikTable + " is " + status, nil
+}
+
+// checkCluster checks the requests cluster exists and is active
+func (req *request) checkCluster(ctx aws.Context) (string, error) {
+	resp, err := req.cluster.ECS.DescribeClustersWithContext(ctx, &ecs.DescribeClustersInput{
+		Clusters: []*string{aws.String(req.cluster.Name)},
+	})
+	if err != nil {
+		return "", errors.Wrap(classify(err), "ecs.DescribeClusters()")
+	}
+	if len(resp.Clusters) == 0 {
+		return "", errors.Wrap(ErrItemNotFound, "cluster "+req.cluster.Name)
+	}
+	status := aws.StringValue(resp.Clusters[0].Status)
+	if status != "ACTIVE" {
+		return "", errors.New("cluster " + req.cluster.Name + " is " + status)
+	}
+	return "cluster is ACTIVE", nil
+}
+
+// checkEC2 checks the ec2 api of the requests cluster can be reached
+func (req *request) checkEC2(ctx aws.Context) (string, error) {
+	_, err := req.cluster.EC2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		MaxResults: aws.Int64(5),
+	})
+	if err != nil {
+		return "", errors.Wrap(classify(err), "ec2.DescribeInstances()")
+	}
+	return "reachable", nil
+}
+
+// checkSubscription checks a topic has a confirmed http subscription, to
+// ready.endpoint when it is set
+func (req *request) checkSubscription(ctx aws.Context, topicArn string) (string, error) {
+	var subscriptions []*sns.Subscription
+	err := req.util.SNS.ListSubscriptionsByTopicPagesWithContext(ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicArn),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		subscriptions = append(subscriptions, page.Subscriptions...)
+		return !lastPage
+	})
+	if err != nil {
+		return "", errors.Wrap(classify(err), "sns.ListSubscriptionsByTopic()")
+	}
+	pending := false
+	for _, s := range subscriptions {
+		protocol, endpoint := aws.StringValue(s.Protocol), aws.StringValue(s.Endpoint)
+		if protocol != "http" && protocol != "https" {
+			continue
+		}
+		if req.util.Ready.Endpoint != "" && endpoint != req.util.Ready.Endpoint {
+			continue
+		}
+		// unconfirmed subscriptions have no arn yet
+		if aws.StringValue(s.SubscriptionArn) == "PendingConfirmation" {
+			pending = true
+			continue
+		}
+		return "subscribed " + endpoint, nil
+	}
+	if pending {
+		return "", errors.New("subscription is pending confirmation")
+	}
+	return "", errors.Wrap(ErrItemNotFound, "no confirmed http subscription")
+}
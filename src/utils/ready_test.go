@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+const readyTopic = "arn:aws:sns:us-east-1:123456789012:ecs-events"
+
+func readyStatuses(readiness Readiness) map[string]string {
+	statuses := make(map[string]string)
+	for _, c := range readiness.Checks {
+		statuses[c.Name] = c.Status
+	}
+	return statuses
+}
+
+func TestHandleReady(t *testing.T) {
+	cluster := accountCluster("", "ready-instance-arn", "i-ready", "10.10.0.1")
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	snsMock := &utils_test.SnsMock{Subscriptions: map[string][]*sns.Subscription{
+		readyTopic: {
+			{Protocol: aws.String("sqs"), Endpoint: aws.String("arn:aws:sqs:us-east-1:123456789012:audit"), SubscriptionArn: aws.String(readyTopic + ":1")},
+			{Protocol: aws.String("https"), Endpoint: aws.String("https://tracker.example.com/event"), SubscriptionArn: aws.String(readyTopic + ":2")},
+		},
+	}}
+	defer withTable(table)()
+	defer withClusters([]*Cluster{cluster}, NamePolicyService)()
+	defer withUtil(func(u *Util) {
+		u.SNS, u.TopicArns = snsMock, []string{readyTopic}
+		u.Ready = config.Ready{Timeout: config.Duration(time.Second), Endpoint: "https://tracker.example.com/event"}
+	})()
+
+	// the table is missing
+	readiness := HandleReady()
+	statuses := readyStatuses(readiness)
+	if readiness.Ready || statuses["dynamodb"] != CheckFailed {
+		t.Errorf("expected the missing table to fail, got %+v", readiness)
+	}
+	for _, name := range []string{"ecs:web", "ec2:web", "sns:" + readyTopic} {
+		if statuses[name] != CheckOK {
+			t.Errorf("expected %s to be ok, got %+v", name, readiness)
+		}
+	}
+
+	if err := BootstrapTable(config.Tables{Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	if readiness := HandleReady(); !readiness.Ready {
+		t.Errorf("expected to be ready, got %+v", readiness)
+	}
+
+	cluster.ECS.(*utils_test.EcsMock).ClusterStatus = "INACTIVE"
+	snsMock.Subscriptions[readyTopic][1].SubscriptionArn = aws.String("PendingConfirmation")
+	readiness = HandleReady()
+	statuses = readyStatuses(readiness)
+	if readiness.Ready || statuses["ecs:web"] != CheckFailed || statuses["sns:"+readyTopic] != CheckFailed {
+		t.Errorf("expected the inactive cluster and pending subscription to fail, got %+v", readiness)
+	}
+}
+
+func TestHandleReadyWithoutTopics(t *testing.T) {
+	defer withUtil(func(u *Util) { u.TopicArns = nil })()
+	if status := readyStatuses(HandleReady())["sns"]; status != CheckSkipped {
+		t.Errorf("expected sns to be skipped without topics, got %q", status)
+	}
+}
@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// clock is the time retries see so tests don't have to sleep
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// retryPolicy is exponential backoff with full jitter. It is shared by the
+// aws clients, through NewRetryer, and the optimistic locking loops
+type retryPolicy struct {
+	// maxTries is how many times an operation is attempted in total
+	maxTries int
+	// baseDelay is the most the first retry waits. Each retry doubles it
+	baseDelay time.Duration
+	// maxDelay caps the wait before a single retry
+	maxDelay time.Duration
+	// maxElapsed is how long an operation may take including its retries. Zero is no limit
+	maxElapsed time.Duration
+	clock      clock
+
+	mutex *sync.Mutex
+	rand  *rand.Rand
+}
+
+// newRetryPolicy creates the retry policy of a configuration
+func newRetryPolicy(cfg config.Retry) *retryPolicy {
+	return &retryPolicy{
+		maxTries:   cfg.MaxTries,
+		baseDelay:  time.Duration(cfg.Delay),
+		maxDelay:   time.Duration(cfg.MaxDelay),
+		maxElapsed: time.Duration(cfg.MaxElapsed),
+		clock:      realClock{},
+		mutex:      &sync.Mutex{},
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// backoff is how long to wait before retry number attempt, counting from zero.
+// It is random between zero and the exponential delay so retries that failed
+// together don't retry together
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.baseDelay
+	for i := 0; i < attempt && ceiling < p.maxDelay; i++ {
+		ceiling *= 2
+	}
+	if p.maxDelay > 0 && ceiling > p.maxDelay {
+		ceiling = p.maxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return time.Duration(p.rand.Int63n(int64(ceiling) + 1))
+}
+
+// isThrottle checks whether an error is aws asking to slow down
+func isThrottle(err error) bool {
+	return awsrequest.IsErrorThrottle(errors.Cause(err))
+}
+
+// isTransient checks whether an aws call failed in a way that may pass if it is
+// sent again, like throttling, 5xx responses and connection errors
+func isTransient(err error) bool {
+	// the sdk treats errors it doesn't know as retryable
+	cause, ok := errors.Cause(err).(awserr.Error)
+	return ok && (isThrottle(cause) || awsrequest.IsErrorRetryable(cause))
+}
+
+// do runs op until it succeeds, fails with an error retryable doesn't accept,
+// has been tried maxTries times or the next retry would go past maxElapsed
+func (p *retryPolicy) do(retryable func(error) bool, op func() error) error {
+	start := p.clock.Now()
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt+1 >= p.maxTries {
+			return errors.Wrap(err, "tried "+strconv.Itoa(attempt+1)+" times")
+		}
+		delay := p.backoff(attempt)
+		if p.maxElapsed > 0 && p.clock.Now().Add(delay).Sub(start) > p.maxElapsed {
+			return errors.Wrap(err, "gave up after "+p.clock.Now().Sub(start).String())
+		}
+		p.clock.Sleep(delay)
+	}
+}
+
+// retryer adapts the retry policy of the current settings to the retries of the
+// aws sdk so reloads change how aws calls are retried too
+type retryer struct {
+	fallback *retryPolicy
+}
+
+// NewRetryer creates a retryer for aws clients that retries throttling and
+// transient errors with the backoff of the retry configuration. cfg is used
+// until Init is called
+func NewRetryer(cfg config.Retry) awsrequest.Retryer {
+	return retryer{fallback: newRetryPolicy(cfg)}
+}
+
+func (r retryer) policy() *retryPolicy {
+	if util, ok := current.Load().(*Util); ok && util.retry != nil {
+		return util.retry
+	}
+	return r.fallback
+}
+
+// MaxRetries is how many times a request is retried after the first attempt
+func (r retryer) MaxRetries() int {
+	if r.policy().maxTries < 1 {
+		return 0
+	}
+	return r.policy().maxTries - 1
+}
+
+// RetryRules is how long to wait before retrying a request
+func (r retryer) RetryRules(req *awsrequest.Request) time.Duration {
+	return r.policy().backoff(req.RetryCount)
+}
+
+// ShouldRetry checks whether a request failed in a way worth retrying and
+// there is time left to retry it
+func (r retryer) ShouldRetry(req *awsrequest.Request) bool {
+	if req.Retryable != nil {
+		return *req.Retryable
+	}
+	policy := r.policy()
+	if policy.maxElapsed > 0 && policy.clock.Now().Sub(req.Time) > policy.maxElapsed {
+		return false
+	}
+	return isTransient(req.Error)
+}
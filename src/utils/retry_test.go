@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/pkg/errors"
+)
+
+// fakeClock only moves when something sleeps
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func testRetryPolicy(maxTries int, maxElapsed time.Duration) (*retryPolicy, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	return &retryPolicy{
+		maxTries:   maxTries,
+		baseDelay:  100 * time.Millisecond,
+		maxDelay:   time.Second,
+		maxElapsed: maxElapsed,
+		clock:      clock,
+		mutex:      &sync.Mutex{},
+		rand:       rand.New(rand.NewSource(1)),
+	}, clock
+}
+
+var errConflict = errors.Wrap(classify(awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "version", nil)), "dynamodb.UpdateItem()")
+
+func TestBackoff(t *testing.T) {
+	policy, _ := testRetryPolicy(10, 0)
+	for attempt, ceiling := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		for i := 0; i < 50; i++ {
+			if delay := policy.backoff(attempt); delay < 0 || delay > ceiling {
+				t.Fatalf("retry %d waited %s, expected at most %s", attempt, delay, ceiling)
+			}
+		}
+	}
+}
+
+func TestRetryDoMaxTries(t *testing.T) {
+	policy, clock := testRetryPolicy(4, 0)
+	calls := 0
+	err := policy.do(isVersionConflict, func() error {
+		calls++
+		return errConflict
+	})
+	if calls != 4 || len(clock.sleeps) != 3 {
+		t.Errorf("expected 4 tries and 3 sleeps, got %d and %d", calls, len(clock.sleeps))
+	}
+	if !isVersionConflict(err) {
+		t.Errorf("expected the last conflict, got %v", err)
+	}
+}
+
+func TestRetryDoMaxElapsed(t *testing.T) {
+	policy, clock := testRetryPolicy(1000, 3*time.Second)
+	err := policy.do(isVersionConflict, func() error { return errConflict })
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if elapsed := clock.now.Sub(time.Unix(0, 0)); elapsed > 3*time.Second {
+		t.Errorf("retried for %s, past the 3s limit", elapsed)
+	}
+	if len(clock.sleeps) == 0 || len(clock.sleeps) >= 999 {
+		t.Errorf("expected the time limit to stop the retries, slept %d times", len(clock.sleeps))
+	}
+}
+
+func TestRetryDoStops(t *testing.T) {
+	policy, clock := testRetryPolicy(10, 0)
+	calls := 0
+	err := policy.do(isVersionConflict, func() error {
+		calls++
+		if calls == 1 {
+			return errConflict
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("expected success on the second try, got %v after %d", err, calls)
+	}
+
+	calls = 0
+	clock.sleeps = nil
+	err = policy.do(isVersionConflict, func() error {
+		calls++
+		return errors.New("validation failed")
+	})
+	if err == nil || calls != 1 || len(clock.sleeps) != 0 {
+		t.Errorf("expected no retries of a permanent error, got %d tries", calls)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	cases := []struct {
+		err       error
+		transient bool
+		kind      error
+	}{
+		{awserr.New("ThrottlingException", "slow down", nil), true, ErrThrottled},
+		{errors.Wrap(awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil), "dynamodb.GetItem()"), true, ErrThrottled},
+		{awserr.New(awsrequest.ErrCodeRequestError, "connection reset", nil), true, nil},
+		{awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "version", nil), false, ErrVersionConflict},
+		{awserr.New(servicediscovery.ErrCodeInstanceNotFound, "gone", nil), false, ErrItemNotFound},
+		{awserr.New(dynamodb.ErrCodeResourceNotFoundException, "no table", nil), false, ErrTableNotFound},
+		{awserr.New("ValidationException", "bad key", nil), false, nil},
+		{errors.Wrap(ErrItemNotFound, "service api"), false, ErrItemNotFound},
+	}
+	kinds := []error{ErrThrottled, ErrVersionConflict, ErrItemNotFound, ErrTableNotFound}
+	for _, c := range cases {
+		if transient := isTransient(c.err); transient != c.transient {
+			t.Errorf("%v: transient %v want %v", c.err, transient, c.transient)
+		}
+		err := errors.Wrap(classify(c.err), "call()")
+		for _, kind := range kinds {
+			if is := errors.Is(err, kind); is != (kind == c.kind) {
+				t.Errorf("%v: errors.Is(%v) %v", c.err, kind, is)
+			}
+		}
+		if errors.Cause(err) != errors.Cause(c.err) {
+			t.Errorf("%v: classifying hid the cause %v", c.err, errors.Cause(err))
+		}
+	}
+}
+
+func TestRetryerShouldRetry(t *testing.T) {
+	policy, clock := testRetryPolicy(3, time.Minute)
+	r := retryer{fallback: policy}
+	defer withUtil(func(u *Util) { u.retry = policy })()
+
+	req := &awsrequest.Request{Time: clock.now, Error: awserr.New("ThrottlingException", "slow down", nil)}
+	if !r.ShouldRetry(req) {
+		t.Error("expected throttling to be retried")
+	}
+	clock.Sleep(2 * time.Minute)
+	if r.ShouldRetry(req) {
+		t.Error("expected no retries past the time limit")
+	}
+	if r.MaxRetries() != 2 {
+		t.Errorf("expected 2 retries, got %d", r.MaxRetries())
+	}
+}
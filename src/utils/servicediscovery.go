@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/aws/aws-sdk-go/service/servicediscovery/servicediscoveryiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CloudMapTaskArnAttribute is the custom attribute holding the task arn of a cloud map instance
+	CloudMapTaskArnAttribute = "ECS_TASK_ARN"
+	// cloudMapMissTTL is how long a backend without a cloud map service is
+	// remembered so a service created in the meantime is picked up
+	cloudMapMissTTL = time.Minute
+)
+
+// cloudMap registers the tasks of each backend as instances of the
+// cloud map service with the same name in a namespace
+type cloudMap struct {
+	client      servicediscoveryiface.ServiceDiscoveryAPI
+	namespaceID string
+	serviceIDs  map[string]string
+	// misses are when backends were found to have no service
+	misses map[string]time.Time
+	clock  clock
+}
+
+// NewCloudMap creates a Sink that registers and deregisters tasks in AWS Cloud Map
+// alongside dynamodb. Each backend maps to the cloud map service with the same name
+// in the namespace
+func NewCloudMap(client servicediscoveryiface.ServiceDiscoveryAPI, namespaceID string) Sink {
+	return &cloudMap{
+		client:      client,
+		namespaceID: namespaceID,
+		serviceIDs:  make(map[string]string),
+		misses:      make(map[string]time.Time),
+		clock:       realClock{},
+	}
+}
+
+// instanceID is the id of the cloud map instance for a task
+// which is the id at the end of the task arn
+func instanceID(taskArn string) string {
+	parts := strings.Split(taskArn, "/")
+	return parts[len(parts)-1]
+}
+
+// getServiceID gets the id of the cloud map service named after the ecs service
+// returns an empty string if the namespace has no such service. Both are
+// cached, services that are missing for cloudMapMissTTL. The caches start over
+// on reload since the sinks are created again
+func (c *cloudMap) getServiceID(req *request, service string) (string, error) {
+	req.util.Mutex.Lock()
+	if id, exists := c.serviceIDs[service]; exists {
+		req.util.Mutex.Unlock()
+		return id, nil
+	}
+	if missed, exists := c.misses[service]; exists && c.clock.Now().Sub(missed) < cloudMapMissTTL {
+		req.util.Mutex.Unlock()
+		return "", nil
+	}
+	req.util.Mutex.Unlock()
+
+	serviceID := ""
+	params := &servicediscovery.ListServicesInput{
+		Filters: []*servicediscovery.ServiceFilter{
+			{
+				Name:      aws.String(servicediscovery.ServiceFilterNameNamespaceId),
+				Condition: aws.String(servicediscovery.FilterConditionEq),
+				Values:    []*string{aws.String(c.namespaceID)},
+			},
+		},
+	}
+	err := c.client.ListServicesPagesWithContext(req.ctx, params,
+		func(page *servicediscovery.ListServicesOutput, lastPage bool) bool {
+			for _, summary := range page.Services {
+				if aws.StringValue(summary.Name) == service {
+					serviceID = aws.StringValue(summary.Id)
+					return false
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		req.debug("error listing cloud map services")
+		return "", errors.Wrap(classify(err), "servicediscovery.ListServicesPages()")
+	}
+	req.util.Mutex.Lock()
+	defer req.util.Mutex.Unlock()
+	if serviceID == "" {
+		c.misses[service] = c.clock.Now()
+		return "", nil
+	}
+	delete(c.misses, service)
+	c.serviceIDs[service] = serviceID
+	return serviceID, nil
+}
+
+func (c *cloudMap) register(req *request, service string, address taskAddress) error {
+	serviceID, err := c.getServiceID(req, service)
+	if err != nil {
+		return errors.Wrap(err, "getServiceID("+service+")")
+	}
+	if serviceID == "" {
+		req.debug("no cloud map service for " + service + ". skipping register")
+		return nil
+	}
+	params := &servicediscovery.RegisterInstanceInput{
+		ServiceId:  aws.String(serviceID),
+		InstanceId: aws.String(instanceID(address.TaskArn)),
+		Attributes: map[string]*string{
+			"AWS_INSTANCE_IPV4":      aws.String(address.IP),
+			"AWS_INSTANCE_PORT":      aws.String(strconv.FormatInt(address.Port, 10)),
+			CloudMapTaskArnAttribute: aws.String(address.TaskArn),
+		},
+	}
+	_, err = c.client.RegisterInstanceWithContext(req.ctx, params)
+	if err != nil {
+		req.debug("error registering instance in cloud map: " + address.TaskArn)
+		return errors.Wrap(classify(err), "servicediscovery.RegisterInstance()")
+	}
+	req.debug("registered " + address.String() + " in cloud map service " + service)
+	return nil
+}
+
+func (c *cloudMap) deregister(req *request, service string, address taskAddress) error {
+	serviceID, err := c.getServiceID(req, service)
+	if err != nil {
+		return errors.Wrap(err, "getServiceID("+service+")")
+	}
+	if serviceID == "" {
+		req.debug("no cloud map service for " + service + ". skipping deregister")
+		return nil
+	}
+	return c.deregisterInstance(req, serviceID, instanceID(address.TaskArn))
+}
+
+func (c *cloudMap) deregisterInstance(req *request, serviceID, id string) error {
+	params := &servicediscovery.DeregisterInstanceInput{
+		ServiceId:  aws.String(serviceID),
+		InstanceId: aws.String(id),
+	}
+	_, err := c.client.DeregisterInstanceWithContext(req.ctx, params)
+	if err != nil {
+		err = classify(err)
+		// the instance is already gone
+		if errors.Is(err, ErrItemNotFound) {
+			return nil
+		}
+		req.debug("error deregistering instance from cloud map: " + id)
+		return errors.Wrap(err, "servicediscovery.DeregisterInstance()")
+	}
+	req.debug("deregistered instance " + id + " from cloud map")
+	return nil
+}
+
+// sync registers every task that is missing or has moved and
+// deregisters every instance that no longer has a task
+func (c *cloudMap) sync(req *request, service string, addresses []taskAddress) error {
+	serviceID, err := c.getServiceID(req, service)
+	if err != nil {
+		return errors.Wrap(err, "getServiceID("+service+")")
+	}
+	if serviceID == "" {
+		req.debug("no cloud map service for " + service + ". skipping sync")
+		return nil
+	}
+
+	registered := make(map[string]map[string]*string)
+	params := &servicediscovery.ListInstancesInput{
+		ServiceId: aws.String(serviceID),
+	}
+	err = c.client.ListInstancesPagesWithContext(req.ctx, params,
+		func(page *servicediscovery.ListInstancesOutput, lastPage bool) bool {
+			for _, instance := range page.Instances {
+				registered[aws.StringValue(instance.Id)] = instance.Attributes
+			}
+			return !lastPage
+		})
+	if err != nil {
+		req.debug("error listing cloud map instances for " + service)
+		return errors.Wrap(classify(err), "servicediscovery.ListInstancesPages()")
+	}
+
+	for _, address := range addresses {
+		id := instanceID(address.TaskArn)
+		attributes, exists := registered[id]
+		delete(registered, id)
+		if exists &&
+			aws.StringValue(attributes["AWS_INSTANCE_IPV4"]) == address.IP &&
+			aws.StringValue(attributes["AWS_INSTANCE_PORT"]) == strconv.FormatInt(address.Port, 10) {
+			continue
+		}
+		if err := c.register(req, service, address); err != nil {
+			return errors.Wrap(err, "register("+service+")")
+		}
+	}
+
+	// anything left over that was registered by us no longer has a task behind it
+	for id, attributes := range registered {
+		if _, ours := attributes[CloudMapTaskArnAttribute]; !ours {
+			continue
+		}
+		if err := c.deregisterInstance(req, serviceID, id); err != nil {
+			return errors.Wrap(err, "deregisterInstance("+id+")")
+		}
+	}
+	return nil
+}
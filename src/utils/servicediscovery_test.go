@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func newServiceDiscoveryMock() (*utils_test.ServiceDiscoveryMock, func()) {
+	sdM := &utils_test.ServiceDiscoveryMock{
+		Services:  make(map[string]string),
+		Instances: make(map[string]map[string]map[string]*string),
+	}
+	restore := withUtil(func(u *Util) {
+		u.Sinks = []Sink{NewCloudMap(sdM, "test-namespace")}
+	})
+	return sdM, restore
+}
+
+func snsBody(detail Detail) *bytes.Reader {
+	return snsEventBody(Event{Detail: detail})
+}
+
+func snsEventBody(event Event) *bytes.Reader {
+	msg, _ := json.Marshal(&event)
+	notificationEncoded, _ := json.Marshal(&Notification{Message: string(msg[:])})
+	return bytes.NewReader(notificationEncoded)
+}
+
+func TestCloudMapRegisterAndDeregister(t *testing.T) {
+	sdM, restore := newServiceDiscoveryMock()
+	defer restore()
+
+	instanceArn, taskName, instanceID, instanceIP, hostPort := "myinstancearn", "cloudmaptask", "instanceid", "10.0.0.4", 8081
+	createEnv(instanceArn, taskName, instanceID, instanceIP, hostPort)
+	sdM.AddService(taskName, "srv-cloudmaptask")
+
+	detail := Detail{
+		Group:                "service:" + taskName,
+		ContainerInstanceArn: instanceArn,
+		DesiredStatus:        Running,
+		LastStatus:           Running,
+		TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/abc123",
+		Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: hostPort}}}},
+	}
+	_, err := HandleSNS("TestCloudMap::Add", ioutil.NopCloser(snsBody(detail)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes, ok := sdM.Instances["srv-cloudmaptask"]["abc123"]
+	if !ok {
+		t.Fatal("instance was not registered in cloud map")
+	}
+	if *attributes["AWS_INSTANCE_IPV4"] != instanceIP || *attributes["AWS_INSTANCE_PORT"] != "8081" {
+		t.Fatalf("unexpected attributes: %s:%s", *attributes["AWS_INSTANCE_IPV4"], *attributes["AWS_INSTANCE_PORT"])
+	}
+	if *attributes[CloudMapTaskArnAttribute] != detail.TaskArn {
+		t.Fatal("task arn attribute not set")
+	}
+
+	detail.DesiredStatus = Stopped
+	_, err = HandleSNS("TestCloudMap::Remove", ioutil.NopCloser(snsBody(detail)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sdM.Instances["srv-cloudmaptask"]["abc123"]; ok {
+		t.Fatal("instance was not deregistered from cloud map")
+	}
+}
+
+func TestCloudMapSync(t *testing.T) {
+	sdM, restore := newServiceDiscoveryMock()
+	defer restore()
+
+	instanceArn, taskName, instanceID, instanceIP, hostPort := "myinstancearn", "cloudmapsync", "instanceid", "10.0.0.4", 8082
+	createEnv(instanceArn, taskName, instanceID, instanceIP, hostPort)
+	sdM.AddService(taskName, "srv-cloudmapsync")
+	stale := "arn:aws:ecs:us-east-1:123456789012:task/stale"
+	sdM.Instances["srv-cloudmapsync"]["stale"] = map[string]*string{CloudMapTaskArnAttribute: &stale}
+	sdM.Instances["srv-cloudmapsync"]["manual"] = map[string]*string{}
+
+	_, err := HandleSync("", taskName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := sdM.Instances["srv-cloudmapsync"]
+	if _, ok := instances["stale"]; ok {
+		t.Error("stale instance was not deregistered")
+	}
+	if _, ok := instances["manual"]; !ok {
+		t.Error("instance not registered by the tracker was deregistered")
+	}
+	if _, ok := instances[taskName+"-arn"]; !ok {
+		t.Error("running task was not registered")
+	}
+}
+
+func TestCloudMapMissingServiceCached(t *testing.T) {
+	sdM, restore := newServiceDiscoveryMock()
+	defer restore()
+	sink := NewCloudMap(sdM, "test-namespace").(*cloudMap)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	sink.clock = clock
+	req := newRequest("TestCloudMapMissingServiceCached")
+
+	for i := 0; i < 2; i++ {
+		if id, err := sink.getServiceID(req, "late"); err != nil || id != "" {
+			t.Fatalf("expected no service, got %q %v", id, err)
+		}
+	}
+	if sdM.ServiceLists != 1 {
+		t.Errorf("expected the missing service to be looked up once, got %d", sdM.ServiceLists)
+	}
+
+	sdM.AddService("late", "srv-late")
+	clock.now = clock.now.Add(cloudMapMissTTL)
+	if id, err := sink.getServiceID(req, "late"); err != nil || id != "srv-late" {
+		t.Errorf("expected the service created later to be found, got %q %v", id, err)
+	}
+	if sdM.ServiceLists != 2 {
+		t.Errorf("expected the miss to expire, got %d lookups", sdM.ServiceLists)
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+)
+
+// tableActiveTimeout is how long a created table has to become active
+const tableActiveTimeout = 5 * time.Minute
+
+// BootstrapTable verifies the traefik table has the id hash key traefik reads
+// items by and, when tables.create is set, creates it if it is missing. It does
+// nothing unless tables.verify or tables.create is set
+func BootstrapTable(cfg config.Tables) error {
+	if !cfg.Verify && !cfg.Create {
+		return nil
+	}
+	req := newRequest("BootstrapTable::" + strconv.FormatInt(time.Now().Unix(), 10)).withDryRun(false)
+	_, err := req.describeTable(req.ctx)
+	if errors.Is(err, ErrTableNotFound) && cfg.Create {
+		if req.dryRun() {
+			req.log("dry run: would create table " + req.util.TraefikTable)
+			return nil
+		}
+		if err := req.createTable(cfg.Tags); err != nil {
+			return errors.Wrap(err, "createTable()")
+		}
+		_, err = req.waitForTable(tableActiveTimeout)
+	}
+	if err != nil {
+		return errors.Wrap(err, "table "+req.util.TraefikTable)
+	}
+	req.log("table " + req.util.TraefikTable + " is ready")
+	return nil
+}
+
+// describeTable gets the status of the traefik table, like ACTIVE or UPDATING,
+// and checks its key schema
+func (req *request) describeTable(ctx aws.Context) (string, error) {
+	resp, err := req.util.DynamoDB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(req.util.TraefikTable),
+	})
+	if err != nil {
+		return "", errors.Wrap(classify(err), "dynamodb.DescribeTable()")
+	}
+	table := resp.Table
+	if err := checkKeySchema(table); err != nil {
+		return aws.StringValue(table.TableStatus), err
+	}
+	return aws.StringValue(table.TableStatus), nil
+}
+
+// checkKeySchema checks a table is keyed by nothing but a string id like traefik expects
+func checkKeySchema(table *dynamodb.TableDescription) error {
+	if len(table.KeySchema) != 1 ||
+		aws.StringValue(table.KeySchema[0].AttributeName) != "id" ||
+		aws.StringValue(table.KeySchema[0].KeyType) != dynamodb.KeyTypeHash {
+		return errors.Wrap(ErrInvalidTable, "key schema must be a single id hash key")
+	}
+	for _, attribute := range table.AttributeDefinitions {
+		if aws.StringValue(attribute.AttributeName) == "id" && aws.StringValue(attribute.AttributeType) != dynamodb.ScalarAttributeTypeS {
+			return errors.Wrap(ErrInvalidTable, "id must be a string")
+		}
+	}
+	return nil
+}
+
+// createTable creates the traefik table with on-demand billing
+func (req *request) createTable(tags map[string]string) error {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := &dynamodb.CreateTableInput{
+		TableName:   aws.String(req.util.TraefikTable),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	}
+	for _, key := range keys {
+		params.Tags = append(params.Tags, &dynamodb.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	if _, err := req.util.DynamoDB.CreateTableWithContext(req.ctx, params); err != nil {
+		return errors.Wrap(classify(err), "dynamodb.CreateTable()")
+	}
+	req.log("created table " + req.util.TraefikTable)
+	return nil
+}
+
+// waitForTable waits until the traefik table is active
+func (req *request) waitForTable(timeout time.Duration) (string, error) {
+	clock := req.util.retry.clock
+	deadline := clock.Now().Add(timeout)
+	for {
+		status, err := req.describeTable(req.ctx)
+		if err != nil && !errors.Is(err, ErrTableNotFound) {
+			return status, err
+		}
+		if status == dynamodb.TableStatusActive {
+			return status, nil
+		}
+		if clock.Now().After(deadline) {
+			return status, errors.New("not active after " + timeout.String())
+		}
+		req.debug("waiting for table " + req.util.TraefikTable + " to become active")
+		clock.Sleep(2 * time.Second)
+	}
+}
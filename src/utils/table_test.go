@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils_test"
+)
+
+func withTable(table *utils_test.DynamodbMock) func() {
+	return withUtil(func(u *Util) {
+		u.DynamoDB, u.TraefikTable = table, "bootstrap"
+	})
+}
+
+func TestBootstrapTableCreate(t *testing.T) {
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withTable(table)()
+
+	if err := BootstrapTable(config.Tables{Create: true, Tags: map[string]string{"team": "edge", "env": "test"}}); err != nil {
+		t.Fatal(err)
+	}
+	if table.Table == nil || aws.StringValue(table.Table.BillingModeSummary.BillingMode) != dynamodb.BillingModePayPerRequest {
+		t.Fatalf("expected an on-demand table, got %v", table.Table)
+	}
+	if len(table.TableTags) != 2 || aws.StringValue(table.TableTags[0].Key) != "env" {
+		t.Errorf("expected the env and team tags, got %v", table.TableTags)
+	}
+	status, err := newRequest("TestBootstrapTableCreate").describeTable(aws.BackgroundContext())
+	if err != nil || status != dynamodb.TableStatusActive {
+		t.Errorf("expected an active table, got %s %v", status, err)
+	}
+
+	// an existing table is left alone
+	if err := BootstrapTable(config.Tables{Create: true}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBootstrapTableVerify(t *testing.T) {
+	table := &utils_test.DynamodbMock{Items: make(map[string]map[string]*dynamodb.AttributeValue)}
+	defer withTable(table)()
+
+	if err := BootstrapTable(config.Tables{}); err != nil {
+		t.Errorf("expected no checks without verify or create, got %v", err)
+	}
+	if err := BootstrapTable(config.Tables{Verify: true}); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected a missing table, got %v", err)
+	}
+	if table.Table != nil {
+		t.Error("verify created the table")
+	}
+
+	table.Table = &dynamodb.TableDescription{
+		TableName:   aws.String("bootstrap"),
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("name"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+	}
+	if err := BootstrapTable(config.Tables{Verify: true}); !errors.Is(err, ErrInvalidTable) {
+		t.Errorf("expected an invalid key schema, got %v", err)
+	}
+	if _, err := newRequest("TestBootstrapTableVerify").describeTable(aws.BackgroundContext()); !errors.Is(err, ErrInvalidTable) {
+		t.Errorf("expected the status to report the invalid key schema, got %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of this package
+const tracerName = "github.com/tskinn/ecs-task-tracker/src/utils"
+
+// tracer is looked up every time so a tracer provider installed later, like by
+// main or a test, is used
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startSpan creates a copy of a request whose aws calls and spans are children of
+// a new span. The span has everything known about the request as attributes
+func (req *request) startSpan(name string, attrs ...attribute.KeyValue) (*request, trace.Span) {
+	attrs = append(attrs, attribute.String("request.id", req.id))
+	if req.messageID != "" {
+		attrs = append(attrs, attribute.String("messaging.message.id", req.messageID))
+	}
+	if req.cluster != nil {
+		attrs = append(attrs, attribute.String("ecs.cluster", clusterName(req.cluster.Name)))
+	}
+	if req.service != "" {
+		attrs = append(attrs, attribute.String("ecs.service", req.service))
+	}
+	if req.taskArn != "" {
+		attrs = append(attrs, attribute.String("ecs.task.arn", req.taskArn))
+	}
+	sreq := *req
+	ctx, span := tracer().Start(req.ctx, name, trace.WithAttributes(attrs...))
+	sreq.ctx = ctx
+	return &sreq, span
+}
+
+// endSpan records err on a span, if there is one, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// annotate adds attributes to the span a request is in
+func (req *request) annotate(attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(req.ctx).SetAttributes(attrs...)
+}
+
+// cacheLookup records whether a lookup in one of the caches of aws responses
+// was answered from the cache
+func (req *request) cacheLookup(cache string, hit bool) {
+	trace.SpanFromContext(req.ctx).AddEvent("cache lookup", trace.WithAttributes(
+		attribute.String("cache.name", cache),
+		attribute.Bool("cache.hit", hit),
+	))
+}
+
+// TraceAWS adds a span to every call made by aws clients created with handlers
+// afterwards. Calls made with the context of a request are children of its span
+func TraceAWS(handlers *awsrequest.Handlers) {
+	handlers.Validate.PushFrontNamed(awsrequest.NamedHandler{Name: "tracing.Start", Fn: startAWSSpan})
+	// before the sdk clears the error of an attempt it retries
+	handlers.AfterRetry.PushFrontNamed(awsrequest.NamedHandler{Name: "tracing.Attempt", Fn: failedAWSAttempt})
+	handlers.Complete.PushBackNamed(awsrequest.NamedHandler{Name: "tracing.End", Fn: endAWSSpan})
+}
+
+func startAWSSpan(r *awsrequest.Request) {
+	ctx, _ := tracer().Start(r.Context(), r.ClientInfo.ServiceName+"."+r.Operation.Name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", r.ClientInfo.ServiceName),
+			attribute.String("rpc.method", r.Operation.Name),
+			attribute.String("cloud.region", aws.StringValue(r.Config.Region)),
+		))
+	r.SetContext(ctx)
+}
+
+func failedAWSAttempt(r *awsrequest.Request) {
+	if r.Error != nil {
+		trace.SpanFromContext(r.Context()).AddEvent("attempt failed", trace.WithAttributes(
+			attribute.Int("aws.retry_count", r.RetryCount),
+			attribute.String("error", r.Error.Error()),
+		))
+	}
+}
+
+func endAWSSpan(r *awsrequest.Request) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.Int("aws.retry_count", r.RetryCount),
+		attribute.String("aws.request_id", r.RequestID),
+	)
+	if r.HTTPResponse != nil {
+		span.SetAttributes(attribute.Int("http.status_code", r.HTTPResponse.StatusCode))
+	}
+	endSpan(span, r.Error)
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// withTracing records spans in memory until the returned func is called
+func withTracing() (*tracetest.InMemoryExporter, func()) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	return exporter, func() { otel.SetTracerProvider(noop.NewTracerProvider()) }
+}
+
+func spanNamed(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span in %v", name, exporter.GetSpans())
+	return tracetest.SpanStub{}
+}
+
+func attrValue(attrs []attribute.KeyValue, key string) attribute.Value {
+	for _, kv := range attrs {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceHandleSNS(t *testing.T) {
+	exporter, restore := withTracing()
+	defer restore()
+	createEnv("traceinstancearn", "tracetask", "traceinstanceid", "10.0.0.8", 8096)
+
+	detail := Detail{
+		Group:                "service:tracetask",
+		ContainerInstanceArn: "traceinstancearn",
+		DesiredStatus:        Running,
+		LastStatus:           Running,
+		TaskArn:              "arn:aws:ecs:us-east-1:123456789012:task/trace1",
+		Containers:           []Container{{NetworkBindings: []NetworkBinding{{HostPort: 8096}}}},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := HandleSNS("TestTrace::Add"+strconv.Itoa(i), ioutil.NopCloser(snsBody(detail)), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var spans []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "HandleSNS" {
+			spans = append(spans, span)
+		}
+	}
+	if len(spans) != 2 {
+		t.Fatalf("expected a HandleSNS span for each event, got %d", len(spans))
+	}
+	for key, want := range map[string]string{
+		"messaging.message.id": "TestTrace::Add0",
+		"ecs.task.arn":         detail.TaskArn,
+		"ecs.cluster":          "test",
+		"ecs.service":          "tracetask",
+	} {
+		if got := attrValue(spans[0].Attributes, key).AsString(); got != want {
+			t.Errorf("%s: got %q want %q", key, got, want)
+		}
+	}
+	// the second event finds the instance id of the container instance in the cache
+	for i, want := range []bool{false, true} {
+		hit := false
+		for _, event := range spans[i].Events {
+			if attrValue(event.Attributes, "cache.name").AsString() == "instance_ids" {
+				hit = attrValue(event.Attributes, "cache.hit").AsBool()
+			}
+		}
+		if hit != want {
+			t.Errorf("event %d: expected instance id cache hit %t", i, want)
+		}
+	}
+}
+
+func TestTraceSync(t *testing.T) {
+	exporter, restore := withTracing()
+	defer restore()
+	createEnv("traceinstancearn", "tracesync", "traceinstanceid", "10.0.0.8", 8097)
+
+	if _, err := HandleSync("", "tracesync", false); err != nil {
+		t.Fatal(err)
+	}
+	span := spanNamed(t, exporter, "sync")
+	if got := attrValue(span.Attributes, "ecs.service").AsString(); got != "tracesync" {
+		t.Errorf("expected the sync span to have the service, got %q", got)
+	}
+}
+
+func TestTraceAWS(t *testing.T) {
+	exporter, restore := withTracing()
+	defer restore()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		SleepDelay:  func(time.Duration) {},
+	}))
+	TraceAWS(&sess.Handlers)
+	svc := ecs.New(sess)
+	// fail the first attempt with a 500 and answer the retry
+	attempts := 0
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Send.PushBack(func(r *awsrequest.Request) {
+		attempts++
+		status, body := http.StatusOK, "{}"
+		if attempts == 1 {
+			status, body = http.StatusInternalServerError, ""
+			r.Error = awserr.New("InternalFailure", "try again", nil)
+		}
+		r.HTTPResponse = &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body))}
+	})
+
+	req, parent := newRequest("TestTraceAWS").startSpan("parent")
+	if _, err := svc.DescribeClustersWithContext(req.ctx, &ecs.DescribeClustersInput{}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	span := spanNamed(t, exporter, "ecs.DescribeClusters")
+	if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Error("the aws span is not a child of the span of the request")
+	}
+	if got := attrValue(span.Attributes, "aws.retry_count").AsInt64(); got != 1 {
+		t.Errorf("expected 1 retry, got %d", got)
+	}
+	if len(span.Events) != 1 || span.Events[0].Name != "attempt failed" {
+		t.Errorf("expected the failed attempt as an event, got %v", span.Events)
+	}
+}
@@ -1,22 +1,23 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
-	"path/filepath"
 	"reflect"
-	"runtime"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"github.com/containous/traefik/types"
 	"github.com/pkg/errors"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -24,16 +25,29 @@ const (
 	Running = "RUNNING"
 	// Stopped matches the stopped status of an ecs task
 	Stopped = "STOPPED"
-	// ErrNoNetworkBindings is thrown when there are not network bindings attached to a task
-	ErrNoNetworkBindings = "NoNetworkBindings"
-	// ErrItemNotFound is thrown when an item isn't found in the database
-	ErrItemNotFound = "ItemNotFound"
 )
 
-var util Util
+// current holds the *Util new requests are made with. It is replaced as a whole
+// on reload so requests that are in flight finish with the settings they started with
+var current atomic.Value
 
 type request struct {
-	id string
+	id      string
+	cluster *Cluster
+	util    *Util
+	// ctx carries the span of the request to aws calls
+	ctx context.Context
+	// messageID, service and taskArn are logged with every line when they are known
+	messageID string
+	service   string
+	taskArn   string
+	// plan collects the changes of a dry run. nil makes changes
+	plan *plan
+}
+
+// newRequest creates a request that uses the current settings
+func newRequest(id string) *request {
+	return &request{id: id, util: current.Load().(*Util), ctx: context.Background()}
 }
 
 // Util holds global configuraton for the utils package
@@ -41,37 +55,73 @@ type Util struct {
 	DynamoDB       dynamodbiface.DynamoDBAPI
 	EC2            ec2iface.EC2API
 	ECS            ecsiface.ECSAPI
-	ECSCluster     string
+	SNS            snsiface.SNSAPI
+	Clusters       []*Cluster
+	NamePolicy     string
+	WriteStrategy  string
 	HostNameTable  string
 	PrivateIPTable string
 	TraefikTable   string
-	MaxTries       int
+	Owner          string
+	Prune          config.Prune
+	Ready          config.Ready
+	Dedupe         config.Dedupe
+	dedupe         dedupeStore
+	deadLetters    deadLetterStore
+	capture        *captureFiles
+	TopicArns      []string
+	retry          *retryPolicy
+	filter         *serviceFilter
+	naming         *naming
+	TaskPolicy     string
+	TaskGroups     []config.TaskGroup
+	PortLabel      string
 	Mutex          *sync.Mutex
 	Debug          bool
+	Logger         Logger
+	levels         levels
+	DryRun         bool
+	Sinks          []Sink
+}
+
+// Sink is a service discovery registry that is kept up to date alongside
+// the traefik table in dynamodb
+type Sink interface {
+	// register adds the address of a task to a service
+	register(req *request, service string, address taskAddress) error
+	// deregister removes the address of a task from a service
+	deregister(req *request, service string, address taskAddress) error
+	// sync makes a service contain exactly the given addresses
+	sync(req *request, service string, addresses []taskAddress) error
 }
 
 // EndItem is a backend or frontend that will be marshalled into a dynamodb item
 type EndItem struct {
-	ID      string `dynamodbav:"id"`
-	Name    string `dynamodbav:"name"`
-	Version uint64 `dynamodbav:"version"`
+	ID      string `dynamodbav:"id" json:"id"`
+	Name    string `dynamodbav:"name" json:"name"`
+	Version uint64 `dynamodbav:"version" json:"version"`
 }
 
 // BackendItem will be marshaled into dynamodb item
 type BackendItem struct {
-	Backend types.Backend `dynamodbav:"backend"`
+	Backend types.Backend `dynamodbav:"backend" json:"backend"`
+	// Owner is the tracker that created the backend. Only owned backends are pruned
+	Owner string `dynamodbav:"owner,omitempty" json:"owner,omitempty"`
+	// OrphanedAt is the unix time pruning first found the backend orphaned
+	OrphanedAt int64 `dynamodbav:"orphanedAt,omitempty" json:"orphanedAt,omitempty"`
 	EndItem
 }
 
 // FrontendItem will be marshaled into dynamodb item
 type FrontendItem struct {
-	Frontend types.Frontend `dynamodbav:"frontend"`
+	Frontend types.Frontend `dynamodbav:"frontend" json:"frontend"`
 	EndItem
 }
 
 // NetworkBinding is ...
 type NetworkBinding struct {
-	HostPort int `json:"hostPort"`
+	ContainerPort int `json:"containerPort"`
+	HostPort      int `json:"hostPort"`
 }
 
 // Container is ...
@@ -89,6 +139,7 @@ type Detail struct {
 	DesiredStatus        string `json:"desiredStatus"`
 	Group                string `json:"group"`
 	LastStatus           string `json:"lastStatus"`
+	StartedBy            string `json:"startedBy"`
 	TaskArn              string `json:"taskArn"`
 	TaskDefinitionArn    string `json:"taskDefinitionArn"`
 	Containers           []Container
@@ -123,30 +174,89 @@ type Notification struct {
 }
 
 // Init sets the necesary values for this package to function properly
+// Clusters without their own ecs or ec2 clients use ecsSvc and ec2Svc
+// snsSvc is only used to check subscriptions and may be nil
 // This must be called before using this package!
-func Init(traefikTable, ecsCluster string,
-	maxTries int,
+func Init(cfg *config.Config,
+	clusters []*Cluster,
+	sinks []Sink,
 	dynamo dynamodbiface.DynamoDBAPI,
 	ec2Svc ec2iface.EC2API,
 	ecsSvc ecsiface.ECSAPI,
-	debugOn string) {
-	debug := false
-	if debugOn == "on" {
-		debug = true
-	}
-	util = Util{
-		TraefikTable: traefikTable,
-		ECSCluster:   ecsCluster,
-		MaxTries:     maxTries,
-		DynamoDB:     dynamo,
-		EC2:          ec2Svc,
-		ECS:          ecsSvc,
-		Mutex:        &sync.Mutex{},
-		Debug:        debug,
-	}
+	snsSvc snsiface.SNSAPI) {
+	current.Store(newUtil(cfg, clusters, sinks, &Util{
+		DynamoDB: dynamo,
+		EC2:      ec2Svc,
+		ECS:      ecsSvc,
+		SNS:      snsSvc,
+		Mutex:    &sync.Mutex{},
+		Logger:   defaultLogger,
+	}))
 
 	arnToInstanceIDs = make(map[string]*string)
 	instancePrivateIPs = make(map[string]string)
+	containerLabels = make(map[string]map[string]map[string]*string)
+	serviceTags = make(map[string]cachedTags)
+}
+
+// Reload replaces the settings used by new requests. Requests that are in
+// flight finish with the settings they started with. Init must be called first
+func Reload(cfg *config.Config, clusters []*Cluster, sinks []Sink) {
+	current.Store(newUtil(cfg, clusters, sinks, current.Load().(*Util)))
+	configReloads.WithLabelValues("success").Inc()
+	configLastReload.SetToCurrentTime()
+	req := newRequest("Reload::" + strconv.FormatInt(time.Now().Unix(), 10))
+	req.log("reloaded configuration")
+}
+
+// ReloadFailed records that a configuration could not be reloaded
+// The settings in use are kept
+func ReloadFailed(err error) {
+	configReloads.WithLabelValues("failure").Inc()
+	req := newRequest("Reload::" + strconv.FormatInt(time.Now().Unix(), 10))
+	req.error("error reloading configuration. keeping the current one: " + err.Error())
+}
+
+// newUtil creates settings from cfg sharing the aws clients and lock of prev
+func newUtil(cfg *config.Config, clusters []*Cluster, sinks []Sink, prev *Util) *Util {
+	for _, cluster := range clusters {
+		if cluster.ECS == nil {
+			cluster.ECS = prev.ECS
+		}
+		if cluster.EC2 == nil {
+			cluster.EC2 = prev.EC2
+		}
+	}
+	return &Util{
+		TraefikTable:  cfg.Tables.Traefik,
+		Owner:         cfg.Owner,
+		Prune:         cfg.Prune,
+		Ready:         cfg.Ready,
+		Dedupe:        cfg.Dedupe,
+		dedupe:        newDedupe(cfg.Dedupe, prev.dedupe),
+		deadLetters:   newDeadLetters(cfg.DeadLetters, prev.deadLetters),
+		capture:       newCapture(cfg.Capture, prev.capture),
+		TopicArns:     cfg.Auth.TopicArns,
+		Clusters:      clusters,
+		NamePolicy:    cfg.NamePolicy,
+		WriteStrategy: cfg.WriteStrategy,
+		retry:         newRetryPolicy(cfg.Retry),
+		filter:        newServiceFilter(cfg.Services),
+		naming:        newNaming(cfg.Naming),
+		TaskPolicy:    cfg.Tasks.Policy,
+		TaskGroups:    cfg.Tasks.Groups,
+		PortLabel:     cfg.Labels.Port,
+		DynamoDB:      prev.DynamoDB,
+		EC2:           prev.EC2,
+		ECS:           prev.ECS,
+		SNS:           prev.SNS,
+		Mutex:         prev.Mutex,
+		Debug:         cfg.Debug,
+		Logger:        prev.Logger,
+		levels:        newLevels(cfg.Logging, cfg.Debug),
+		DryRun:        cfg.DryRun,
+		Sinks:         sinks,
+	}
 }
 
 func (req *request) getIP(containerInstanceArn string) (string, error) {
@@ -161,64 +271,95 @@ func (req *request) getIP(containerInstanceArn string) (string, error) {
 	return ip, nil
 }
 
-// debug is just a crappy debugging mechanism
-func (req *request) debug(str string) {
-	if !util.Debug {
-		return
-	}
-
-	_, file, line, ok := runtime.Caller(1)
-	if ok {
-		base := filepath.Base(file)
-		fmt.Printf("%s::%d::%s::%s\n", base, line, string(req.id), str)
+// processECSEventMessage parses an event from ECS and updates dynamodb accordingly
+func (req *request) processECSEventMessage(msg Detail) error {
+	change, err := req.eventChange(msg)
+	if err != nil || change == nil {
+		return err
 	}
+	return req.withService(change.backend).applyChange(*change)
 }
 
-func (req *request) log(str interface{}) {
-	fmt.Printf("%s ::: %s\n", string(req.id), str)
+// serverChange is a server an event adds to or removes from a backend
+type serverChange struct {
+	backend string
+	address taskAddress
+	running bool
 }
 
-// processECSEventMessage parses an event from ECS and updates dynamodb accordingly
-func (req *request) processECSEventMessage(msg Detail) error {
+// eventChange works out the server an event adds or removes. It is nil when
+// the event doesn't change anything
+func (req *request) eventChange(msg Detail) (*serverChange, error) {
 	if len(msg.Containers) < 1 {
 		req.debug("skipping message. no containers listed")
-		return nil
+		return nil, nil
+	}
+	serviceName, tracked, err := req.eventBackendName(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "eventBackendName("+msg.Group+")")
+	}
+	if !tracked {
+		req.debug("skipping message. task group is not tracked: " + msg.Group)
+		return nil, nil
 	}
-	if len(msg.Containers[0].NetworkBindings) < 1 {
+	req = req.withService(serviceName)
+	req.annotate(attribute.String("ecs.service", serviceName))
+	running := msg.LastStatus == Running && msg.DesiredStatus == Running
+	if !running && msg.DesiredStatus != Stopped {
+		req.debug("skipping...")
+		return nil, nil
+	}
+	port, err := req.hostPort(msg.TaskDefinitionArn, msg.Containers)
+	if err != nil {
+		return nil, errors.Wrap(err, "hostPort("+msg.TaskDefinitionArn+")")
+	}
+	if port == 0 {
 		req.debug("skipping message. no networkbindings on container")
-		return nil
+		return nil, nil
 	}
-	serviceName := strings.Split(msg.Group, ":")[1]
 	ip, err := req.getIP(msg.ContainerInstanceArn)
 	if err != nil {
 		req.debug("unable to get port")
-		return errors.Wrap(err, "getIP("+msg.ContainerInstanceArn+")")
+		return nil, errors.Wrap(err, "getIP("+msg.ContainerInstanceArn+")")
 	}
-	// Assuming only one container and one networkbinding exists...
-	hostPort := strconv.Itoa(msg.Containers[0].NetworkBindings[0].HostPort)
-	if hostPort == "" {
-		return errors.New("error HostPort doesn't exist")
+	address := taskAddress{
+		TaskArn: msg.TaskArn,
+		IP:      ip,
+		Port:    int64(port),
 	}
-	portIP := ip + ":" + hostPort
+	return &serverChange{backend: serviceName, address: address, running: running}, nil
+}
 
-	if msg.LastStatus == Running && msg.DesiredStatus == Running {
+// applyChange adds or removes the server of a change in dynamodb and the sinks
+func (req *request) applyChange(change serverChange) error {
+	serviceName, address := change.backend, change.address
+	portIP := address.String()
+	if change.running {
 		// add to dynamodb
 		backend := req.createBackend([]string{portIP})
-		err = req.updateBackendDynamoDB(serviceName, backend, false)
+		err := req.addServersDynamoDB(serviceName, backend)
 		if err != nil {
 			req.debug("unable to update backend in dynamodb for " + serviceName + portIP)
-			return errors.Wrap(err, "updateBackendDynamoDB("+serviceName+","+portIP+")")
+			return errors.Wrap(err, "addServersDynamoDB("+serviceName+","+portIP+")")
 		}
 		req.debug("successfully updated backend in dynamodb for " + serviceName + portIP)
-	} else if msg.DesiredStatus == Stopped {
-		err = req.removeServerFromBackendDynamoDB(serviceName, portIP)
-		if err != nil {
-			req.debug("unable to remove server from backend in dynamodb" + serviceName + portIP)
-			return errors.Wrap(err, "removeServerFromBackendDynamoDB("+serviceName+","+portIP+")")
+		for _, s := range req.sinks() {
+			if err := s.register(req, serviceName, address); err != nil {
+				return errors.Wrap(err, "register("+serviceName+","+portIP+")")
+			}
+		}
+		return nil
+	}
+	err := req.removeServerFromBackendDynamoDB(serviceName, portIP)
+	if err != nil {
+		req.debug("unable to remove server from backend in dynamodb" + serviceName + portIP)
+		return errors.Wrap(err, "removeServerFromBackendDynamoDB("+serviceName+","+portIP+")")
+	}
+	req.debug("successfully removed server from backend in dynamodb" + serviceName + portIP)
+	for _, s := range req.sinks() {
+		if err := s.deregister(req, serviceName, address); err != nil {
+			return errors.Wrap(err, "deregister("+serviceName+","+portIP+")")
 		}
-		req.debug("successfully removed server from backend in dynamodb" + serviceName + portIP)
-	} else {
-		req.debug("skipping...")
 	}
 	return nil
 }
@@ -230,42 +371,82 @@ func DecodeNotification(body io.ReadCloser) (Notification, error) {
 	decoder := json.NewDecoder(body)
 	err := decoder.Decode(&notif)
 	if err != nil {
-		return notif, errors.Wrap(err, "Decode()")
+		return notif, errors.Wrap(withKind(ErrInvalidEvent, err), "Decode()")
 	}
 	return notif, nil
 }
 
 // syncs a given service to dynamodb
-func (req *request) sync(service string) error {
+func (req *request) sync(service string) (err error) {
+	req, span := req.startSpan("sync")
+	defer func() { endSpan(span, err) }()
+	tracked, err := req.included(service)
+	if err != nil {
+		return errors.Wrap(err, "included("+service+")")
+	}
+	if !tracked {
+		req.debug("not syncing filtered out service: " + service)
+		return nil
+	}
 	req.debug("syncing service: " + service)
 
-	backend, err := req.getBackendECS(service)
-	// if its a no bindings error still update the backend with no empty backend
-	if err != nil {
-		return errors.Wrap(err, "getBackendECS("+service+")")
+	taskAddresses, err := req.getTaskAddressesECS(service)
+	// the backend of a service whose tasks lost their bindings is still emptied
+	// so traefik stops routing to the servers they had
+	unbound := errors.Is(err, ErrNoNetworkBindings)
+	if err != nil && !unbound {
+		return errors.Wrap(err, "getTaskAddressesECS("+service+")")
+	}
+	backendName, ierr := req.serviceBackendName(service)
+	if ierr != nil {
+		return errors.Wrap(ierr, "serviceBackendName("+service+")")
 	}
+	if ierr := req.syncBackend(backendName, taskAddresses); ierr != nil {
+		return ierr
+	}
+	if unbound {
+		return errors.Wrap(err, "getTaskAddressesECS("+service+")")
+	}
+	return nil
+}
+
+// syncBackend overwrites a backend in dynamodb and every sink with the addresses of its tasks
+func (req *request) syncBackend(backendName string, taskAddresses []taskAddress) error {
+	backend := req.createBackendFromTasks(taskAddresses)
 
 	// overwrite current backend
-	err = req.updateBackendDynamoDB(service, backend, true)
+	err := req.updateBackendDynamoDB(backendName, backend, true)
 	if err != nil {
 		req.debug("error syncing dyamodb: " + err.Error())
-		return errors.Wrap(err, "updateBackendDynamoDB("+service+", interface{})")
+		return errors.Wrap(err, "updateBackendDynamoDB("+backendName+", interface{})")
+	}
+
+	for _, s := range req.sinks() {
+		if err := s.sync(req, backendName, taskAddresses); err != nil {
+			req.debug("error syncing sink: " + err.Error())
+			return errors.Wrap(err, "sync("+backendName+")")
+		}
 	}
 
 	return nil
 }
 
-// syncs all services in an ecs cluster to dynamodb
+// syncs all services and task groups in an ecs cluster to dynamodb
 func (req *request) syncAll(milliseconds int) error {
 	services, err := req.listServices()
 	if err != nil {
 		return errors.Wrap(err, "listServices()")
 	}
+	services, _, err = req.partitionServices(services)
+	if err != nil {
+		return errors.Wrap(err, "partitionServices()")
+	}
 	for _, service := range services {
-		ierr := req.sync(service)
+		ierr := req.withService(service).sync(service)
 		if ierr != nil {
-			// don't err on services that don't have networkbindings
-			if strings.Contains(ierr.Error(), ErrNoNetworkBindings) {
+			// don't err on services that don't have networkbindings. sync
+			// already emptied their backends
+			if errors.Is(ierr, ErrNoNetworkBindings) {
 				continue
 			}
 
@@ -277,6 +458,12 @@ func (req *request) syncAll(milliseconds int) error {
 		}
 		time.Sleep(time.Duration(milliseconds) * time.Millisecond)
 	}
+	if ierr := req.syncGroups(); ierr != nil {
+		if err == nil {
+			err = errors.New("")
+		}
+		err = errors.Wrap(ierr, "syncGroups()")
+	}
 	if err != nil {
 		req.debug("error one or more services were unable to be synced")
 		return errors.Wrap(err, "error syncing one or more services")
@@ -287,20 +474,35 @@ func (req *request) syncAll(milliseconds int) error {
 // compares what is stored in dynamodb to what is returned from ecs api calls
 // for a give service in the ecs cluster
 // NOTE: it only compares the Servers see traefik types.Server
-// returns true, nil if there is no difference
-//    and false, nil if there is a difference
-//    and false, err if there was an error at any point in the process
-func (req *request) diff(service string) (bool, error) {
+// returns StatusInSync, nil if there is no difference
+//    and StatusOutOfSync, nil if there is a difference
+//    and StatusIgnored, nil if the service is excluded by the service filters
+//    and "", err if there was an error at any point in the process
+func (req *request) diff(service string) (status string, err error) {
+	req, span := req.startSpan("diff")
+	defer func() { endSpan(span, err) }()
+	tracked, err := req.included(service)
+	if err != nil {
+		return "", errors.Wrap(err, "included("+service+")")
+	}
+	if !tracked {
+		req.debug("not diffing filtered out service: " + service)
+		return StatusIgnored, nil
+	}
 	req.debug("diffing service: " + service)
 	ecsBackend, err := req.getBackendECS(service)
 	// ignore the error if it was caused by no networkbindings
 	if err != nil {
-		return false, errors.Wrap(err, "getBackendECS("+service+")")
+		return "", errors.Wrap(err, "getBackendECS("+service+")")
+	}
+	backendName, err := req.serviceBackendName(service)
+	if err != nil {
+		return "", errors.Wrap(err, "serviceBackendName("+service+")")
 	}
-	dynamoBackend, err := req.getBackend(service)
+	dynamoBackend, err := req.getBackend(backendName)
 	// ignore the error if it was caused by item not being in dynamodb
-	if err != nil && !strings.Contains(err.Error(), ErrItemNotFound) {
-		return false, errors.Wrap(err, "getBackend( "+service+")")
+	if err != nil && !errors.Is(err, ErrItemNotFound) {
+		return "", errors.Wrap(err, "getBackend( "+backendName+")")
 	}
 
 	// only compare servers. we will allow different config to be set manually for the backend
@@ -309,11 +511,11 @@ func (req *request) diff(service string) (bool, error) {
 	// in dynamodb without worrying about it getting modified by this program
 	if reflect.DeepEqual(ecsBackend.Servers, dynamoBackend.Servers) {
 		req.debug("the " + service + " service is in sync")
-		return true, nil
+		return StatusInSync, nil
 	}
 
 	req.debug("the " + service + " service is NOT in sync")
-	return false, nil
+	return StatusOutOfSync, nil
 }
 
 // creates a types.Backend given a []string of addresses (ip:port)
@@ -332,12 +534,22 @@ func (req *request) createBackend(addresses []string) types.Backend {
 	return backend
 }
 
+// creates a types.Backend from the addresses of tasks
+func (req *request) createBackendFromTasks(taskAddresses []taskAddress) types.Backend {
+	addresses := make([]string, len(taskAddresses))
+	for i, address := range taskAddresses {
+		addresses[i] = address.String()
+	}
+	return req.createBackend(addresses)
+}
+
 // creates a BackendItem given the name of the backend and the types.Backend
 func (req *request) createBackendItem(name string, backend types.Backend) BackendItem {
 	backendItem := BackendItem{
 		Backend: backend,
+		Owner:   req.util.Owner,
 		EndItem: EndItem{
-			ID:      name + "__backend",
+			ID:      req.backendID(name),
 			Name:    name,
 			Version: 0,
 		},
@@ -5,19 +5,32 @@ import (
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
+// errNilContext is what the mocks fail with where the sdk would panic on a
+// request without a context
+var errNilContext = errors.New("context cannot be nil")
+
 type DynamodbMock struct {
 	dynamodbiface.DynamoDBAPI
 	Items      map[string]map[string]*dynamodb.AttributeValue
 	FailGet    bool
 	FailPut    bool
 	FailUpdate bool
+	// Table is what DescribeTable returns. nil means the table doesn't exist
+	Table *dynamodb.TableDescription
+	// TableTags are the tags CreateTable was called with
+	TableTags []*dynamodb.Tag
 }
 
-func (d *DynamodbMock) GetItem(params *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+func (d *DynamodbMock) GetItemWithContext(ctx aws.Context, params *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	if d.FailGet {
 		return nil, errors.New("boolfai")
 	}
@@ -33,7 +46,10 @@ func (d *DynamodbMock) GetItem(params *dynamodb.GetItemInput) (*dynamodb.GetItem
 	return output, nil
 }
 
-func (d *DynamodbMock) PutItem(params *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+func (d *DynamodbMock) PutItemWithContext(ctx aws.Context, params *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	if d.FailPut {
 		return nil, errors.New("boofai")
 	}
@@ -42,13 +58,28 @@ func (d *DynamodbMock) PutItem(params *dynamodb.PutItemInput) (*dynamodb.PutItem
 	if idS == nil {
 		return nil, errors.New("bad params")
 	}
+	// dedupe claims only replace items that expired by :now
+	if now := params.ExpressionAttributeValues[":now"]; now != nil {
+		existing, ok := d.Items[*idS]
+		if ok && unix(existing["expires"]) > unix(now) {
+			return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+		}
+	}
 
 	d.Items[*idS] = params.Item
 
 	return &dynamodb.PutItemOutput{}, nil
 }
 
-func (d *DynamodbMock) UpdateItem(params *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+func unix(value *dynamodb.AttributeValue) int64 {
+	seconds, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+	return seconds
+}
+
+func (d *DynamodbMock) UpdateItemWithContext(ctx aws.Context, params *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	if d.FailUpdate {
 		return nil, errors.New("boolfai")
 	}
@@ -58,6 +89,15 @@ func (d *DynamodbMock) UpdateItem(params *dynamodb.UpdateItemInput) (*dynamodb.U
 		return nil, errors.New("bad params")
 	}
 
+	// map path updates of a single server
+	if addr := params.ExpressionAttributeNames["#addr"]; addr != nil {
+		return d.updateServer(*idS, *addr, params.ExpressionAttributeValues[":srv"])
+	}
+	// prune marks leave the version alone
+	if params.ExpressionAttributeNames["#oa"] != nil {
+		return d.updateOrphanedAt(*idS, params.ExpressionAttributeValues[":oa"], params.ExpressionAttributeValues[":v"])
+	}
+
 	tmpItem, ok := d.Items[*idS]
 	if !ok {
 		return nil, errors.New("bad params")
@@ -87,16 +127,59 @@ func (d *DynamodbMock) UpdateItem(params *dynamodb.UpdateItemInput) (*dynamodb.U
 	return &dynamodb.UpdateItemOutput{}, nil
 }
 
+// updateServer sets or, when server is nil, removes one server of a backend and
+// fails its condition like dynamodb when there are no servers or nothing to remove
+func (d *DynamodbMock) updateServer(id, addr string, server *dynamodb.AttributeValue) (*dynamodb.UpdateItemOutput, error) {
+	conditionFailed := awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	item, ok := d.Items[id]
+	if !ok || item["backend"] == nil || item["backend"].M["servers"] == nil {
+		return nil, conditionFailed
+	}
+	servers := item["backend"].M["servers"].M
+	if server != nil {
+		servers[addr] = server
+	} else if _, exists := servers[addr]; exists {
+		delete(servers, addr)
+	} else {
+		return nil, conditionFailed
+	}
+
+	version, err := strconv.Atoi(aws.StringValue(item["version"].N))
+	if err != nil {
+		return nil, errors.New("bad item: version missing")
+	}
+	item["version"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(version + 1))}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+// updateOrphanedAt sets or, when orphanedAt is nil, removes the prune mark of a
+// backend and fails its condition like dynamodb when the version isn't version
+func (d *DynamodbMock) updateOrphanedAt(id string, orphanedAt, version *dynamodb.AttributeValue) (*dynamodb.UpdateItemOutput, error) {
+	item, ok := d.Items[id]
+	if !ok || aws.StringValue(item["version"].N) != aws.StringValue(version.N) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}
+	if orphanedAt != nil {
+		item["orphanedAt"] = orphanedAt
+	} else {
+		delete(item, "orphanedAt")
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
 func (d *DynamodbMock) PutBackend(item map[string]*dynamodb.AttributeValue) error {
 	params := &dynamodb.PutItemInput{
 		Item:      item,
 		TableName: aws.String("test"),
 	}
-	_, err := d.PutItem(params)
+	_, err := d.PutItemWithContext(aws.BackgroundContext(), params)
 	return err
 }
 
-func (d *DynamodbMock) DeleteItem(params *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+func (d *DynamodbMock) DeleteItemWithContext(ctx aws.Context, params *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	id := params.Key["id"]
 	if id == nil || id.S == nil {
 		return nil, errors.New("Bad params. No 'id'")
@@ -104,3 +187,44 @@ func (d *DynamodbMock) DeleteItem(params *dynamodb.DeleteItemInput) (*dynamodb.D
 	delete(d.Items, *id.S)
 	return nil, nil
 }
+
+func (d *DynamodbMock) ScanPagesWithContext(ctx aws.Context, params *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(d.Items))
+	for _, item := range d.Items {
+		items = append(items, item)
+	}
+	fn(&dynamodb.ScanOutput{Items: items}, true)
+	return nil
+}
+
+func (d *DynamodbMock) DescribeTableWithContext(ctx aws.Context, params *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
+	if d.Table == nil || aws.StringValue(d.Table.TableName) != aws.StringValue(params.TableName) {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found", nil)
+	}
+	return &dynamodb.DescribeTableOutput{Table: d.Table}, nil
+}
+
+// CreateTableWithContext creates a table that is active right away
+func (d *DynamodbMock) CreateTableWithContext(ctx aws.Context, params *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
+	if d.Table != nil {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, "Table already exists", nil)
+	}
+	d.Table = &dynamodb.TableDescription{
+		TableName:            params.TableName,
+		TableStatus:          aws.String(dynamodb.TableStatusActive),
+		KeySchema:            params.KeySchema,
+		AttributeDefinitions: params.AttributeDefinitions,
+		BillingModeSummary:   &dynamodb.BillingModeSummary{BillingMode: params.BillingMode},
+	}
+	d.TableTags = params.Tags
+	return &dynamodb.CreateTableOutput{TableDescription: d.Table}, nil
+}
@@ -3,6 +3,8 @@ package utils_test
 import (
 	"errors"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
@@ -13,7 +15,10 @@ type Ec2Mock struct {
 	ReturnError bool
 }
 
-func (e *Ec2Mock) DescribeInstances(params *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+func (e *Ec2Mock) DescribeInstancesWithContext(ctx aws.Context, params *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	if e.ReturnError {
 		return nil, errors.New("some error")
 	}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 )
@@ -13,6 +15,10 @@ type EcsMock struct {
 	ContainerInstances map[string]*ecs.ContainerInstance
 	Services           map[string]bool
 	Tasks              map[string]*ecs.Task
+	TaskDefinitions    map[string]*ecs.TaskDefinition
+	ServiceTags        map[string]map[string]string
+	// ClusterStatus is the status DescribeClusters reports. Empty is ACTIVE
+	ClusterStatus string
 }
 
 func (e *EcsMock) AddContainerInstance(instance *ecs.ContainerInstance) {
@@ -46,6 +52,7 @@ func (e *EcsMock) RemoveService(service string) {
 func (e *EcsMock) GetServices() []*string {
 	services := make([]*string, 0)
 	for service := range e.Services {
+		service := service
 		services = append(services, &service)
 	}
 	return services
@@ -86,7 +93,10 @@ func (e *EcsMock) GetTaskArns() []*string {
 	return arns
 }
 
-func (e *EcsMock) DescribeContainerInstances(params *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error) {
+func (e *EcsMock) DescribeContainerInstancesWithContext(ctx aws.Context, params *ecs.DescribeContainerInstancesInput, opts ...request.Option) (*ecs.DescribeContainerInstancesOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	containerInstances := e.GetContainerInstances()
 	if len(containerInstances) == 0 {
 		return nil, errors.New("boom")
@@ -97,7 +107,10 @@ func (e *EcsMock) DescribeContainerInstances(params *ecs.DescribeContainerInstan
 	}, nil
 }
 
-func (e *EcsMock) ListServicesPages(params *ecs.ListServicesInput, fn func(*ecs.ListServicesOutput, bool) bool) error {
+func (e *EcsMock) ListServicesPagesWithContext(ctx aws.Context, params *ecs.ListServicesInput, fn func(*ecs.ListServicesOutput, bool) bool, opts ...request.Option) error {
+	if ctx == nil {
+		return errNilContext
+	}
 	services := e.GetServices()
 	if len(services) == 0 {
 		return errors.New("boom fail")
@@ -117,7 +130,10 @@ func (e *EcsMock) ListServicesPages(params *ecs.ListServicesInput, fn func(*ecs.
 	return nil
 }
 
-func (e *EcsMock) ListTasksPages(params *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool) error {
+func (e *EcsMock) ListTasksPagesWithContext(ctx aws.Context, params *ecs.ListTasksInput, fn func(*ecs.ListTasksOutput, bool) bool, opts ...request.Option) error {
+	if ctx == nil {
+		return errNilContext
+	}
 	taskArns := e.GetTaskArns()
 	if len(taskArns) == 0 {
 		return nil
@@ -140,7 +156,10 @@ func (e *EcsMock) ListTasksPages(params *ecs.ListTasksInput, fn func(*ecs.ListTa
 	return nil
 }
 
-func (e *EcsMock) DescribeTasks(params *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+func (e *EcsMock) DescribeTasksWithContext(ctx aws.Context, params *ecs.DescribeTasksInput, opts ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	if len(e.Tasks) == 0 {
 		return nil, errors.New("bofal")
 	}
@@ -149,3 +168,54 @@ func (e *EcsMock) DescribeTasks(params *ecs.DescribeTasksInput) (*ecs.DescribeTa
 		Tasks: e.GetTasks(),
 	}, nil
 }
+
+func (e *EcsMock) DescribeTaskDefinitionWithContext(ctx aws.Context, params *ecs.DescribeTaskDefinitionInput, opts ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
+	taskDefinition, ok := e.TaskDefinitions[*params.TaskDefinition]
+	if !ok {
+		return nil, errors.New("ClientException: Unable to describe task definition")
+	}
+	return &ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: taskDefinition,
+	}, nil
+}
+
+func (e *EcsMock) DescribeServicesWithContext(ctx aws.Context, params *ecs.DescribeServicesInput, opts ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
+	if len(params.Services) > 10 {
+		return nil, errors.New("InvalidParameterException: too many services")
+	}
+	services := make([]*ecs.Service, 0)
+	for _, name := range params.Services {
+		if !e.Services["garbage/"+*name] {
+			continue
+		}
+		service := &ecs.Service{ServiceName: name}
+		for key, value := range e.ServiceTags[*name] {
+			service.Tags = append(service.Tags, &ecs.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		services = append(services, service)
+	}
+	return &ecs.DescribeServicesOutput{
+		Services: services,
+	}, nil
+}
+
+func (e *EcsMock) DescribeClustersWithContext(ctx aws.Context, params *ecs.DescribeClustersInput, opts ...request.Option) (*ecs.DescribeClustersOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
+	status := e.ClusterStatus
+	if status == "" {
+		status = "ACTIVE"
+	}
+	clusters := make([]*ecs.Cluster, len(params.Clusters))
+	for i, name := range params.Clusters {
+		clusters[i] = &ecs.Cluster{ClusterName: name, Status: aws.String(status)}
+	}
+	return &ecs.DescribeClustersOutput{Clusters: clusters}, nil
+}
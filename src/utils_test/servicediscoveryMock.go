@@ -0,0 +1,95 @@
+package utils_test
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/aws/aws-sdk-go/service/servicediscovery/servicediscoveryiface"
+)
+
+type ServiceDiscoveryMock struct {
+	servicediscoveryiface.ServiceDiscoveryAPI
+	// Services maps service names to service ids
+	Services map[string]string
+	// Instances maps service ids to instance ids to attributes
+	Instances      map[string]map[string]map[string]*string
+	FailRegister   bool
+	FailDeregister bool
+	// ServiceLists counts the calls listing services
+	ServiceLists int
+}
+
+func (s *ServiceDiscoveryMock) AddService(name, id string) {
+	s.Services[name] = id
+	s.Instances[id] = make(map[string]map[string]*string)
+}
+
+func (s *ServiceDiscoveryMock) ListServicesPagesWithContext(ctx aws.Context, params *servicediscovery.ListServicesInput, fn func(*servicediscovery.ListServicesOutput, bool) bool, opts ...request.Option) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	s.ServiceLists++
+	summaries := make([]*servicediscovery.ServiceSummary, 0)
+	for name, id := range s.Services {
+		summaries = append(summaries, &servicediscovery.ServiceSummary{
+			Id:   aws.String(id),
+			Name: aws.String(name),
+		})
+	}
+	fn(&servicediscovery.ListServicesOutput{Services: summaries}, true)
+	return nil
+}
+
+func (s *ServiceDiscoveryMock) ListInstancesPagesWithContext(ctx aws.Context, params *servicediscovery.ListInstancesInput, fn func(*servicediscovery.ListInstancesOutput, bool) bool, opts ...request.Option) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	instances, ok := s.Instances[*params.ServiceId]
+	if !ok {
+		return errors.New(servicediscovery.ErrCodeServiceNotFound)
+	}
+	summaries := make([]*servicediscovery.InstanceSummary, 0)
+	for id, attributes := range instances {
+		summaries = append(summaries, &servicediscovery.InstanceSummary{
+			Id:         aws.String(id),
+			Attributes: attributes,
+		})
+	}
+	fn(&servicediscovery.ListInstancesOutput{Instances: summaries}, true)
+	return nil
+}
+
+func (s *ServiceDiscoveryMock) RegisterInstanceWithContext(ctx aws.Context, params *servicediscovery.RegisterInstanceInput, opts ...request.Option) (*servicediscovery.RegisterInstanceOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
+	if s.FailRegister {
+		return nil, errors.New("boofai")
+	}
+	instances, ok := s.Instances[*params.ServiceId]
+	if !ok {
+		return nil, errors.New(servicediscovery.ErrCodeServiceNotFound)
+	}
+	instances[*params.InstanceId] = params.Attributes
+	return &servicediscovery.RegisterInstanceOutput{}, nil
+}
+
+func (s *ServiceDiscoveryMock) DeregisterInstanceWithContext(ctx aws.Context, params *servicediscovery.DeregisterInstanceInput, opts ...request.Option) (*servicediscovery.DeregisterInstanceOutput, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
+	if s.FailDeregister {
+		return nil, errors.New("boofai")
+	}
+	instances, ok := s.Instances[*params.ServiceId]
+	if !ok {
+		return nil, errors.New(servicediscovery.ErrCodeServiceNotFound)
+	}
+	if _, ok := instances[*params.InstanceId]; !ok {
+		return nil, errors.New(servicediscovery.ErrCodeInstanceNotFound)
+	}
+	delete(instances, *params.InstanceId)
+	return &servicediscovery.DeregisterInstanceOutput{}, nil
+}
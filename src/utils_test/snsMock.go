@@ -0,0 +1,28 @@
+package utils_test
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+type SnsMock struct {
+	snsiface.SNSAPI
+	// Subscriptions maps topic arns to their subscriptions
+	Subscriptions map[string][]*sns.Subscription
+}
+
+func (s *SnsMock) ListSubscriptionsByTopicPagesWithContext(ctx aws.Context, params *sns.ListSubscriptionsByTopicInput, fn func(*sns.ListSubscriptionsByTopicOutput, bool) bool, opts ...request.Option) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	subscriptions, ok := s.Subscriptions[aws.StringValue(params.TopicArn)]
+	if !ok {
+		return errors.New("NotFound: Topic does not exist")
+	}
+	fn(&sns.ListSubscriptionsByTopicOutput{Subscriptions: subscriptions}, true)
+	return nil
+}
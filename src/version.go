@@ -0,0 +1,59 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/labstack/echo"
+	"github.com/tskinn/ecs-task-tracker/src/config"
+	"github.com/tskinn/ecs-task-tracker/src/utils"
+)
+
+// set at build time by scripts/build_binary.sh with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// buildInfo describes the running binary and the configuration it runs with
+type buildInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	BuildTime  string `json:"buildTime"`
+	GoVersion  string `json:"goVersion"`
+	ConfigHash string `json:"configHash,omitempty"`
+}
+
+// currentBuild is the build of the binary with the hash of the active configuration
+func currentBuild() buildInfo {
+	build := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+	if cfg, ok := active.Load().(*config.Config); ok {
+		build.ConfigHash = cfg.Hash()
+	}
+	return build
+}
+
+func (b buildInfo) String() string {
+	out := "ecs-task-tracker " + b.Version + " (commit " + b.Commit + ", built " + b.BuildTime + ", " + b.GoVersion + ")"
+	if b.ConfigHash != "" {
+		out += " config " + b.ConfigHash
+	}
+	return out
+}
+
+// recordBuild updates the build info metric with the active configuration
+func recordBuild() {
+	b := currentBuild()
+	utils.RecordBuildInfo(b.Version, b.Commit, b.BuildTime, b.GoVersion, b.ConfigHash)
+}
+
+// versionHandler reports the build and the hash of the active configuration
+func versionHandler(c echo.Context) error {
+	return c.JSON(200, currentBuild())
+}